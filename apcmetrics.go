@@ -20,12 +20,20 @@ package main
 
 import (
 	"context"
+	"encoding/csv"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"runtime"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
+	"text/tabwriter"
 	"time"
 
 	"github.com/go-kit/log"
@@ -35,6 +43,7 @@ import (
 	"gopkg.in/alecthomas/kingpin.v2"
 
 	"github.com/56quarters/apcmetrics/pkg/apcmetrics"
+	"github.com/56quarters/apcmetrics/pkg/apcmetrics/apctest"
 )
 
 // Set by the build process: -ldflags="-X 'main.Version=xyz'"
@@ -44,6 +53,34 @@ var (
 	Revision string
 )
 
+// Exit codes for commands that fail, based on the type of error encountered.
+const (
+	exitFailure    = 1
+	exitConnection = 2
+	exitTimeout    = 3
+	exitProtocol   = 4
+	exitParse      = 5
+)
+
+func exitCode(err error) int {
+	var connErr *apcmetrics.ConnectionError
+	var timeoutErr *apcmetrics.TimeoutError
+	var protocolErr *apcmetrics.ProtocolError
+	var parseErr *apcmetrics.ParseError
+
+	if errors.As(err, &timeoutErr) {
+		return exitTimeout
+	} else if errors.As(err, &connErr) {
+		return exitConnection
+	} else if errors.As(err, &protocolErr) {
+		return exitProtocol
+	} else if errors.As(err, &parseErr) {
+		return exitParse
+	}
+
+	return exitFailure
+}
+
 func setupLogger(l level.Option) log.Logger {
 	logger := log.NewSyncLogger(log.NewLogfmtLogger(os.Stderr))
 	logger = level.NewFilter(logger, l)
@@ -55,48 +92,523 @@ func main() {
 	logger := setupLogger(level.AllowInfo())
 
 	kp := kingpin.New(os.Args[0], "apcmetrics: APC UPS metrics exporter for Prometheus")
-	upsAddress := kp.Flag("ups.address", "Address and port of the apcupsd daemon to connect to").Default("localhost:3551").String()
-	upsTimeout := kp.Flag("ups.timeout", "Max time reads from the apcupsd daemon may take").Default("5s").Duration()
+	configFile := kp.Flag("config.file", "YAML file to load configuration from, overriding settings from CLI flags").Default("").String()
+	target := kp.Flag("target", "Name of the target from the configuration file to use for commands other than metrics, the first target if empty").Default("").String()
+	upsAddress := kp.Flag("ups.address", "Address and port of the apcupsd daemon to connect to").Default(apcmetrics.DefaultNisAddress).String()
+	upsTimeout := kp.Flag("ups.timeout", "Max time reads from the apcupsd daemon may take").Default(apcmetrics.DefaultTimeout.String()).Duration()
+	upsPersistent := kp.Flag("ups.persistent", "Reuse a single connection to the apcupsd daemon for all requests").Default("false").Bool()
+	upsSource := kp.Flag("ups.source", "Where to read UPS status and events from, one of nis (the apcupsd daemon), file (files written by apcupsd), nut (the upsd daemon of Network UPS Tools), snmp (the SNMP agent of the UPS), or replay (a recording made by the record command)").Default("nis").Enum("nis", "file", "nut", "snmp", "replay")
+	upsStatusFile := kp.Flag("ups.status-file", "Status file written by apcupsd to read when using the file source").Default(apcmetrics.DefaultStatusFile).String()
+	upsEventsFile := kp.Flag("ups.events-file", "Events file written by apcupsd to read when using the file source").Default(apcmetrics.DefaultEventsFile).String()
+	upsNutAddress := kp.Flag("ups.nut-address", "Address and port of the NUT upsd daemon to connect to when using the nut source").Default(apcmetrics.DefaultNutAddress).String()
+	upsNutName := kp.Flag("ups.nut-name", "Name of the UPS configured in NUT to use when using the nut source").Default(apcmetrics.DefaultNutUps).String()
+	upsSnmpAddress := kp.Flag("ups.snmp-address", "Address and port of the SNMP agent of the UPS to query when using the snmp source").Default(apcmetrics.DefaultSnmpAddress).String()
+	upsSnmpVersion := kp.Flag("ups.snmp-version", "SNMP version to use, one of 2c or 3").Default("2c").Enum("2c", "3")
+	upsSnmpCommunity := kp.Flag("ups.snmp-community", "SNMP v2c community").Default(apcmetrics.DefaultSnmpCommunity).String()
+	upsSnmpUser := kp.Flag("ups.snmp-user", "SNMP v3 user name").Default("").String()
+	upsSnmpAuthProtocol := kp.Flag("ups.snmp-auth-protocol", "SNMP v3 authentication protocol, one of md5, sha, sha224, sha256, sha384, or sha512, no authentication if empty").Default("").String()
+	upsSnmpAuthPassword := kp.Flag("ups.snmp-auth-password", "SNMP v3 authentication password").Default("").String()
+	upsSnmpPrivProtocol := kp.Flag("ups.snmp-priv-protocol", "SNMP v3 privacy protocol, one of des, aes, aes192, or aes256, no privacy if empty").Default("").String()
+	upsSnmpPrivPassword := kp.Flag("ups.snmp-priv-password", "SNMP v3 privacy password").Default("").String()
+	upsReplayFile := kp.Flag("ups.replay-file", "Recording made by the record command to serve when using the replay source").Default("").String()
 
 	metrics := kp.Command("metrics", "Export Prometheus metrics via HTTP")
-	metricsPath := metrics.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-	metricsAddress := metrics.Flag("web.listen-address", "Address and port to expose Prometheus metrics on").Default(":9780").String()
+	metricsPath := metrics.Flag("web.telemetry-path", "Path under which to expose metrics.").Default(apcmetrics.DefaultTelemetryPath).String()
+	metricsAddress := metrics.Flag("web.listen-address", "Address and port to expose Prometheus metrics on").Default(apcmetrics.DefaultListenAddress).String()
+	probePath := metrics.Flag("web.probe-path", "Path under which to expose metrics for arbitrary apcupsd targets.").Default(apcmetrics.DefaultProbePath).String()
+	outagesPath := metrics.Flag("web.outages-path", "Path under which to expose samples taken during recent outages as JSON, only when --poll.interval is set.").Default(apcmetrics.DefaultOutagesPath).String()
+	metricsLenient := metrics.Flag("metrics.lenient", "Export all fields of the UPS status that can be parsed instead of failing when any field cannot be parsed").Default("false").Bool()
+	genericFields := metrics.Flag("metrics.generic-fields", "Export numeric fields of the UPS status that have no specific metric as apc_field").Default("false").Bool()
+	pollInterval := metrics.Flag("poll.interval", "Fetch UPS status in the background at this interval instead of on every scrape, disabled if zero").Default("0s").Duration()
+	pollBatteryInterval := metrics.Flag("poll.battery-interval", "Fetch UPS status in the background at this interval while the UPS is on batteries, sampling it into the apc_battery_sample_* histograms and /outages. Only used when --poll.interval is set").Default(apcmetrics.DefaultBatteryInterval.String()).Duration()
+	pollMaxAge := metrics.Flag("poll.max-age", "Max age of UPS status fetched in the background to serve for scrapes, three times the poll interval plus the timeout if zero").Default("0s").Duration()
+	eventsCountInterval := metrics.Flag("events.interval", "How often to check for new events to export as apc_events_total, disabled if zero. Events are never checked for the nut and snmp sources since they have no events").Default("0s").Duration()
+	eventsStateFile := metrics.Flag("events.state-file", "File to persist counts of events to between restarts, counts start from zero on each restart if empty").Default("").String()
+	legacyStatus := metrics.Flag("metrics.legacy-status", "Export the apc_status metric with the STATUS reported by apcupsd as a label").Default("false").Bool()
 
 	status := kp.Command("status", "Display the current status of the UPS as JSON")
 	statusRaw := status.Flag("raw", "Output the unparsed status response from apcupsd").Default("false").Bool()
+	statusLenient := status.Flag("lenient", "Output all fields that can be parsed and log fields that cannot instead of failing").Default("false").Bool()
 
 	events := kp.Command("events", "Display recent UPS events as JSON")
 	eventsRaw := events.Flag("raw", "Output the unparsed events response from apcupsd").Default("false").Bool()
+	eventsFollow := events.Flag("follow", "Output new events as JSON lines as they happen until interrupted").Short('f').Default("false").Bool()
+	eventsInterval := events.Flag("interval", "How often to check for new events when following").Default("10s").Duration()
+
+	outages := kp.Command("outages", "Display outages derived from recent UPS events")
+	outagesFormat := outages.Flag("format", "Output format for outages, one of json, csv, or table").Default("table").Enum("json", "csv", "table")
+	outagesSince := outages.Flag("since", "Only display outages that started within this long ago, all outages if zero").Default("0s").Duration()
+
+	check := kp.Command("check", "Check the status of the UPS against thresholds as a Nagios or Icinga plugin")
+	checkChargeWarning := check.Flag("charge-warning", "Warning if the battery charge percentage is below this, disabled if zero").Default("50").Float64()
+	checkChargeCritical := check.Flag("charge-critical", "Critical if the battery charge percentage is below this, disabled if zero").Default("25").Float64()
+	checkTimeLeftWarning := check.Flag("time-left-warning", "Warning if the remaining runtime is below this, disabled if zero").Default("10m").Duration()
+	checkTimeLeftCritical := check.Flag("time-left-critical", "Critical if the remaining runtime is below this, disabled if zero").Default("5m").Duration()
+	checkLoadWarning := check.Flag("load-warning", "Warning if the load percentage is above this, disabled if zero").Default("80").Float64()
+	checkLoadCritical := check.Flag("load-critical", "Critical if the load percentage is above this, disabled if zero").Default("95").Float64()
+	checkBatteryAgeWarning := check.Flag("battery-age-warning", "Warning if the batteries were replaced more than this many days ago, disabled if zero").Default("1095").Int()
+	checkBatteryAgeCritical := check.Flag("battery-age-critical", "Critical if the batteries were replaced more than this many days ago, disabled if zero").Default("0").Int()
+	checkSelfTestAgeWarning := check.Flag("self-test-age-warning", "Warning if the last self test was more than this many days ago, disabled if zero").Default("0").Int()
+	checkSelfTestAgeCritical := check.Flag("self-test-age-critical", "Critical if the last self test was more than this many days ago, disabled if zero").Default("0").Int()
+	checkOnBattery := check.Flag("on-battery", "State when the UPS is running on batteries, one of ok, warning, or critical").Default("warning").Enum("ok", "warning", "critical")
+
+	record := kp.Command("record", "Save raw status and events responses to a file to be replayed later")
+	recordOutput := record.Flag("output", "File to append recorded responses to").Short('o').Required().String()
+	recordInterval := record.Flag("interval", "How often to record status and events").Default("10s").Duration()
+	recordCount := record.Flag("count", "Number of times to record status and events before exiting, until interrupted if zero").Default("0").Int()
+	recordEvents := record.Flag("events", "Record events in addition to status").Default("true").Bool()
+
+	simulate := kp.Command("simulate", "Run a fake apcupsd NIS server that simulates a UPS going through a scenario such as a power failure")
+	simulateAddress := simulate.Flag("listen-address", "Address and port to run the fake apcupsd NIS server on").Default("localhost:3551").String()
+	simulateScenario := simulate.Flag("scenario", "Scenario to simulate, one of "+strings.Join(apctest.ScenarioNames(), ", ")).Default(apctest.ScenarioPowerFailure).Enum(apctest.ScenarioNames()...)
+	simulateDelay := simulate.Flag("delay", "How long the UPS is on mains before the scenario starts").Default("30s").Duration()
+	simulateDuration := simulate.Flag("duration", "How long each power failure of the scenario lasts").Default("5m").Duration()
+	simulateRuntime := simulate.Flag("runtime", "How long the batteries of the UPS last from a full charge").Default(apctest.DefaultRuntime.String()).Duration()
+	simulateRecharge := simulate.Flag("recharge-time", "How long the batteries of the UPS take to charge from empty to full").Default(apctest.DefaultRechargeTime.String()).Duration()
+	simulateLoad := simulate.Flag("load", "Percentage of load capacity of the UPS in use").Default("20").Float64()
+	simulateSpeed := simulate.Flag("speed", "How many times faster than real time to run the scenario").Default("1").Float64()
 
 	command, err := kp.Parse(os.Args[1:])
 	if err != nil {
 		level.Error(logger).Log("msg", "failed to parse CLI options", "err", err)
-		os.Exit(1)
+		os.Exit(exitFailure)
+	}
+
+	base := apcmetrics.Config{
+		Web: apcmetrics.WebConfig{
+			ListenAddress: *metricsAddress,
+			TelemetryPath: *metricsPath,
+			ProbePath:     *probePath,
+			OutagesPath:   *outagesPath,
+		},
+		Metrics: apcmetrics.MetricsConfig{
+			Lenient:       *metricsLenient,
+			GenericFields: *genericFields,
+			LegacyStatus:  *legacyStatus,
+		},
+		Poll: apcmetrics.PollConfig{
+			Interval:        *pollInterval,
+			BatteryInterval: *pollBatteryInterval,
+			MaxAge:          *pollMaxAge,
+		},
+		Events: apcmetrics.EventsConfig{
+			Interval:  *eventsCountInterval,
+			StateFile: *eventsStateFile,
+		},
+		Timeout: *upsTimeout,
+		Targets: []apcmetrics.TargetConfig{{
+			Name:       "default",
+			Source:     *upsSource,
+			Persistent: *upsPersistent,
+			StatusFile: *upsStatusFile,
+			EventsFile: *upsEventsFile,
+			NutName:    *upsNutName,
+			Snmp: apcmetrics.SnmpOptions{
+				Version:      *upsSnmpVersion,
+				Community:    *upsSnmpCommunity,
+				User:         *upsSnmpUser,
+				AuthProtocol: *upsSnmpAuthProtocol,
+				AuthPassword: *upsSnmpAuthPassword,
+				PrivProtocol: *upsSnmpPrivProtocol,
+				PrivPassword: *upsSnmpPrivPassword,
+			},
+			ReplayFile: *upsReplayFile,
+		}},
+	}
+
+	switch *upsSource {
+	case apcmetrics.SourceNis:
+		base.Targets[0].Address = *upsAddress
+	case apcmetrics.SourceNut:
+		base.Targets[0].Address = *upsNutAddress
+	case apcmetrics.SourceSnmp:
+		base.Targets[0].Address = *upsSnmpAddress
 	}
 
-	client := apcmetrics.NewApcClient(*upsAddress, logger)
+	// the config is only loaded by commands that use it so that a bad source
+	// config can't prevent running a simulation
+	loadConfig := func() *apcmetrics.Config {
+		cfg, err := apcmetrics.LoadConfig(*configFile, base)
+		if err != nil {
+			level.Error(logger).Log("msg", "invalid configuration", "file", *configFile, "err", err)
+			os.Exit(exitFailure)
+		}
+
+		return cfg
+	}
 
 	switch command {
 	case metrics.FullCommand():
-		if err := serveMetrics(client, logger, *upsTimeout, *metricsPath, *metricsAddress); err != nil {
+		if err := serveMetrics(loadConfig(), *configFile, base, logger); err != nil {
 			level.Error(logger).Log("msg", "unable to serve UPS metrics", "err", err)
-			os.Exit(1)
+			os.Exit(exitFailure)
 		}
 	case status.FullCommand():
-		if err := showStatus(client, *upsTimeout, *statusRaw); err != nil {
+		err := withSource(loadConfig(), *target, logger, func(source apcmetrics.Source, timeout time.Duration) error {
+			return showStatus(source, logger, timeout, *statusRaw, *statusLenient)
+		})
+
+		if err != nil {
 			level.Error(logger).Log("msg", "unable to get UPS status", "err", err)
-			os.Exit(1)
+			os.Exit(exitCode(err))
 		}
 	case events.FullCommand():
-		if err := showEvents(client, *upsTimeout, *eventsRaw); err != nil {
+		err := withSource(loadConfig(), *target, logger, func(source apcmetrics.Source, timeout time.Duration) error {
+			if *eventsFollow {
+				return followEvents(source, logger, timeout, *eventsInterval, *eventsRaw)
+			}
+
+			return showEvents(source, timeout, *eventsRaw)
+		})
+
+		if err != nil {
 			level.Error(logger).Log("msg", "unable to get UPS events", "err", err)
-			os.Exit(1)
+			os.Exit(exitCode(err))
+		}
+	case outages.FullCommand():
+		err := withSource(loadConfig(), *target, logger, func(source apcmetrics.Source, timeout time.Duration) error {
+			return showOutages(source, timeout, *outagesFormat, *outagesSince)
+		})
+
+		if err != nil {
+			level.Error(logger).Log("msg", "unable to get UPS outages", "err", err)
+			os.Exit(exitCode(err))
+		}
+	case check.FullCommand():
+		day := 24 * time.Hour
+		thresholds := apcmetrics.CheckThresholds{
+			ChargeWarning:       apcmetrics.Percent(*checkChargeWarning),
+			ChargeCritical:      apcmetrics.Percent(*checkChargeCritical),
+			TimeLeftWarning:     *checkTimeLeftWarning,
+			TimeLeftCritical:    *checkTimeLeftCritical,
+			LoadWarning:         apcmetrics.Percent(*checkLoadWarning),
+			LoadCritical:        apcmetrics.Percent(*checkLoadCritical),
+			BatteryAgeWarning:   time.Duration(*checkBatteryAgeWarning) * day,
+			BatteryAgeCritical:  time.Duration(*checkBatteryAgeCritical) * day,
+			SelfTestAgeWarning:  time.Duration(*checkSelfTestAgeWarning) * day,
+			SelfTestAgeCritical: time.Duration(*checkSelfTestAgeCritical) * day,
+			OnBattery:           checkStates[*checkOnBattery],
+		}
+
+		if err := thresholds.Validate(); err != nil {
+			fmt.Printf("APC %s - invalid thresholds: %s\n", apcmetrics.CheckUnknown, strings.ReplaceAll(err.Error(), "\n", ", "))
+			os.Exit(int(apcmetrics.CheckUnknown))
+		}
+
+		state := apcmetrics.CheckUnknown
+		err := withSource(loadConfig(), *target, logger, func(source apcmetrics.Source, timeout time.Duration) error {
+			state = checkStatus(source, timeout, thresholds)
+			return nil
+		})
+
+		if err != nil {
+			fmt.Printf("APC %s - %s\n", apcmetrics.CheckUnknown, err)
+		}
+
+		os.Exit(int(state))
+	case record.FullCommand():
+		err := withSource(loadConfig(), *target, logger, func(source apcmetrics.Source, timeout time.Duration) error {
+			return recordResponses(source, logger, timeout, *recordOutput, *recordInterval, *recordCount, *recordEvents)
+		})
+
+		if err != nil {
+			level.Error(logger).Log("msg", "unable to record UPS responses", "err", err)
+			os.Exit(exitCode(err))
+		}
+	case simulate.FullCommand():
+		scenario, err := apctest.NewScenario(*simulateScenario, *simulateDelay, *simulateDuration)
+		if err != nil {
+			level.Error(logger).Log("msg", "invalid scenario", "err", err)
+			os.Exit(exitFailure)
+		}
+
+		opts := apctest.SimulatorOptions{
+			Runtime:      *simulateRuntime,
+			RechargeTime: *simulateRecharge,
+			Load:         *simulateLoad,
+			Speed:        *simulateSpeed,
+		}
+
+		if err := runSimulation(logger, *simulateAddress, scenario, opts); err != nil {
+			level.Error(logger).Log("msg", "unable to run simulation", "err", err)
+			os.Exit(exitFailure)
+		}
+	}
+}
+
+// withSource creates the source of the target given by name, the first target if
+// empty, and calls fn with it and the timeout of the target, closing the source
+// once fn returns.
+func withSource(cfg *apcmetrics.Config, name string, logger log.Logger, fn func(apcmetrics.Source, time.Duration) error) error {
+	t, err := cfg.Target(name)
+	if err != nil {
+		return err
+	}
+
+	source, err := apcmetrics.NewSource(t, logger)
+	if err != nil {
+		return fmt.Errorf("unable to create source for target %s: %w", t.Name, err)
+	}
+
+	defer func() {
+		if c, ok := source.(io.Closer); ok {
+			_ = c.Close()
+		}
+	}()
+
+	return fn(source, cfg.TimeoutFor(t))
+}
+
+// serveMetrics serves metrics for all targets of the config until the HTTP
+// server fails. The config is reloaded from the config file and environment on
+// SIGHUP, keeping the previous config if the new one is invalid. The HTTP server
+// keeps running during reloads, so changes to the listen address require a restart.
+func serveMetrics(cfg *apcmetrics.Config, configFile string, base apcmetrics.Config, logger log.Logger) error {
+	exp := newExporter(logger)
+	if err := exp.Apply(cfg); err != nil {
+		return err
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloaded, err := apcmetrics.LoadConfig(configFile, base)
+			if err != nil {
+				level.Error(logger).Log("msg", "unable to reload configuration, keeping previous configuration", "file", configFile, "err", err)
+				continue
+			}
+
+			if err := exp.Apply(reloaded); err != nil {
+				level.Error(logger).Log("msg", "unable to apply configuration, keeping previous configuration", "file", configFile, "err", err)
+				continue
+			}
+
+			if reloaded.Web.ListenAddress != cfg.Web.ListenAddress {
+				level.Warn(logger).Log("msg", "listen address cannot be changed without restarting", "address", cfg.Web.ListenAddress, "configured", reloaded.Web.ListenAddress)
+			}
+
+			level.Info(logger).Log("msg", "reloaded configuration", "file", configFile, "targets", len(reloaded.Targets), "path", reloaded.Web.TelemetryPath, "probe", reloaded.Web.ProbePath)
+		}
+	}()
+
+	level.Info(logger).Log("msg", "serving Prometheus metrics", "targets", len(cfg.Targets), "path", cfg.Web.TelemetryPath, "probe", cfg.Web.ProbePath, "address", cfg.Web.ListenAddress)
+	return http.ListenAndServe(cfg.Web.ListenAddress, exp)
+}
+
+// exporter is an http.Handler that serves metrics for the targets of a config.
+// The config can be replaced while running, after which requests are served
+// using collectors and handlers built for the new config.
+type exporter struct {
+	logger log.Logger
+
+	mtx     sync.Mutex
+	handler http.Handler
+	stop    func()
+	cfg     *apcmetrics.Config
+	// counters are the event counters of each target by name, handed over to
+	// the counters of the same targets when a new config is applied
+	counters map[string]*apcmetrics.EventCounter
+}
+
+func newExporter(logger log.Logger) *exporter {
+	return &exporter{
+		logger:  logger,
+		handler: http.NotFoundHandler(),
+	}
+}
+
+func (e *exporter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.mtx.Lock()
+	h := e.handler
+	e.mtx.Unlock()
+
+	h.ServeHTTP(w, r)
+}
+
+// Apply starts serving metrics for the config, then stops background polling and
+// closes connections used for the previous config. The new config is built and
+// started before the previous one is stopped so that requests are always served
+// and the previous sources aren't used after they're closed. Event counters using
+// the same state file (or of targets with the same name if counts aren't persisted)
+// are handed over to the new config so that counts are never loaded from a state
+// file that is still being written.
+// If the config can't be used, the previous config keeps running.
+func (e *exporter) Apply(cfg *apcmetrics.Config) error {
+	handler, stop, counters, err := e.build(cfg)
+	if err != nil {
+		return err
+	}
+
+	e.mtx.Lock()
+	prevStop := e.stop
+	e.cfg = cfg
+	e.handler = handler
+	e.stop = stop
+	e.counters = counters
+	e.mtx.Unlock()
+
+	if prevStop != nil {
+		prevStop()
+	}
+
+	return nil
+}
+
+// previousCounter returns the event counter from the previous config that used the
+// state file, or of the target with the same name if counts aren't persisted, nil if
+// there isn't one.
+func (e *exporter) previousCounter(t apcmetrics.TargetConfig, stateFile string) *apcmetrics.EventCounter {
+	e.mtx.Lock()
+	defer e.mtx.Unlock()
+
+	for name, c := range e.counters {
+		if stateFile != "" && c.StateFile() == stateFile {
+			return c
+		} else if stateFile == "" && c.StateFile() == "" && name == t.Name {
+			return c
+		}
+	}
+
+	return nil
+}
+
+// build creates a registry and handlers for the config and starts any background
+// polling, returning a function to stop polling, wait for it to finish, and close
+// the sources of all targets along with the event counters of each target.
+// Each target is registered separately with its own labels so that the registry
+// collects them concurrently and a slow target only delays scrapes by its own timeout.
+func (e *exporter) build(cfg *apcmetrics.Config) (http.Handler, func(), map[string]*apcmetrics.EventCounter, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	var sources []apcmetrics.Source
+	stop := func() {
+		cancel()
+		wg.Wait()
+		for _, s := range sources {
+			if c, ok := s.(io.Closer); ok {
+				_ = c.Close()
+			}
+		}
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		newVersionInfo(),
+	)
+
+	opts := apcmetrics.CollectorOptions{
+		LegacyStatus:  cfg.Metrics.LegacyStatus,
+		Lenient:       cfg.Metrics.Lenient,
+		GenericFields: cfg.Metrics.GenericFields,
+	}
+
+	pollers := make(map[string]*apcmetrics.ApcPoller)
+	counters := make(map[string]*apcmetrics.EventCounter)
+	for _, t := range cfg.Targets {
+		source, poller, err := e.registerTarget(ctx, &wg, cfg, t, opts, registry, counters)
+		if source != nil {
+			sources = append(sources, source)
+		}
+
+		if err != nil {
+			stop()
+			return nil, nil, nil, fmt.Errorf("target %s: %w", t.Name, err)
+		}
+
+		if poller != nil {
+			pollers[t.Name] = poller
+		}
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(cfg.Web.TelemetryPath, promhttp.InstrumentMetricHandler(registry, promhttp.HandlerFor(registry, promhttp.HandlerOpts{})))
+	if len(pollers) > 0 {
+		mux.Handle(cfg.Web.OutagesPath, outagesHandler(pollers, cfg.Targets[0].Name, e.logger))
+	}
+
+	mux.Handle(cfg.Web.ProbePath, probeHandler(cfg, e.logger, opts))
+	return mux, stop, counters, nil
+}
+
+// registerTarget creates the source of a target and registers collectors for it,
+// starting any background polling of the target until the context is canceled,
+// tracked by wg. The event counter of the target, if any, is added to counters.
+// The source is returned even if registering collectors fails so that it can be
+// closed by the caller.
+func (e *exporter) registerTarget(ctx context.Context, wg *sync.WaitGroup, cfg *apcmetrics.Config, t apcmetrics.TargetConfig, opts apcmetrics.CollectorOptions, registry *prometheus.Registry, counters map[string]*apcmetrics.EventCounter) (apcmetrics.Source, *apcmetrics.ApcPoller, error) {
+	logger := log.With(e.logger, "target", t.Name)
+	source, err := apcmetrics.NewSource(t, logger)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	timeout := cfg.TimeoutFor(t)
+	if cfg.Poll.Interval > 0 {
+		opts.Poller = apcmetrics.NewApcPoller(source, apcmetrics.PollerOptions{
+			Interval:        cfg.Poll.Interval,
+			BatteryInterval: cfg.Poll.BatteryInterval,
+			Timeout:         timeout,
+			MaxAge:          cfg.Poll.MaxAge,
+		}, logger)
+	}
+
+	var counter *apcmetrics.EventCounter
+	if cfg.Events.Interval > 0 && !t.HasEvents() {
+		level.Debug(logger).Log("msg", "not counting events for source without events", "source", t.Source)
+	} else if cfg.Events.Interval > 0 {
+		stateFile := cfg.StateFileFor(t)
+		watcher := apcmetrics.NewEventWatcher(source, cfg.Events.Interval, timeout, logger)
+		if prev := e.previousCounter(t, stateFile); prev != nil {
+			counter = prev.Handover(watcher, logger)
+		} else if counter, err = apcmetrics.NewEventCounter(watcher, stateFile, logger); err != nil {
+			return source, nil, fmt.Errorf("unable to load event counts from %s: %w", stateFile, err)
+		}
+
+		counters[t.Name] = counter
+	}
+
+	collectors := []prometheus.Collector{apcmetrics.NewApcCollector(source, timeout, opts, logger)}
+	if nis, ok := source.(*apcmetrics.ApcClient); ok {
+		collectors = append(collectors, apcmetrics.NewApcClientCollector(nis))
+	}
+	if opts.Poller != nil {
+		collectors = append(collectors, apcmetrics.NewApcPollerCollector(opts.Poller))
+	}
+	if counter != nil {
+		collectors = append(collectors, apcmetrics.NewApcEventCollector(counter))
+	}
+
+	targetRegistry := prometheus.WrapRegistererWith(cfg.LabelsFor(t), registry)
+	for _, c := range collectors {
+		if err := targetRegistry.Register(c); err != nil {
+			return source, nil, err
 		}
 	}
+
+	if opts.Poller != nil {
+		poller := opts.Poller
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			poller.Run(ctx)
+		}()
+	}
+	if counter != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			counter.Run(ctx)
+		}()
+	}
+
+	return source, opts.Poller, nil
 }
 
-func serveMetrics(client *apcmetrics.ApcClient, logger log.Logger, upsTimeout time.Duration, metricsPath string, metricsAddress string) error {
-	versionInfo := prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+func newVersionInfo() prometheus.Collector {
+	return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
 		Namespace: "apcmetrics",
 		Name:      "build_info",
 		Help:      "APC Metrics version information",
@@ -107,32 +619,112 @@ func serveMetrics(client *apcmetrics.ApcClient, logger log.Logger, upsTimeout ti
 			"goversion": runtime.Version(),
 		},
 	}, func() float64 { return 1 })
-	prometheus.MustRegister(versionInfo)
-	prometheus.MustRegister(apcmetrics.NewApcCollector(client, upsTimeout, logger))
+}
 
-	http.Handle(metricsPath, promhttp.Handler())
-	level.Info(logger).Log("msg", "serving Prometheus metrics", "path", metricsPath, "address", metricsAddress)
-	if err := http.ListenAndServe(metricsAddress, nil); err != nil {
-		return err
-	}
+// probeHandler returns an http.Handler that collects metrics from the UPS given
+// by the "target" query parameter. The target is either the name of a target from
+// the config or the address of an apcupsd daemon. A new source and registry are
+// created for each request so that a single exporter can be used to collect
+// metrics from any number of UPSes, similar to the blackbox or SNMP exporters.
+// Probes are always made on-demand for each request, never using a poller. Metrics
+// always have the "ups" label set to the target: the name of a target from the config,
+// along with its labels, or the address of the apcupsd daemon.
+func probeHandler(cfg *apcmetrics.Config, logger log.Logger, opts apcmetrics.CollectorOptions) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
+			return
+		}
 
-	return nil
+		var labels map[string]string
+		targetConfig, err := cfg.Target(target)
+		if err == nil {
+			labels = cfg.LabelsFor(targetConfig)
+		} else {
+			targetConfig = apcmetrics.TargetConfig{Name: target, Source: apcmetrics.SourceNis, Address: target}
+			labels = map[string]string{apcmetrics.TargetLabel: target}
+		}
+
+		targetLogger := log.With(logger, "target", target)
+		source, err := apcmetrics.NewSource(targetConfig, targetLogger)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("unable to create UPS source: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		if c, ok := source.(io.Closer); ok {
+			defer func() { _ = c.Close() }()
+		}
+
+		registry := prometheus.NewRegistry()
+		opts.Probe = true
+		collector := apcmetrics.NewApcCollector(source, cfg.TimeoutFor(targetConfig), opts, targetLogger)
+		if err := prometheus.WrapRegistererWith(labels, registry).Register(collector); err != nil {
+			level.Error(targetLogger).Log("msg", "unable to register probe collector", "err", err)
+			http.Error(w, fmt.Sprintf("unable to register collector: %s", err), http.StatusInternalServerError)
+			return
+		}
+
+		h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+		h.ServeHTTP(w, r)
+	})
+}
+
+// outagesHandler returns an http.Handler that displays samples of UPS status
+// taken by the poller during recent outages as JSON. The target is given by the
+// "target" query parameter, using the default target if it isn't specified.
+func outagesHandler(pollers map[string]*apcmetrics.ApcPoller, defaultTarget string, logger log.Logger) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			target = defaultTarget
+		}
+
+		poller, ok := pollers[target]
+		if !ok {
+			http.Error(w, fmt.Sprintf("unknown target %q", target), http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(poller.Outages()); err != nil {
+			level.Error(logger).Log("msg", "unable to encode outages", "err", err)
+		}
+	})
 }
 
-func showStatus(client *apcmetrics.ApcClient, upsTimeout time.Duration, raw bool) error {
+func showStatus(source apcmetrics.Source, logger log.Logger, upsTimeout time.Duration, raw bool, lenient bool) error {
 	ctx, cancel := context.WithTimeout(context.Background(), upsTimeout)
 	defer cancel()
 
 	var output string
 	if raw {
-		lines, err := client.StatusRaw(ctx)
+		lines, err := source.StatusRaw(ctx)
 		if err != nil {
 			return err
 		}
 
 		output = strings.Join(lines, "\n")
+	} else if lenient {
+		lines, err := source.StatusRaw(ctx)
+		if err != nil {
+			return err
+		}
+
+		status, parseErrs := apcmetrics.ParseStatusFromLinesLenient(lines)
+		for _, e := range parseErrs {
+			level.Warn(logger).Log("msg", "unable to parse UPS status field", "field", e.Field, "value", e.Value, "err", e.Err)
+		}
+
+		bytes, err := json.MarshalIndent(status, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		output = string(bytes)
 	} else {
-		status, err := client.Status(ctx)
+		status, err := source.Status(ctx)
 		if err != nil {
 			return err
 		}
@@ -149,20 +741,20 @@ func showStatus(client *apcmetrics.ApcClient, upsTimeout time.Duration, raw bool
 	return nil
 }
 
-func showEvents(client *apcmetrics.ApcClient, upsTimeout time.Duration, raw bool) error {
+func showEvents(source apcmetrics.Source, upsTimeout time.Duration, raw bool) error {
 	ctx, cancel := context.WithTimeout(context.Background(), upsTimeout)
 	defer cancel()
 
 	var output string
 	if raw {
-		lines, err := client.EventsRaw(ctx)
+		lines, err := source.EventsRaw(ctx)
 		if err != nil {
 			return err
 		}
 
 		output = strings.Join(lines, "\n")
 	} else {
-		events, err := client.Events(ctx)
+		events, err := source.Events(ctx)
 		if err != nil {
 			return err
 		}
@@ -178,3 +770,216 @@ func showEvents(client *apcmetrics.ApcClient, upsTimeout time.Duration, raw bool
 	fmt.Println(output)
 	return nil
 }
+
+func followEvents(source apcmetrics.Source, logger log.Logger, upsTimeout time.Duration, interval time.Duration, raw bool) error {
+	if raw {
+		return errors.New("raw output cannot be used when following events")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	enc := json.NewEncoder(os.Stdout)
+	watcher := apcmetrics.NewEventWatcher(source, interval, upsTimeout, logger)
+	for e := range watcher.Watch(ctx) {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func showOutages(source apcmetrics.Source, upsTimeout time.Duration, format string, since time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), upsTimeout)
+	defer cancel()
+
+	events, err := source.Events(ctx)
+	if err != nil {
+		return err
+	}
+
+	status, err := source.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	outages := apcmetrics.OutagesSince(apcmetrics.FindOutages(events, status, now), since, now)
+
+	summary := apcmetrics.SummarizeOutages(outages)
+
+	switch format {
+	case "json":
+		bytes, err := json.MarshalIndent(struct {
+			Outages []apcmetrics.Outage      `json:"outages"`
+			Summary apcmetrics.OutageSummary `json:"summary"`
+		}{Outages: outages, Summary: summary}, "", "  ")
+		if err != nil {
+			return err
+		}
+
+		fmt.Println(string(bytes))
+	case "csv":
+		w := csv.NewWriter(os.Stdout)
+		_ = w.Write([]string{"start", "end", "duration_seconds", "reason", "cause"})
+		for _, o := range outages {
+			_ = w.Write([]string{
+				o.Start.Format(time.RFC3339),
+				formatOutageEnd(o, time.RFC3339),
+				strconv.FormatFloat(o.Duration.Seconds(), 'f', -1, 64),
+				o.Reason,
+				o.Cause,
+			})
+		}
+
+		w.Flush()
+		return w.Error()
+	default:
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "START\tEND\tDURATION\tREASON\tCAUSE")
+		for _, o := range outages {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n",
+				o.Start.Format(time.DateTime),
+				formatOutageEnd(o, time.DateTime),
+				o.Duration.Round(time.Second),
+				o.Reason,
+				o.Cause,
+			)
+		}
+
+		fmt.Fprintln(w)
+		fmt.Fprintf(w, "Outages:\t%d\n", summary.Count)
+		fmt.Fprintf(w, "Total:\t%s\n", summary.Total.Round(time.Second))
+		fmt.Fprintf(w, "Mean:\t%s\n", summary.Mean.Round(time.Second))
+		fmt.Fprintf(w, "Shortest:\t%s\n", summary.Shortest.Round(time.Second))
+		fmt.Fprintf(w, "Longest:\t%s\n", summary.Longest.Round(time.Second))
+		return w.Flush()
+	}
+
+	return nil
+}
+
+// checkStates are states for the check command by name.
+var checkStates = map[string]apcmetrics.CheckState{
+	"ok":       apcmetrics.CheckOK,
+	"warning":  apcmetrics.CheckWarning,
+	"critical": apcmetrics.CheckCritical,
+}
+
+// checkStatus prints the result of checking the status of the UPS against
+// thresholds in the format used by Nagios and Icinga plugins and returns the
+// state of the check to be used as the exit code.
+func checkStatus(source apcmetrics.Source, upsTimeout time.Duration, thresholds apcmetrics.CheckThresholds) apcmetrics.CheckState {
+	ctx, cancel := context.WithTimeout(context.Background(), upsTimeout)
+	defer cancel()
+
+	status, err := source.Status(ctx)
+	if err != nil {
+		fmt.Printf("APC %s - unable to get UPS status: %s\n", apcmetrics.CheckUnknown, err)
+		return apcmetrics.CheckUnknown
+	}
+
+	res := apcmetrics.CheckStatus(status, thresholds, time.Now())
+
+	text := res.Summary
+	if len(res.Problems) > 0 {
+		text = res.Problems
+	}
+
+	perfData := make([]string, 0, len(res.PerfData))
+	for _, p := range res.PerfData {
+		perfData = append(perfData, p.String())
+	}
+
+	if len(perfData) == 0 {
+		fmt.Printf("APC %s - %s\n", res.State, strings.Join(text, ", "))
+	} else {
+		fmt.Printf("APC %s - %s | %s\n", res.State, strings.Join(text, ", "), strings.Join(perfData, " "))
+	}
+	return res.State
+}
+
+// recordResponses appends raw status and, optionally, events responses to a file
+// at each interval until count responses have been recorded or interrupted.
+// Failed requests are logged and are only recorded if a truncated or malformed
+// response was received.
+func recordResponses(source apcmetrics.Source, logger log.Logger, upsTimeout time.Duration, output string, interval time.Duration, count int, events bool) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	f, err := os.OpenFile(output, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	recorder := apcmetrics.NewRecorder(source, f)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for i := 0; count == 0 || i < count; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-ticker.C:
+			}
+		}
+
+		reqCtx, cancel := context.WithTimeout(ctx, upsTimeout)
+		if _, err := recorder.StatusRaw(reqCtx); err != nil {
+			level.Warn(logger).Log("msg", "unable to record UPS status", "err", err)
+		}
+
+		if events {
+			if _, err := recorder.EventsRaw(reqCtx); err != nil {
+				level.Warn(logger).Log("msg", "unable to record UPS events", "err", err)
+			}
+		}
+
+		cancel()
+	}
+
+	return nil
+}
+
+// runSimulation serves the status and events of a simulated UPS going through
+// the scenario until interrupted. The UPS remains on mains once the scenario ends.
+func runSimulation(logger log.Logger, address string, scenario apctest.Scenario, opts apctest.SimulatorOptions) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	sim := apctest.NewSimulator(scenario, opts)
+	server, err := apctest.NewServer(address, sim, logger)
+	if err != nil {
+		return err
+	}
+
+	level.Info(logger).Log("msg", "simulating UPS", "scenario", scenario.Name, "address", server.Addr(), "speed", opts.Speed)
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	done := false
+	for {
+		select {
+		case <-ctx.Done():
+			return server.Close()
+		case <-ticker.C:
+			if !done && sim.Done() {
+				level.Info(logger).Log("msg", "scenario complete, UPS will remain on mains", "scenario", scenario.Name)
+				done = true
+			}
+		}
+	}
+}
+
+func formatOutageEnd(o apcmetrics.Outage, layout string) string {
+	if o.Ongoing() {
+		return "ongoing"
+	}
+
+	return o.End.Format(layout)
+}
@@ -0,0 +1,151 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/56quarters/apcmetrics/pkg/apcmetrics"
+	"github.com/go-kit/log"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{name: "connection", err: &apcmetrics.ConnectionError{Address: "ups:3551", Err: errors.New("refused")}, want: exitConnection},
+		{name: "timeout", err: &apcmetrics.TimeoutError{Address: "ups:3551", Op: "status", Err: errors.New("i/o timeout")}, want: exitTimeout},
+		{name: "protocol", err: &apcmetrics.ProtocolError{Address: "ups:3551", Command: "status", Err: apcmetrics.ErrTruncatedResponse}, want: exitProtocol},
+		{name: "parse", err: &apcmetrics.ParseError{Field: "BCHARGE", Value: "lots", Err: errors.New("invalid")}, want: exitParse},
+		{name: "wrapped", err: fmt.Errorf("unable to get status: %w", &apcmetrics.ParseError{Field: "LINEV"}), want: exitParse},
+		{name: "other", err: errors.New("something else"), want: exitFailure},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := exitCode(tc.err); got != tc.want {
+				t.Errorf("expected exit code %d, got %d", tc.want, got)
+			}
+		})
+	}
+}
+
+// loadTestConfig writes a config file with the targets given as YAML and loads it.
+func loadTestConfig(t *testing.T, targets string) (*apcmetrics.Config, error) {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "config.yml")
+	raw := "events:\n  interval: 1h\ntargets:\n" + targets
+	if err := os.WriteFile(path, []byte(raw), 0644); err != nil {
+		t.Fatalf("unable to write config: %s", err)
+	}
+
+	return apcmetrics.LoadConfig(path, apcmetrics.Config{Timeout: apcmetrics.DefaultTimeout})
+}
+
+// scrape returns the response body of the metrics endpoint of the exporter.
+func scrape(t *testing.T, exp *exporter) string {
+	t.Helper()
+
+	rec := httptest.NewRecorder()
+	exp.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, apcmetrics.DefaultTelemetryPath, nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, rec.Code)
+	}
+
+	return rec.Body.String()
+}
+
+func TestExporter_Apply(t *testing.T) {
+	recording := filepath.Join("pkg", "apcmetrics", "testdata", "recording.jsonl")
+	stateFile := filepath.Join(t.TempDir(), "events.json")
+	target := func(labels string) string {
+		return "  - name: rack\n    source: replay\n    replay_file: " + recording +
+			"\n    events_state_file: " + stateFile + "\n    labels: {" + labels + "}\n"
+	}
+
+	exp := newExporter(log.NewNopLogger())
+	defer func() { exp.stop() }()
+
+	first, err := loadTestConfig(t, target("site: office"))
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %s", err)
+	}
+
+	if err := exp.Apply(first); err != nil {
+		t.Fatalf("unexpected error applying config: %s", err)
+	}
+
+	if body := scrape(t, exp); !strings.Contains(body, `apc_up{site="office",ups="rack"}`) {
+		t.Fatalf("expected metrics for the first config, got\n%s", body)
+	}
+
+	firstCounter := exp.counters["rack"]
+
+	// a config that can't be used keeps the previous config running
+	missing, err := loadTestConfig(t, "  - name: rack\n    source: replay\n    replay_file: missing.jsonl\n")
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %s", err)
+	}
+
+	if err := exp.Apply(missing); err == nil {
+		t.Fatal("expected error applying config with a missing replay file")
+	}
+
+	if exp.cfg != first || exp.counters["rack"] != firstCounter {
+		t.Fatal("expected the first config to keep running")
+	}
+
+	if body := scrape(t, exp); !strings.Contains(body, `apc_up{site="office",ups="rack"}`) {
+		t.Fatalf("expected metrics for the first config, got\n%s", body)
+	}
+
+	second, err := loadTestConfig(t, target("site: closet"))
+	if err != nil {
+		t.Fatalf("unexpected error loading config: %s", err)
+	}
+
+	if err := exp.Apply(second); err != nil {
+		t.Fatalf("unexpected error applying config: %s", err)
+	}
+
+	if body := scrape(t, exp); !strings.Contains(body, `apc_up{site="closet",ups="rack"}`) {
+		t.Fatalf("expected metrics for the second config, got\n%s", body)
+	}
+
+	// the event counter of the target is handed over instead of loading counts
+	// from the state file it was using
+	secondCounter := exp.counters["rack"]
+	if secondCounter == nil || secondCounter == firstCounter {
+		t.Fatalf("expected a new event counter for the second config, got %v", secondCounter)
+	}
+
+	if secondCounter.StateFile() != stateFile {
+		t.Errorf("expected state file %s, got %s", stateFile, secondCounter.StateFile())
+	}
+}
@@ -4,8 +4,11 @@ go 1.20
 
 require (
 	github.com/go-kit/log v0.1.0
+	github.com/gosnmp/gosnmp v1.36.0
 	github.com/prometheus/client_golang v1.8.0
+	github.com/prometheus/common v0.14.0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v2 v2.3.0
 )
 
 require (
@@ -17,7 +20,6 @@ require (
 	github.com/golang/protobuf v1.4.3 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.1 // indirect
 	github.com/prometheus/client_model v0.2.0 // indirect
-	github.com/prometheus/common v0.14.0 // indirect
 	github.com/prometheus/procfs v0.2.0 // indirect
 	golang.org/x/sys v0.0.0-20201015000850-e3ed0017c211 // indirect
 	google.golang.org/protobuf v1.23.0 // indirect
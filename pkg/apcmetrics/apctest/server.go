@@ -0,0 +1,213 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+// Package apctest provides a fake apcupsd NIS server for testing clients,
+// dashboards, and alerts without a real UPS, along with scenarios that
+// simulate a UPS losing and regaining mains power.
+package apctest
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	statusCommand = "status"
+	eventsCommand = "events"
+
+	// invalidCommand is the response apcupsd sends for unknown commands
+	invalidCommand = "Invalid command"
+)
+
+// Responder provides the lines of the responses to the status and events
+// commands each time they are requested from a Server.
+type Responder interface {
+	Status() []string
+	Events() []string
+}
+
+// Responses is a Responder that always returns the same lines.
+type Responses struct {
+	StatusLines []string
+	EventsLines []string
+}
+
+func (r Responses) Status() []string {
+	return r.StatusLines
+}
+
+func (r Responses) Events() []string {
+	return r.EventsLines
+}
+
+// Server is a fake apcupsd NIS server that responds to the status and events
+// commands using the same length-prefixed protocol as apcupsd. Connections
+// may make any number of requests until they are closed by the client.
+type Server struct {
+	listener  net.Listener
+	responder Responder
+	logger    log.Logger
+
+	mtx    sync.Mutex
+	conns  map[net.Conn]struct{}
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// NewServer starts a Server listening on the given address, such as
+// "localhost:3551" or "127.0.0.1:0" to pick an unused port, that serves
+// responses from responder until Close is called.
+func NewServer(address string, responder Responder, logger log.Logger) (*Server, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Server{
+		listener:  listener,
+		responder: responder,
+		logger:    logger,
+		conns:     make(map[net.Conn]struct{}),
+	}
+
+	s.wg.Add(1)
+	go s.accept()
+	return s, nil
+}
+
+// Addr returns the address the server is listening on, suitable for use with
+// apcmetrics.NewApcClient.
+func (s *Server) Addr() string {
+	return s.listener.Addr().String()
+}
+
+// Close stops accepting connections, closes all open connections, and waits
+// for them to finish.
+func (s *Server) Close() error {
+	s.mtx.Lock()
+	s.closed = true
+	for conn := range s.conns {
+		_ = conn.Close()
+	}
+	s.mtx.Unlock()
+
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+func (s *Server) accept() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				level.Warn(s.logger).Log("msg", "failed to accept connection", "err", err)
+			}
+			return
+		}
+
+		s.mtx.Lock()
+		if s.closed {
+			s.mtx.Unlock()
+			_ = conn.Close()
+			return
+		}
+
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mtx.Unlock()
+
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mtx.Lock()
+		delete(s.conns, conn)
+		s.mtx.Unlock()
+
+		_ = conn.Close()
+		s.wg.Done()
+	}()
+
+	for {
+		cmd, err := readRecord(conn)
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				level.Debug(s.logger).Log("msg", "failed to read command", "remote", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+
+		var lines []string
+		switch strings.TrimSpace(cmd) {
+		case statusCommand:
+			lines = s.responder.Status()
+		case eventsCommand:
+			lines = s.responder.Events()
+		default:
+			lines = []string{invalidCommand}
+		}
+
+		if err := writeResponse(conn, lines); err != nil {
+			level.Debug(s.logger).Log("msg", "failed to write response", "remote", conn.RemoteAddr(), "err", err)
+			return
+		}
+	}
+}
+
+// readRecord reads a single record, a two byte, big-endian, length followed by
+// that many bytes of text.
+func readRecord(r io.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// writeResponse writes each line as a record followed by an empty record to
+// indicate the end of the response, the same way apcupsd does.
+func writeResponse(w io.Writer, lines []string) error {
+	var buf []byte
+	for _, line := range lines {
+		line += "\n"
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(line)))
+		buf = append(buf, line...)
+	}
+
+	buf = binary.BigEndian.AppendUint16(buf, 0)
+	_, err := w.Write(buf)
+	return err
+}
@@ -0,0 +1,388 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apctest
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/56quarters/apcmetrics/pkg/apcmetrics"
+)
+
+const (
+	ScenarioPowerFailure = "power-failure"
+	ScenarioSelfTest     = "self-test"
+	ScenarioFlapping     = "flapping"
+
+	DefaultRuntime      = 30 * time.Minute
+	DefaultRechargeTime = 2 * time.Hour
+
+	// version is reported by the simulated apcupsd
+	version = "3.14.14 (31 May 2016) apcmetrics simulate"
+	// timeFormat is the format of timestamps reported by apcupsd
+	timeFormat = "2006-01-02 15:04:05 -0700"
+	// onBatteryDelay is how long apcupsd waits after a power failure before
+	// logging that the UPS is running on batteries (ONBATTERYDELAY)
+	onBatteryDelay = 6 * time.Second
+	// selfTestDuration is how long a self test keeps the UPS on batteries
+	selfTestDuration = 8 * time.Second
+	// minCharge is the charge at which apcupsd shuts down the system (BATTERYLEVEL)
+	minCharge = 5.0
+)
+
+// Phase is a period of a Scenario during which the UPS is powered by either
+// mains or its batteries.
+type Phase struct {
+	Duration  time.Duration
+	OnBattery bool
+	// SelfTest indicates the UPS is on batteries because of a self test
+	// instead of a power failure.
+	SelfTest bool
+}
+
+// Scenario is a sequence of phases that a simulated UPS goes through. Once all
+// phases have elapsed, the UPS remains on mains.
+type Scenario struct {
+	Name   string
+	Phases []Phase
+}
+
+// ScenarioNames returns the names of all scenarios that can be created by NewScenario.
+func ScenarioNames() []string {
+	return []string{ScenarioPowerFailure, ScenarioSelfTest, ScenarioFlapping}
+}
+
+// NewScenario returns the named scenario. The UPS is on mains for delay before
+// anything happens and each power failure lasts for duration.
+//
+//   - power-failure: mains fails once for duration and then returns.
+//   - self-test: the UPS runs a self test, switching to batteries for a few seconds.
+//   - flapping: mains fails three times for duration, returning for the same
+//     amount of time in between each failure.
+func NewScenario(name string, delay time.Duration, duration time.Duration) (Scenario, error) {
+	mains := Phase{Duration: delay}
+
+	switch name {
+	case ScenarioPowerFailure:
+		return Scenario{Name: name, Phases: []Phase{
+			mains,
+			{Duration: duration, OnBattery: true},
+		}}, nil
+	case ScenarioSelfTest:
+		return Scenario{Name: name, Phases: []Phase{
+			mains,
+			{Duration: selfTestDuration, OnBattery: true, SelfTest: true},
+		}}, nil
+	case ScenarioFlapping:
+		return Scenario{Name: name, Phases: []Phase{
+			mains,
+			{Duration: duration, OnBattery: true},
+			{Duration: duration},
+			{Duration: duration, OnBattery: true},
+			{Duration: duration},
+			{Duration: duration, OnBattery: true},
+		}}, nil
+	}
+
+	return Scenario{}, fmt.Errorf("unknown scenario %q, expected one of %s", name, strings.Join(ScenarioNames(), ", "))
+}
+
+// SimulatorOptions describe the simulated UPS. Defaults are used for any
+// options that are zero.
+type SimulatorOptions struct {
+	// Runtime is how long the batteries last from a full charge. The charge
+	// of the batteries drains linearly while on batteries.
+	Runtime time.Duration
+	// RechargeTime is how long the batteries take to charge from empty to full.
+	// The charge of the batteries increases linearly while on mains.
+	RechargeTime time.Duration
+	// Load is the percentage of load capacity in use.
+	Load float64
+	// Speed is how many times faster than real time the scenario runs.
+	Speed float64
+}
+
+// Simulator is a Responder that reports the status and events of a simulated
+// UPS going through a Scenario, starting from when the simulator was created.
+type Simulator struct {
+	scenario Scenario
+	opts     SimulatorOptions
+	start    time.Time
+}
+
+func NewSimulator(scenario Scenario, opts SimulatorOptions) *Simulator {
+	if opts.Runtime <= 0 {
+		opts.Runtime = DefaultRuntime
+	}
+
+	if opts.RechargeTime <= 0 {
+		opts.RechargeTime = DefaultRechargeTime
+	}
+
+	if opts.Speed <= 0 {
+		opts.Speed = 1
+	}
+
+	return &Simulator{
+		scenario: scenario,
+		opts:     opts,
+		start:    time.Now(),
+	}
+}
+
+// Elapsed returns how far into the scenario the simulator is, accounting for speed.
+func (s *Simulator) Elapsed() time.Duration {
+	return time.Duration(float64(time.Since(s.start)) * s.opts.Speed)
+}
+
+// Done returns true once every phase of the scenario has elapsed.
+func (s *Simulator) Done() bool {
+	var total time.Duration
+	for _, p := range s.scenario.Phases {
+		total += p.Duration
+	}
+
+	return s.Elapsed() >= total
+}
+
+func (s *Simulator) Status() []string {
+	st := s.state()
+	date := st.now.Format(timeFormat)
+
+	states := []string{string(apcmetrics.StateOnline)}
+	flags := apcmetrics.FlagPlugged | apcmetrics.FlagBatteryPresent | apcmetrics.FlagOnline
+	lineVoltage := 120.0
+	battVoltage := 27.3
+
+	if st.onBattery {
+		states = []string{string(apcmetrics.StateOnBattery)}
+		flags = apcmetrics.FlagPlugged | apcmetrics.FlagBatteryPresent | apcmetrics.FlagOnBattery
+		battVoltage = 22.0 + 4.0*st.charge/100
+
+		if !st.selfTest {
+			lineVoltage = 0
+		}
+	}
+
+	if st.lowBattery {
+		states = append(states, string(apcmetrics.StateLowBattery))
+		flags |= apcmetrics.FlagLowBattery
+	}
+
+	timeLeft := time.Duration(float64(s.opts.Runtime) * st.charge / 100)
+
+	return []string{
+		line("APC", "001,036,0866"),
+		line("DATE", date),
+		line("HOSTNAME", "simulated"),
+		line("VERSION", version),
+		line("UPSNAME", s.scenario.Name),
+		line("CABLE", "USB Cable"),
+		line("DRIVER", "USB UPS Driver"),
+		line("UPSMODE", "Stand Alone"),
+		line("STARTTIME", s.start.Format(timeFormat)),
+		line("MODEL", "Simulated UPS"),
+		line("STATUS", strings.Join(states, " ")),
+		line("LINEV", fmt.Sprintf("%.1f Volts", lineVoltage)),
+		line("LOADPCT", fmt.Sprintf("%.1f Percent", s.opts.Load)),
+		line("BCHARGE", fmt.Sprintf("%.1f Percent", st.charge)),
+		line("TIMELEFT", fmt.Sprintf("%.1f Minutes", timeLeft.Minutes())),
+		line("MBATTCHG", fmt.Sprintf("%.0f Percent", minCharge)),
+		line("MINTIMEL", "3 Minutes"),
+		line("MAXTIME", "0 Seconds"),
+		line("SENSE", "Medium"),
+		line("LOTRANS", "88.0 Volts"),
+		line("HITRANS", "139.0 Volts"),
+		line("ALARMDEL", "30 Seconds"),
+		line("BATTV", fmt.Sprintf("%.1f Volts", battVoltage)),
+		line("LASTXFER", st.lastTransfer),
+		line("NUMXFERS", fmt.Sprintf("%d", st.transfers)),
+		line("XONBATT", formatTime(st.xOnBattery)),
+		line("TONBATT", fmt.Sprintf("%.0f Seconds", st.timeOnBattery.Seconds())),
+		line("CUMONBATT", fmt.Sprintf("%.0f Seconds", st.cumulativeOnBattery.Seconds())),
+		line("XOFFBATT", formatTime(st.xOffBattery)),
+		line("SELFTEST", st.selfTestResult),
+		line("STATFLAG", fmt.Sprintf("0x%08X", uint32(flags))),
+		line("SERIALNO", "SIM000000001"),
+		line("BATTDATE", s.start.Format("2006-01-02")),
+		line("NOMINV", "120 Volts"),
+		line("NOMBATTV", "24.0 Volts"),
+		line("NOMPOWER", "900 Watts"),
+		line("FIRMWARE", "simulated"),
+		line("END APC", date),
+	}
+}
+
+func (s *Simulator) Events() []string {
+	st := s.state()
+	sort.SliceStable(st.events, func(i, j int) bool {
+		return st.events[i].time.Before(st.events[j].time)
+	})
+
+	out := make([]string, 0, len(st.events))
+	for _, e := range st.events {
+		// timestamp is separated from message with two spaces
+		out = append(out, e.time.Format(timeFormat)+"  "+e.message)
+	}
+
+	return out
+}
+
+type simEvent struct {
+	time    time.Time
+	message string
+}
+
+// simState is the state of the simulated UPS at a point in time.
+type simState struct {
+	now                 time.Time
+	charge              float64
+	onBattery           bool
+	lowBattery          bool
+	selfTest            bool
+	selfTestResult      string
+	lastTransfer        string
+	transfers           int
+	xOnBattery          time.Time
+	xOffBattery         time.Time
+	timeOnBattery       time.Duration
+	cumulativeOnBattery time.Duration
+	events              []simEvent
+}
+
+// state determines the state of the UPS by replaying the scenario from the start
+// up to the current (simulated) time. Scenarios are short enough that this is
+// simpler than keeping track of state between requests.
+func (s *Simulator) state() *simState {
+	now := s.start.Add(s.Elapsed())
+	st := &simState{
+		now:            now,
+		charge:         100,
+		selfTestResult: "NO",
+		lastTransfer:   "No transfers since turnon",
+		events:         []simEvent{{s.start, fmt.Sprintf("apcupsd %s startup succeeded", version)}},
+	}
+
+	t := s.start
+	for _, p := range s.scenario.Phases {
+		if !t.Before(now) {
+			break
+		}
+
+		end := t.Add(p.Duration)
+		if end.After(now) {
+			end = now
+		}
+
+		if p.OnBattery {
+			s.battery(st, t, end, p.SelfTest)
+		} else {
+			s.mains(st, t, end)
+		}
+
+		t = t.Add(p.Duration)
+	}
+
+	// once the scenario is over, the UPS remains on mains
+	if t.Before(now) {
+		s.mains(st, t, now)
+	}
+
+	return st
+}
+
+func (s *Simulator) battery(st *simState, from time.Time, to time.Time, selfTest bool) {
+	if !st.onBattery {
+		st.onBattery = true
+		st.selfTest = selfTest
+		st.transfers++
+		st.xOnBattery = from
+
+		if selfTest {
+			st.lastTransfer = "Automatic or explicit self test"
+			st.events = append(st.events, simEvent{from, "UPS Self Test switch to battery."})
+		} else {
+			st.lastTransfer = "Low line voltage"
+			st.events = append(st.events, simEvent{from, "Power failure."})
+			if to.Sub(from) >= onBatteryDelay {
+				st.events = append(st.events, simEvent{from.Add(onBatteryDelay), "Running on UPS batteries."})
+			}
+		}
+	}
+
+	elapsed := to.Sub(from)
+	drained := 100 * float64(elapsed) / float64(s.opts.Runtime)
+	if !st.lowBattery && !st.selfTest && st.charge-drained <= minCharge {
+		at := from.Add(time.Duration((st.charge - minCharge) / 100 * float64(s.opts.Runtime)))
+		st.lowBattery = true
+		st.events = append(st.events,
+			simEvent{at, "Battery charge below low limit."},
+			simEvent{at, "Initiating system shutdown!"},
+		)
+	}
+
+	st.charge -= drained
+	if st.charge < 0 {
+		st.charge = 0
+	}
+
+	st.timeOnBattery = to.Sub(st.xOnBattery)
+	st.cumulativeOnBattery += elapsed
+}
+
+func (s *Simulator) mains(st *simState, from time.Time, to time.Time) {
+	if st.onBattery {
+		st.onBattery = false
+		st.lowBattery = false
+		st.timeOnBattery = 0
+		st.xOffBattery = from
+
+		if st.selfTest {
+			st.selfTestResult = "OK"
+			st.events = append(st.events, simEvent{from, "UPS Self Test completed: Battery OK"})
+		} else {
+			st.events = append(st.events,
+				simEvent{from, "Mains returned. No longer on UPS batteries."},
+				simEvent{from, "Power is back. UPS running on mains."},
+			)
+		}
+
+		st.selfTest = false
+	}
+
+	st.charge += 100 * float64(to.Sub(from)) / float64(s.opts.RechargeTime)
+	if st.charge > 100 {
+		st.charge = 100
+	}
+}
+
+// line formats a key and value the same way as each line of the apcupsd status report.
+func line(key string, val string) string {
+	return fmt.Sprintf("%-9s: %s", key, val)
+}
+
+func formatTime(t time.Time) string {
+	if t.IsZero() {
+		return "N/A"
+	}
+
+	return t.Format(timeFormat)
+}
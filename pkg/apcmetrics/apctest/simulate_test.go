@@ -0,0 +1,137 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apctest
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/56quarters/apcmetrics/pkg/apcmetrics"
+)
+
+func TestSimulator_PowerFailure(t *testing.T) {
+	scenario, err := NewScenario(ScenarioPowerFailure, 0, 20*time.Minute)
+	if err != nil {
+		t.Fatalf("unexpected error creating scenario: %s", err)
+	}
+
+	// batteries run out partway through the power failure: at 6000x, low battery
+	// is reached after ~95ms and mains returns after 200ms
+	sim := NewSimulator(scenario, SimulatorOptions{Runtime: 10 * time.Minute, RechargeTime: 10 * time.Minute, Speed: 6000})
+	server, err := NewServer("127.0.0.1:0", sim, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unable to start test server: %s", err)
+	}
+	defer func() { _ = server.Close() }()
+
+	client := apcmetrics.NewApcClient(server.Addr(), apcmetrics.ClientOptions{}, log.NewNopLogger())
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	status := pollUntil(ctx, t, client, func(s *apcmetrics.ApcStatus) bool {
+		return s.States.Has(apcmetrics.StateLowBattery)
+	})
+
+	if !status.States.Has(apcmetrics.StateOnBattery) {
+		t.Errorf("expected UPS to be on battery at low battery, got %v", status.States)
+	}
+
+	if status.Flags == nil || !status.Flags.Has(apcmetrics.FlagLowBattery) {
+		t.Errorf("expected low battery flag to be set, got %v", status.Flags)
+	}
+
+	if status.ChargePercent > minCharge {
+		t.Errorf("expected charge at or below %v at low battery, got %v", minCharge, status.ChargePercent)
+	}
+
+	status = pollUntil(ctx, t, client, func(s *apcmetrics.ApcStatus) bool {
+		return s.States.Has(apcmetrics.StateOnline)
+	})
+
+	if status.States.Has(apcmetrics.StateLowBattery) {
+		t.Errorf("expected low battery to be cleared when mains returns, got %v", status.States)
+	}
+
+	recharged := pollUntil(ctx, t, client, func(s *apcmetrics.ApcStatus) bool {
+		return s.ChargePercent > status.ChargePercent+10
+	})
+
+	if !recharged.States.Has(apcmetrics.StateOnline) {
+		t.Errorf("expected UPS to remain online while recharging, got %v", recharged.States)
+	}
+
+	events, err := client.Events(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error getting events: %s", err)
+	}
+
+	expected := []apcmetrics.EventKind{
+		apcmetrics.EventDaemonStart,
+		apcmetrics.EventPowerFailure,
+		apcmetrics.EventOnBattery,
+		apcmetrics.EventChargeLimit,
+		apcmetrics.EventShutdown,
+		apcmetrics.EventOffBattery,
+		apcmetrics.EventPowerBack,
+	}
+
+	if len(events) != len(expected) {
+		t.Fatalf("expected %d events, got %d: %+v", len(expected), len(events), events)
+	}
+
+	for i, e := range events {
+		if e.Kind != expected[i] {
+			t.Errorf("expected event %d to be %s, got %s (%q)", i, expected[i], e.Kind, e.Message)
+		}
+	}
+
+	// simulated time between events is exact even though the test runs in real time
+	start := events[0].TimeStamp
+	offsets := []time.Duration{0, 0, onBatteryDelay, 9*time.Minute + 30*time.Second, 9*time.Minute + 30*time.Second, 20 * time.Minute, 20 * time.Minute}
+	for i, e := range events {
+		if got := e.TimeStamp.Sub(start); got != offsets[i] {
+			t.Errorf("expected event %d (%q) at %s, got %s", i, e.Message, offsets[i], got)
+		}
+	}
+}
+
+// pollUntil requests the status from the client until done returns true for it.
+func pollUntil(ctx context.Context, t *testing.T, client *apcmetrics.ApcClient, done func(*apcmetrics.ApcStatus) bool) *apcmetrics.ApcStatus {
+	t.Helper()
+
+	for {
+		status, err := client.Status(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error getting status: %s", err)
+		}
+
+		if done(status) {
+			return status
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Fatalf("timed out waiting for status, last status %v", status.States)
+		case <-time.After(5 * time.Millisecond):
+		}
+	}
+}
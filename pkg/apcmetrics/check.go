@@ -0,0 +1,300 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CheckState is the result of checking the status of a UPS using the same
+// values as the exit codes of Nagios and Icinga plugins.
+type CheckState int
+
+const (
+	CheckOK CheckState = iota
+	CheckWarning
+	CheckCritical
+	CheckUnknown
+)
+
+var checkStateNames = []string{"OK", "WARNING", "CRITICAL", "UNKNOWN"}
+
+func (c CheckState) String() string {
+	if c < CheckOK || c > CheckUnknown {
+		return checkStateNames[CheckUnknown]
+	}
+
+	return checkStateNames[c]
+}
+
+// CheckThresholds are the values at which the status of a UPS is considered
+// a warning or critical. Thresholds that are zero are not checked. Charge, time
+// left, and load are only checked if the UPS reports them.
+type CheckThresholds struct {
+	// ChargeWarning and ChargeCritical apply when the charge is below them.
+	ChargeWarning  Percent
+	ChargeCritical Percent
+	// TimeLeftWarning and TimeLeftCritical apply when the runtime left is below them.
+	TimeLeftWarning  time.Duration
+	TimeLeftCritical time.Duration
+	// LoadWarning and LoadCritical apply when the load is above them.
+	LoadWarning  Percent
+	LoadCritical Percent
+	// BatteryAgeWarning and BatteryAgeCritical apply when the batteries were
+	// replaced longer ago than them. Not checked if the UPS doesn't report BATTDATE.
+	BatteryAgeWarning  time.Duration
+	BatteryAgeCritical time.Duration
+	// SelfTestAgeWarning and SelfTestAgeCritical apply when the last self test
+	// was longer ago than them. Not checked if the UPS doesn't report LASTSTEST.
+	SelfTestAgeWarning  time.Duration
+	SelfTestAgeCritical time.Duration
+	// OnBattery is the state when the UPS is running on batteries.
+	OnBattery CheckState
+}
+
+// Validate returns an error if any threshold is negative, a percentage is above
+// 100, or a warning threshold would never apply because the critical threshold
+// is reached first.
+func (t CheckThresholds) Validate() error {
+	var errs []error
+
+	percent := func(name string, v Percent) {
+		if v < 0 || v > 100 {
+			errs = append(errs, fmt.Errorf("%s must be between 0 and 100, got %v", name, v))
+		}
+	}
+
+	duration := func(name string, v time.Duration) {
+		if v < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %s", name, v))
+		}
+	}
+
+	// below checks thresholds that apply when a value is below them, where
+	// warning must be higher than critical to ever apply
+	below := func(name string, warning float64, critical float64) {
+		if warning > 0 && critical > 0 && warning < critical {
+			errs = append(errs, fmt.Errorf("%s warning threshold must not be below the critical threshold", name))
+		}
+	}
+
+	// above checks thresholds that apply when a value is above them, where
+	// warning must be lower than critical to ever apply
+	above := func(name string, warning float64, critical float64) {
+		if warning > 0 && critical > 0 && warning > critical {
+			errs = append(errs, fmt.Errorf("%s warning threshold must not be above the critical threshold", name))
+		}
+	}
+
+	percent("charge warning", t.ChargeWarning)
+	percent("charge critical", t.ChargeCritical)
+	percent("load warning", t.LoadWarning)
+	percent("load critical", t.LoadCritical)
+	duration("time left warning", t.TimeLeftWarning)
+	duration("time left critical", t.TimeLeftCritical)
+	duration("battery age warning", t.BatteryAgeWarning)
+	duration("battery age critical", t.BatteryAgeCritical)
+	duration("self test age warning", t.SelfTestAgeWarning)
+	duration("self test age critical", t.SelfTestAgeCritical)
+
+	below("charge", float64(t.ChargeWarning), float64(t.ChargeCritical))
+	below("time left", float64(t.TimeLeftWarning), float64(t.TimeLeftCritical))
+	above("load", float64(t.LoadWarning), float64(t.LoadCritical))
+	above("battery age", float64(t.BatteryAgeWarning), float64(t.BatteryAgeCritical))
+	above("self test age", float64(t.SelfTestAgeWarning), float64(t.SelfTestAgeCritical))
+
+	return errors.Join(errs...)
+}
+
+// PerfData is a single value of the performance data output by Nagios and Icinga
+// plugins. Warning and Critical are ranges in the format used by plugins, e.g.
+// "50:" for values below 50 or "80" for values above 80. Min and Max are empty
+// if there is no minimum or maximum.
+type PerfData struct {
+	Label    string
+	Value    float64
+	Unit     string
+	Warning  string
+	Critical string
+	Min      string
+	Max      string
+}
+
+// String formats the performance data as 'label'=value[unit];warn;crit;min;max
+func (p PerfData) String() string {
+	value := strconv.FormatFloat(p.Value, 'f', -1, 64)
+	out := fmt.Sprintf("%s=%s%s;%s;%s;%s;%s", p.Label, value, p.Unit, p.Warning, p.Critical, p.Min, p.Max)
+	return strings.TrimRight(out, ";")
+}
+
+// CheckResult is the result of checking the status of a UPS against thresholds.
+type CheckResult struct {
+	State CheckState
+	// Problems describe each value that is a warning or critical.
+	Problems []string
+	// Summary describes each value that was checked.
+	Summary  []string
+	PerfData []PerfData
+}
+
+func (r *CheckResult) update(state CheckState, problem string) {
+	if state > r.State {
+		r.State = state
+	}
+
+	if state != CheckOK {
+		r.Problems = append(r.Problems, problem)
+	}
+}
+
+// checkBelow returns the state of a value that is a problem when it is below thresholds.
+func checkBelow(value float64, warning float64, critical float64) CheckState {
+	if critical > 0 && value < critical {
+		return CheckCritical
+	} else if warning > 0 && value < warning {
+		return CheckWarning
+	}
+
+	return CheckOK
+}
+
+// checkAbove returns the state of a value that is a problem when it is above thresholds.
+func checkAbove(value float64, warning float64, critical float64) CheckState {
+	if critical > 0 && value > critical {
+		return CheckCritical
+	} else if warning > 0 && value > warning {
+		return CheckWarning
+	}
+
+	return CheckOK
+}
+
+// belowRange formats a threshold for values below it as a plugin range.
+func belowRange(threshold float64) string {
+	if threshold <= 0 {
+		return ""
+	}
+
+	return strconv.FormatFloat(threshold, 'f', -1, 64) + ":"
+}
+
+// aboveRange formats a threshold for values above it as a plugin range.
+func aboveRange(threshold float64) string {
+	if threshold <= 0 {
+		return ""
+	}
+
+	return strconv.FormatFloat(threshold, 'f', -1, 64)
+}
+
+// CheckStatus checks the status of a UPS against thresholds, using now to
+// determine how long ago the batteries were replaced and the last self test.
+// Values that the UPS doesn't report are not checked or included in the result.
+func CheckStatus(status *ApcStatus, t CheckThresholds, now time.Time) *CheckResult {
+	res := &CheckResult{State: CheckOK}
+	day := 24 * time.Hour
+
+	if _, ok := status.Fields["BCHARGE"]; ok {
+		charge := float64(status.ChargePercent)
+		summary := fmt.Sprintf("charge %.1f%%", charge)
+		res.update(checkBelow(charge, float64(t.ChargeWarning), float64(t.ChargeCritical)), summary)
+		res.Summary = append(res.Summary, summary)
+		res.PerfData = append(res.PerfData, PerfData{
+			Label:    "charge",
+			Value:    charge,
+			Unit:     "%",
+			Warning:  belowRange(float64(t.ChargeWarning)),
+			Critical: belowRange(float64(t.ChargeCritical)),
+			Min:      "0",
+			Max:      "100",
+		})
+	}
+
+	if _, ok := status.Fields["TIMELEFT"]; ok {
+		timeLeft := status.TimeLeft.Seconds()
+		summary := fmt.Sprintf("time left %s", status.TimeLeft.Round(time.Second))
+		res.update(checkBelow(timeLeft, t.TimeLeftWarning.Seconds(), t.TimeLeftCritical.Seconds()), summary)
+		res.Summary = append(res.Summary, summary)
+		res.PerfData = append(res.PerfData, PerfData{
+			Label:    "time_left",
+			Value:    timeLeft,
+			Unit:     "s",
+			Warning:  belowRange(t.TimeLeftWarning.Seconds()),
+			Critical: belowRange(t.TimeLeftCritical.Seconds()),
+			Min:      "0",
+		})
+	}
+
+	if _, ok := status.Fields["LOADPCT"]; ok {
+		load := float64(status.LoadPercent)
+		summary := fmt.Sprintf("load %.1f%%", load)
+		res.update(checkAbove(load, float64(t.LoadWarning), float64(t.LoadCritical)), summary)
+		res.Summary = append(res.Summary, summary)
+		res.PerfData = append(res.PerfData, PerfData{
+			Label:    "load",
+			Value:    load,
+			Unit:     "%",
+			Warning:  aboveRange(float64(t.LoadWarning)),
+			Critical: aboveRange(float64(t.LoadCritical)),
+			Min:      "0",
+			Max:      "100",
+		})
+	}
+
+	if !status.BatteryDate.IsZero() {
+		age := float64(now.Sub(status.BatteryDate) / day)
+		summary := fmt.Sprintf("battery age %.0f days", age)
+		res.update(checkAbove(age, float64(t.BatteryAgeWarning/day), float64(t.BatteryAgeCritical/day)), summary)
+		res.Summary = append(res.Summary, summary)
+		res.PerfData = append(res.PerfData, PerfData{
+			Label:    "battery_age_days",
+			Value:    age,
+			Warning:  aboveRange(float64(t.BatteryAgeWarning / day)),
+			Critical: aboveRange(float64(t.BatteryAgeCritical / day)),
+			Min:      "0",
+		})
+	}
+
+	if !status.LastSelfTest.IsZero() {
+		age := float64(now.Sub(status.LastSelfTest) / day)
+		summary := fmt.Sprintf("last self test %.0f days ago", age)
+		res.update(checkAbove(age, float64(t.SelfTestAgeWarning/day), float64(t.SelfTestAgeCritical/day)), summary)
+		res.Summary = append(res.Summary, summary)
+		res.PerfData = append(res.PerfData, PerfData{
+			Label:    "self_test_age_days",
+			Value:    age,
+			Warning:  aboveRange(float64(t.SelfTestAgeWarning / day)),
+			Critical: aboveRange(float64(t.SelfTestAgeCritical / day)),
+			Min:      "0",
+		})
+	}
+
+	if status.OnBattery() {
+		res.update(t.OnBattery, "on battery")
+		res.Summary = append(res.Summary, "on battery")
+	} else {
+		res.Summary = append(res.Summary, "on mains")
+	}
+
+	return res
+}
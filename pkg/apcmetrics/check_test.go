@@ -0,0 +1,201 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckStatus(t *testing.T) {
+	now := time.Date(2021, 11, 7, 12, 15, 21, 0, time.UTC)
+	thresholds := CheckThresholds{
+		ChargeWarning:    50,
+		ChargeCritical:   25,
+		TimeLeftWarning:  10 * time.Minute,
+		TimeLeftCritical: 5 * time.Minute,
+		LoadWarning:      80,
+		LoadCritical:     95,
+		OnBattery:        CheckWarning,
+	}
+
+	tests := []struct {
+		name         string
+		lines        []string
+		wantState    CheckState
+		wantPerfData []string
+	}{
+		{
+			name: "ok",
+			lines: []string{
+				"STATUS   : ONLINE",
+				"LOADPCT  : 6.0 Percent",
+				"BCHARGE  : 82.0 Percent",
+				"TIMELEFT : 72.0 Minutes",
+			},
+			wantState:    CheckOK,
+			wantPerfData: []string{"charge", "time_left", "load"},
+		},
+		{
+			name: "low charge",
+			lines: []string{
+				"STATUS   : ONLINE",
+				"LOADPCT  : 6.0 Percent",
+				"BCHARGE  : 20.0 Percent",
+				"TIMELEFT : 72.0 Minutes",
+			},
+			wantState:    CheckCritical,
+			wantPerfData: []string{"charge", "time_left", "load"},
+		},
+		{
+			name: "on battery",
+			lines: []string{
+				"STATUS   : ONBATT",
+				"LOADPCT  : 6.0 Percent",
+				"BCHARGE  : 82.0 Percent",
+				"TIMELEFT : 72.0 Minutes",
+			},
+			wantState:    CheckWarning,
+			wantPerfData: []string{"charge", "time_left", "load"},
+		},
+		{
+			name: "missing charge, time left, and load",
+			lines: []string{
+				"STATUS   : ONLINE",
+			},
+			wantState: CheckOK,
+		},
+		{
+			name: "missing time left",
+			lines: []string{
+				"STATUS   : ONLINE",
+				"LOADPCT  : 97.0 Percent",
+				"BCHARGE  : 82.0 Percent",
+			},
+			wantState:    CheckCritical,
+			wantPerfData: []string{"charge", "load"},
+		},
+		{
+			name: "battery age",
+			lines: []string{
+				"STATUS   : ONLINE",
+				"BATTDATE : 2019-02-19",
+			},
+			wantState:    CheckOK,
+			wantPerfData: []string{"battery_age_days"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status, err := ParseStatusFromLines(tc.lines)
+			if err != nil {
+				t.Fatalf("unexpected error parsing status: %s", err)
+			}
+
+			res := CheckStatus(status, thresholds, now)
+			if res.State != tc.wantState {
+				t.Errorf("expected state %s, got %s: %v", tc.wantState, res.State, res.Problems)
+			}
+
+			if len(res.PerfData) != len(tc.wantPerfData) {
+				t.Fatalf("expected perfdata %v, got %v", tc.wantPerfData, res.PerfData)
+			}
+
+			for i, p := range res.PerfData {
+				if p.Label != tc.wantPerfData[i] {
+					t.Errorf("expected perfdata %v, got %v", tc.wantPerfData, res.PerfData)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckThresholds_Validate(t *testing.T) {
+	day := 24 * time.Hour
+
+	tests := []struct {
+		name       string
+		thresholds CheckThresholds
+		wantErr    bool
+	}{
+		{
+			name:       "defaults",
+			thresholds: CheckThresholds{ChargeWarning: 50, ChargeCritical: 25, TimeLeftWarning: 10 * time.Minute, TimeLeftCritical: 5 * time.Minute, LoadWarning: 80, LoadCritical: 95, BatteryAgeWarning: 1095 * day},
+		},
+		{
+			name:       "disabled",
+			thresholds: CheckThresholds{},
+		},
+		{
+			name:       "only critical",
+			thresholds: CheckThresholds{ChargeCritical: 25, LoadCritical: 95},
+		},
+		{
+			name:       "equal",
+			thresholds: CheckThresholds{ChargeWarning: 25, ChargeCritical: 25},
+		},
+		{
+			name:       "charge warning below critical",
+			thresholds: CheckThresholds{ChargeWarning: 25, ChargeCritical: 50},
+			wantErr:    true,
+		},
+		{
+			name:       "time left warning below critical",
+			thresholds: CheckThresholds{TimeLeftWarning: 5 * time.Minute, TimeLeftCritical: 10 * time.Minute},
+			wantErr:    true,
+		},
+		{
+			name:       "load warning above critical",
+			thresholds: CheckThresholds{LoadWarning: 95, LoadCritical: 80},
+			wantErr:    true,
+		},
+		{
+			name:       "battery age warning above critical",
+			thresholds: CheckThresholds{BatteryAgeWarning: 1095 * day, BatteryAgeCritical: 365 * day},
+			wantErr:    true,
+		},
+		{
+			name:       "self test age warning above critical",
+			thresholds: CheckThresholds{SelfTestAgeWarning: 30 * day, SelfTestAgeCritical: 14 * day},
+			wantErr:    true,
+		},
+		{
+			name:       "percentage above 100",
+			thresholds: CheckThresholds{LoadCritical: 120},
+			wantErr:    true,
+		},
+		{
+			name:       "negative",
+			thresholds: CheckThresholds{TimeLeftCritical: -time.Minute},
+			wantErr:    true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.thresholds.Validate()
+			if tc.wantErr && err == nil {
+				t.Errorf("expected an error for %+v", tc.thresholds)
+			} else if !tc.wantErr && err != nil {
+				t.Errorf("unexpected error: %s", err)
+			}
+		})
+	}
+}
@@ -21,53 +21,170 @@ package apcmetrics
 import (
 	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"io"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
 )
 
-const readBufferSize = 255
+const (
+	statusCommand = "status"
+	eventsCommand = "events"
+
+	// endRecord is the start of the last line of a status response
+	endRecord = "END APC"
+)
+
+var (
+	// ErrTruncatedResponse is returned when the connection to apcupsd is closed
+	// before the end of a response or a response is missing expected records.
+	ErrTruncatedResponse = errors.New("truncated response")
+	// ErrMalformedResponse is returned when a response from apcupsd is not in
+	// the expected format.
+	ErrMalformedResponse = errors.New("malformed response")
+)
+
+// ClientOptions control how the client communicates with apcupsd.
+type ClientOptions struct {
+	// Persistent reuses a single connection to apcupsd for all requests
+	// instead of making a new connection for each request.
+	Persistent bool
+}
+
+// ClientStats are counts of requests made by the client.
+type ClientStats struct {
+	// Requests is the number of requests made to the client.
+	Requests uint64
+	// Coalesced is the number of requests that were served by waiting on an
+	// identical request that was already in flight instead of contacting apcupsd.
+	Coalesced uint64
+	// Connections is the number of connections made to apcupsd.
+	Connections uint64
+}
 
 type ApcClient struct {
 	address string
+	opts    ClientOptions
 	logger  log.Logger
+
+	requests    uint64
+	coalesced   uint64
+	connections uint64
+
+	callMtx sync.Mutex
+	calls   map[string]*call
+
+	connMtx sync.Mutex
+	conn    net.Conn
+}
+
+// call is a request to apcupsd that is in flight and the result of it, shared
+// between all callers that made an identical request while it was in flight.
+type call struct {
+	done  chan struct{}
+	lines []string
+	err   error
+	// canceled is true if the context of the caller that made the request
+	// was canceled or its deadline passed before the request completed
+	canceled bool
 }
 
-func NewApcClient(address string, logger log.Logger) *ApcClient {
+func NewApcClient(address string, opts ClientOptions, logger log.Logger) *ApcClient {
 	return &ApcClient{
 		address: address,
+		opts:    opts,
 		logger:  logger,
+		calls:   make(map[string]*call),
 	}
 }
 
+// Stats returns counts of requests made by the client.
+func (a *ApcClient) Stats() ClientStats {
+	return ClientStats{
+		Requests:    atomic.LoadUint64(&a.requests),
+		Coalesced:   atomic.LoadUint64(&a.coalesced),
+		Connections: atomic.LoadUint64(&a.connections),
+	}
+}
+
+// Close closes the persistent connection to apcupsd, if there is one.
+func (a *ApcClient) Close() error {
+	a.connMtx.Lock()
+	defer a.connMtx.Unlock()
+
+	if a.conn == nil {
+		return nil
+	}
+
+	err := a.conn.Close()
+	a.conn = nil
+	return err
+}
+
 func (a *ApcClient) connect(ctx context.Context) (net.Conn, error) {
 	var d net.Dialer
 
 	// use the provided context for making the connection
 	conn, err := d.DialContext(ctx, "tcp", a.address)
 	if err != nil {
-		return nil, err
+		if isTimeout(err) {
+			return nil, &TimeoutError{Address: a.address, Op: "connect", Err: err}
+		}
+
+		return nil, &ConnectionError{Address: a.address, Err: err}
 	}
 
-	// if the context had a deadline set, propagate it for all reads and writes
-	// on this connection. connections are not long-lived and so it's reasonable
-	// to use the deadline / context provided to the .Status() or .Event() methods
-	if deadline, ok := ctx.Deadline(); ok {
-		err = conn.SetDeadline(deadline)
-		if err != nil {
-			// if we couldn't set the deadline successfully, close the connection
-			// since we're going to short-circuit the rest of the calls and return
-			// the error
-			_ = conn.Close()
-			return nil, err
-		}
+	atomic.AddUint64(&a.connections, 1)
+	if err := a.setDeadline(ctx, conn); err != nil {
+		// if we couldn't set the deadline successfully, close the connection
+		// since we're going to short-circuit the rest of the calls and return
+		// the error
+		_ = conn.Close()
+		return nil, &ConnectionError{Address: a.address, Err: err}
 	}
 
 	return conn, nil
 }
 
+func (a *ApcClient) setDeadline(ctx context.Context, conn net.Conn) error {
+	// if the context had a deadline set, propagate it for all reads and writes
+	// on this connection. connections are only used for a single request at a
+	// time and so it's reasonable to use the deadline / context provided to the
+	// .Status() or .Event() methods. otherwise, clear any deadline left over from
+	// a previous request on a persistent connection.
+	deadline, _ := ctx.Deadline()
+	return conn.SetDeadline(deadline)
+}
+
+// requestError converts an error that occurred while making a request to apcupsd
+// into a TimeoutError if a deadline was exceeded or a ProtocolError otherwise,
+// including any lines of the response that were read before the error.
+func (a *ApcClient) requestError(cmd string, err error, lines []string) error {
+	if isTimeout(err) {
+		return &TimeoutError{Address: a.address, Op: cmd, Err: err}
+	}
+
+	return &ProtocolError{Address: a.address, Command: cmd, Err: err, Lines: lines}
+}
+
+// contextError returns the error for a request that was abandoned because the
+// context of the caller was done: a TimeoutError if its deadline passed or the
+// error of the context, e.g. context.Canceled, if the caller canceled it.
+func (a *ApcClient) contextError(ctx context.Context, cmd string) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &TimeoutError{Address: a.address, Op: cmd, Err: ctx.Err()}
+	}
+
+	return fmt.Errorf("%s request to %s: %w", cmd, a.address, ctx.Err())
+}
+
 func (a *ApcClient) formatCommand(cmd string) []byte {
 	cmdLen := len(cmd)
 	buf := make([]byte, 2+cmdLen)
@@ -76,13 +193,137 @@ func (a *ApcClient) formatCommand(cmd string) []byte {
 	return buf
 }
 
+// send makes a request to apcupsd, coalescing it with any identical request
+// that is already in flight so that concurrent callers result in only a single
+// round trip to apcupsd. The shared request is made using the context of the
+// caller that started it. If that request fails because that context was canceled
+// or its deadline passed, callers that were waiting on it retry using their own
+// context instead of failing along with it.
 func (a *ApcClient) send(ctx context.Context, cmd string) ([]string, error) {
-	conn, err := a.connect(ctx)
-	if err != nil {
-		return nil, err
+	atomic.AddUint64(&a.requests, 1)
+
+	for {
+		a.callMtx.Lock()
+		c, ok := a.calls[cmd]
+		if !ok {
+			c = &call{done: make(chan struct{})}
+			a.calls[cmd] = c
+			a.callMtx.Unlock()
+
+			c.lines, c.err = a.roundTrip(ctx, cmd)
+			c.canceled = contextDone(ctx)
+
+			a.callMtx.Lock()
+			delete(a.calls, cmd)
+			a.callMtx.Unlock()
+			close(c.done)
+
+			if c.err != nil {
+				return nil, c.err
+			}
+
+			return append([]string(nil), c.lines...), nil
+		}
+
+		a.callMtx.Unlock()
+
+		select {
+		case <-c.done:
+			if c.err != nil && c.canceled && ctx.Err() == nil {
+				level.Debug(a.logger).Log("msg", "retrying request canceled by another caller", "cmd", cmd, "err", c.err)
+				continue
+			}
+
+			// only count requests that were served by the shared result, not
+			// those that retried or gave up waiting on it
+			atomic.AddUint64(&a.coalesced, 1)
+			if c.err != nil {
+				return nil, c.err
+			}
+
+			// callers each get their own copy of the result
+			return append([]string(nil), c.lines...), nil
+		case <-ctx.Done():
+			return nil, a.contextError(ctx, cmd)
+		}
+	}
+}
+
+// contextDone returns true if the context was canceled or its deadline has passed,
+// even if the context hasn't been marked as done yet. Reads that fail because the
+// connection deadline taken from the context passed may return before the context
+// itself is done.
+func contextDone(ctx context.Context) bool {
+	if ctx.Err() != nil {
+		return true
+	}
+
+	deadline, ok := ctx.Deadline()
+	return ok && !time.Now().Before(deadline)
+}
+
+// roundTrip writes a command to apcupsd and reads the response using either a new
+// connection or the persistent connection, depending on how the client is configured.
+func (a *ApcClient) roundTrip(ctx context.Context, cmd string) ([]string, error) {
+	if !a.opts.Persistent {
+		conn, err := a.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		defer func() { _ = conn.Close() }()
+		out, err := a.exchange(conn, cmd)
+		if err != nil {
+			return nil, a.requestError(cmd, err, out)
+		}
+
+		return out, nil
+	}
+
+	a.connMtx.Lock()
+	defer a.connMtx.Unlock()
+
+	// if the persistent connection was closed by apcupsd since the last request
+	// the first attempt will fail, so make a single attempt with a new connection
+	for attempt := 0; attempt < 2; attempt++ {
+		reused := a.conn != nil
+		if reused {
+			if err := a.setDeadline(ctx, a.conn); err != nil {
+				_ = a.conn.Close()
+				a.conn = nil
+				return nil, a.requestError(cmd, err, nil)
+			}
+		} else {
+			conn, err := a.connect(ctx)
+			if err != nil {
+				return nil, err
+			}
+
+			a.conn = conn
+		}
+
+		out, err := a.exchange(a.conn, cmd)
+		if err == nil {
+			return out, nil
+		}
+
+		// the connection is in an unknown state after an error, don't reuse it
+		_ = a.conn.Close()
+		a.conn = nil
+
+		if !reused || ctx.Err() != nil {
+			return nil, a.requestError(cmd, err, out)
+		}
+
+		level.Debug(a.logger).Log("msg", "retrying request on new connection", "cmd", cmd, "err", err)
 	}
 
-	defer func() { _ = conn.Close() }()
+	return nil, a.requestError(cmd, errors.New("unable to complete request"), nil)
+}
+
+// exchange writes a command to apcupsd and reads the response using the given
+// connection. Any lines read before an error are returned along with it.
+func (a *ApcClient) exchange(conn net.Conn, cmd string) ([]string, error) {
 	cmdBytes := a.formatCommand(cmd)
 	cmdLen := len(cmdBytes)
 
@@ -95,43 +336,68 @@ func (a *ApcClient) send(ctx context.Context, cmd string) ([]string, error) {
 		return nil, fmt.Errorf("short write cmd=%s expected=%d got=%d", cmd, cmdLen, n)
 	}
 
-	lineBuf := make([]byte, readBufferSize)
+	return a.readResponse(conn, cmd)
+}
+
+// readResponse reads all records of a response from apcupsd. Each record is
+// a two byte, big-endian, length followed by that many bytes of text. The end
+// of the response is indicated by a record with a length of zero. Responses to
+// the status command also include an "END APC" line as the last record. If the
+// response is truncated or malformed, the lines read so far are returned along
+// with the error.
+func (a *ApcClient) readResponse(conn net.Conn, cmd string) ([]string, error) {
 	var out []string
+	var buf []byte
+	var sawEnd bool
+
+	header := make([]byte, 2)
 	for {
-		n, err = conn.Read(lineBuf[0:2])
-		if err != nil {
-			return nil, err
+		if _, err := io.ReadFull(conn, header); err != nil {
+			return out, wrapReadError(err, cmd, "record length")
 		}
 
-		if n == 0 {
+		sz := int(binary.BigEndian.Uint16(header))
+		if sz == 0 {
 			break
 		}
 
-		sz := int(binary.BigEndian.Uint16(lineBuf[0:2]))
-		if readBufferSize < sz {
-			sz = readBufferSize
+		if sawEnd {
+			return out, fmt.Errorf("%w: unexpected record after %s cmd=%s", ErrMalformedResponse, endRecord, cmd)
 		}
 
-		if sz == 0 {
-			break
+		if cap(buf) < sz {
+			buf = make([]byte, sz)
 		}
 
-		n, err = conn.Read(lineBuf[0:sz])
-		if err != nil {
-			return nil, err
+		if _, err := io.ReadFull(conn, buf[0:sz]); err != nil {
+			return out, wrapReadError(err, cmd, "record")
 		}
 
-		if n == 0 || n != sz {
-			break
+		s := strings.TrimSpace(string(buf[0:sz]))
+		if strings.HasPrefix(s, endRecord) {
+			sawEnd = true
 		}
 
-		s := strings.TrimSpace(string(lineBuf[0:n]))
 		out = append(out, s)
 	}
 
+	if cmd == statusCommand && !sawEnd {
+		return out, fmt.Errorf("%w: missing %s cmd=%s", ErrTruncatedResponse, endRecord, cmd)
+	}
+
 	return out, nil
 }
 
+// wrapReadError converts the connection being closed in the middle of a
+// response to ErrTruncatedResponse and returns all other errors unchanged.
+func wrapReadError(err error, cmd string, part string) error {
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return fmt.Errorf("%w: connection closed while reading %s cmd=%s", ErrTruncatedResponse, part, cmd)
+	}
+
+	return err
+}
+
 func (a *ApcClient) Status(ctx context.Context) (*ApcStatus, error) {
 	status, err := a.StatusRaw(ctx)
 	if err != nil {
@@ -151,7 +417,7 @@ func (a *ApcClient) Events(ctx context.Context) ([]ApcEvent, error) {
 }
 
 func (a *ApcClient) StatusRaw(ctx context.Context) ([]string, error) {
-	r, err := a.send(ctx, "status")
+	r, err := a.send(ctx, statusCommand)
 	if err != nil {
 		return nil, err
 	}
@@ -160,7 +426,7 @@ func (a *ApcClient) StatusRaw(ctx context.Context) ([]string, error) {
 }
 
 func (a *ApcClient) EventsRaw(ctx context.Context) ([]string, error) {
-	r, err := a.send(ctx, "events")
+	r, err := a.send(ctx, eventsCommand)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,566 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+
+	"github.com/56quarters/apcmetrics/pkg/apcmetrics"
+	"github.com/56quarters/apcmetrics/pkg/apcmetrics/apctest"
+)
+
+var testStatus = []string{
+	"APC      : 001,036,0866",
+	"HOSTNAME : example",
+	"STATUS   : ONLINE",
+	"LINEV    : 120.0 Volts",
+	"LOADPCT  : 6.0 Percent",
+	"BCHARGE  : 82.0 Percent",
+	"TIMELEFT : 72.0 Minutes",
+	"STATFLAG : 0x05000008",
+	"END APC  : 2021-11-07 12:15:23 -0500",
+}
+
+var testEvents = []string{
+	"2021-11-06 15:39:29 -0400  Power failure.",
+	"2021-11-06 15:39:35 -0400  Running on UPS batteries.",
+	"2021-11-06 15:40:23 -0400  Mains returned. No longer on UPS batteries.",
+	"2021-11-06 15:40:23 -0400  Power is back. UPS running on mains.",
+}
+
+// slowResponder delays the response to the first status request until
+// it is released, responding immediately to all others.
+type slowResponder struct {
+	release chan struct{}
+	started chan struct{}
+	once    sync.Once
+}
+
+func newSlowResponder() *slowResponder {
+	return &slowResponder{release: make(chan struct{}), started: make(chan struct{})}
+}
+
+func (r *slowResponder) Status() []string {
+	first := false
+	r.once.Do(func() { first = true })
+	if first {
+		close(r.started)
+		<-r.release
+	}
+
+	return testStatus
+}
+
+func (r *slowResponder) Events() []string {
+	return testEvents
+}
+
+func newTestServer(t *testing.T, responder apctest.Responder) *apctest.Server {
+	t.Helper()
+
+	server, err := apctest.NewServer("127.0.0.1:0", responder, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unable to start test server: %s", err)
+	}
+
+	t.Cleanup(func() { _ = server.Close() })
+	return server
+}
+
+func TestApcClient_CoalescedRetryAfterLeaderDeadline(t *testing.T) {
+	responder := newSlowResponder()
+	defer close(responder.release)
+
+	server := newTestServer(t, responder)
+	client := apcmetrics.NewApcClient(server.Addr(), apcmetrics.ClientOptions{}, log.NewNopLogger())
+
+	leaderCtx, leaderCancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer leaderCancel()
+
+	leaderErr := make(chan error, 1)
+	go func() {
+		_, err := client.StatusRaw(leaderCtx)
+		leaderErr <- err
+	}()
+
+	<-responder.started
+
+	followerCtx, followerCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer followerCancel()
+
+	lines, err := client.StatusRaw(followerCtx)
+	if err != nil {
+		t.Fatalf("expected follower to retry after the leader's deadline, got %s", err)
+	}
+
+	if len(lines) != len(testStatus) {
+		t.Fatalf("expected %d lines, got %d", len(testStatus), len(lines))
+	}
+
+	if err := <-leaderErr; err == nil {
+		t.Fatal("expected leader to fail after its deadline")
+	}
+
+	// the follower retried instead of using the result of the leader so it
+	// isn't counted as coalesced
+	if stats := client.Stats(); stats.Coalesced != 0 || stats.Requests != 2 {
+		t.Fatalf("expected two requests and none coalesced, got %+v", stats)
+	}
+}
+
+// waitForRequests waits until the client has received n requests, giving
+// the last one time to start waiting on the request in flight.
+func waitForRequests(t *testing.T, client *apcmetrics.ApcClient, n uint64) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for client.Stats().Requests < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %d requests, got %+v", n, client.Stats())
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+
+	time.Sleep(50 * time.Millisecond)
+}
+
+func TestApcClient_CoalescedSharedResult(t *testing.T) {
+	responder := newSlowResponder()
+	server := newTestServer(t, responder)
+	client := apcmetrics.NewApcClient(server.Addr(), apcmetrics.ClientOptions{}, log.NewNopLogger())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	const callers = 4
+	errs := make(chan error, callers)
+	for i := 0; i < callers; i++ {
+		go func() {
+			_, err := client.StatusRaw(ctx)
+			errs <- err
+		}()
+	}
+
+	<-responder.started
+	waitForRequests(t, client, callers)
+	close(responder.release)
+
+	for i := 0; i < callers; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("unexpected error: %s", err)
+		}
+	}
+
+	if stats := client.Stats(); stats.Coalesced != callers-1 || stats.Connections != 1 {
+		t.Fatalf("expected %d coalesced requests using a single connection, got %+v", callers-1, stats)
+	}
+}
+
+func TestApcClient_CanceledWhileWaiting(t *testing.T) {
+	responder := newSlowResponder()
+	defer close(responder.release)
+
+	server := newTestServer(t, responder)
+	client := apcmetrics.NewApcClient(server.Addr(), apcmetrics.ClientOptions{}, log.NewNopLogger())
+
+	leaderCtx, leaderCancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer leaderCancel()
+
+	go func() { _, _ = client.StatusRaw(leaderCtx) }()
+	<-responder.started
+
+	followerCtx, followerCancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() {
+		_, err := client.StatusRaw(followerCtx)
+		errs <- err
+	}()
+
+	waitForRequests(t, client, 2)
+	followerCancel()
+
+	err := <-errs
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+
+	var protoErr *apcmetrics.ProtocolError
+	var timeoutErr *apcmetrics.TimeoutError
+	if errors.As(err, &protoErr) || errors.As(err, &timeoutErr) {
+		t.Fatalf("expected cancellation not to be a protocol or timeout error, got %T: %v", err, err)
+	}
+
+	if stats := client.Stats(); stats.Coalesced != 0 {
+		t.Fatalf("expected canceled request not to be counted as coalesced, got %+v", stats)
+	}
+}
+
+// rawServer accepts connections and calls handle for each command read from
+// them, allowing tests to write responses that a real apcupsd would not. The
+// connection is closed after handle returns false.
+func rawServer(t *testing.T, handle func(conn net.Conn, cmd string) bool) string {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("unable to start test listener: %s", err)
+	}
+
+	var wg sync.WaitGroup
+	t.Cleanup(func() {
+		_ = listener.Close()
+		wg.Wait()
+	})
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { _ = conn.Close() }()
+
+				for {
+					cmd, err := readTestRecord(conn)
+					if err != nil || !handle(conn, cmd) {
+						return
+					}
+				}
+			}()
+		}
+	}()
+
+	return listener.Addr().String()
+}
+
+func readTestRecord(r io.Reader) (string, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return "", err
+	}
+
+	buf := make([]byte, binary.BigEndian.Uint16(header))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return "", err
+	}
+
+	return string(buf), nil
+}
+
+// records encodes each line as a length-prefixed record without the empty
+// record that marks the end of a response.
+func records(lines ...string) []byte {
+	var buf []byte
+	for _, line := range lines {
+		line += "\n"
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(line)))
+		buf = append(buf, line...)
+	}
+
+	return buf
+}
+
+// endOfResponse is the empty record that marks the end of a response.
+var endOfResponse = []byte{0, 0}
+
+func TestApcClient_Framing(t *testing.T) {
+	complete := append(records(testStatus...), endOfResponse...)
+
+	// records longer than 255 bytes use both bytes of the length
+	longLine := "MODEL    : " + strings.Repeat("Smart-UPS ", 40)
+	long := append(records(append([]string{longLine}, testStatus...)...), endOfResponse...)
+
+	tests := []struct {
+		name      string
+		cmd       string
+		response  []byte
+		chunk     int
+		wantLines int
+		wantLine  string
+		wantErr   error
+	}{
+		{
+			name:      "complete status",
+			cmd:       "status",
+			response:  complete,
+			wantLines: len(testStatus),
+		},
+		{
+			name:      "status written one byte at a time",
+			cmd:       "status",
+			response:  complete,
+			chunk:     1,
+			wantLines: len(testStatus),
+		},
+		{
+			name:      "status written in chunks that split lengths and records",
+			cmd:       "status",
+			response:  complete,
+			chunk:     3,
+			wantLines: len(testStatus),
+		},
+		{
+			name:      "record longer than 255 bytes",
+			cmd:       "status",
+			response:  long,
+			wantLines: len(testStatus) + 1,
+			wantLine:  strings.TrimSpace(longLine),
+		},
+		{
+			name:      "record longer than 255 bytes written one byte at a time",
+			cmd:       "status",
+			response:  long,
+			chunk:     1,
+			wantLines: len(testStatus) + 1,
+			wantLine:  strings.TrimSpace(longLine),
+		},
+		{
+			name:      "empty events",
+			cmd:       "events",
+			response:  endOfResponse,
+			wantLines: 0,
+		},
+		{
+			name:      "events without end record",
+			cmd:       "events",
+			response:  append(records(testEvents...), endOfResponse...),
+			wantLines: len(testEvents),
+		},
+		{
+			name:     "closed in the middle of a record length",
+			cmd:      "status",
+			response: long[:len(records(longLine))+1],
+			wantErr:  apcmetrics.ErrTruncatedResponse,
+		},
+		{
+			name:     "closed in the middle of a record",
+			cmd:      "status",
+			response: complete[:len(complete)/2+1],
+			wantErr:  apcmetrics.ErrTruncatedResponse,
+		},
+		{
+			name:     "closed before the end of the response",
+			cmd:      "status",
+			response: records(testStatus...),
+			wantErr:  apcmetrics.ErrTruncatedResponse,
+		},
+		{
+			name:     "missing end record",
+			cmd:      "status",
+			response: append(records(testStatus[:len(testStatus)-1]...), endOfResponse...),
+			wantErr:  apcmetrics.ErrTruncatedResponse,
+		},
+		{
+			name:     "records after end record",
+			cmd:      "status",
+			response: append(records(append(testStatus, "BCHARGE  : 82.0 Percent")...), endOfResponse...),
+			wantErr:  apcmetrics.ErrMalformedResponse,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			addr := rawServer(t, func(conn net.Conn, cmd string) bool {
+				if tc.chunk == 0 {
+					_, _ = conn.Write(tc.response)
+					return false
+				}
+
+				for i := 0; i < len(tc.response); i += tc.chunk {
+					end := i + tc.chunk
+					if end > len(tc.response) {
+						end = len(tc.response)
+					}
+
+					if _, err := conn.Write(tc.response[i:end]); err != nil {
+						return false
+					}
+				}
+
+				return false
+			})
+
+			client := apcmetrics.NewApcClient(addr, apcmetrics.ClientOptions{}, log.NewNopLogger())
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			var lines []string
+			var err error
+			if tc.cmd == "status" {
+				lines, err = client.StatusRaw(ctx)
+			} else {
+				lines, err = client.EventsRaw(ctx)
+			}
+
+			if tc.wantErr != nil {
+				var protoErr *apcmetrics.ProtocolError
+				if !errors.As(err, &protoErr) {
+					t.Fatalf("expected ProtocolError, got %T: %v", err, err)
+				}
+
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("expected %v, got %v", tc.wantErr, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if len(lines) != tc.wantLines {
+				t.Fatalf("expected %d lines, got %d: %q", tc.wantLines, len(lines), lines)
+			}
+
+			if tc.wantLine != "" && lines[0] != tc.wantLine {
+				t.Fatalf("expected first line %q, got %q", tc.wantLine, lines[0])
+			}
+		})
+	}
+}
+
+func TestApcClient_PersistentRetryAfterClose(t *testing.T) {
+	response := append(records(testStatus...), endOfResponse...)
+
+	// apcupsd closes connections that have been idle for too long, close the
+	// connection after every response to simulate that
+	addr := rawServer(t, func(conn net.Conn, cmd string) bool {
+		_, _ = conn.Write(response)
+		return false
+	})
+
+	client := apcmetrics.NewApcClient(addr, apcmetrics.ClientOptions{Persistent: true}, log.NewNopLogger())
+	defer func() { _ = client.Close() }()
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		lines, err := client.StatusRaw(ctx)
+		cancel()
+
+		if err != nil {
+			t.Fatalf("expected request %d to be retried on a new connection, got %s", i, err)
+		}
+
+		if len(lines) != len(testStatus) {
+			t.Fatalf("expected %d lines, got %d", len(testStatus), len(lines))
+		}
+	}
+
+	if stats := client.Stats(); stats.Connections != 3 {
+		t.Fatalf("expected a new connection for each request, got %+v", stats)
+	}
+}
+
+func TestApcClient_PersistentReusesConnection(t *testing.T) {
+	server := newTestServer(t, apctest.Responses{StatusLines: testStatus, EventsLines: testEvents})
+	client := apcmetrics.NewApcClient(server.Addr(), apcmetrics.ClientOptions{Persistent: true}, log.NewNopLogger())
+	defer func() { _ = client.Close() }()
+
+	for i := 0; i < 3; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		_, statusErr := client.Status(ctx)
+		_, eventsErr := client.Events(ctx)
+		cancel()
+
+		if statusErr != nil || eventsErr != nil {
+			t.Fatalf("unexpected errors: status=%v events=%v", statusErr, eventsErr)
+		}
+	}
+
+	if stats := client.Stats(); stats.Connections != 1 {
+		t.Fatalf("expected a single connection for all requests, got %+v", stats)
+	}
+}
+
+func TestApcClient_ErrorClassification(t *testing.T) {
+	t.Run("timeout", func(t *testing.T) {
+		hang := make(chan struct{})
+		defer close(hang)
+
+		addr := rawServer(t, func(conn net.Conn, cmd string) bool {
+			<-hang
+			return false
+		})
+
+		client := apcmetrics.NewApcClient(addr, apcmetrics.ClientOptions{}, log.NewNopLogger())
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		_, err := client.StatusRaw(ctx)
+		var timeoutErr *apcmetrics.TimeoutError
+		if !errors.As(err, &timeoutErr) {
+			t.Fatalf("expected TimeoutError, got %T: %v", err, err)
+		}
+	})
+
+	t.Run("connection refused", func(t *testing.T) {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("unable to start test listener: %s", err)
+		}
+
+		addr := listener.Addr().String()
+		_ = listener.Close()
+
+		client := apcmetrics.NewApcClient(addr, apcmetrics.ClientOptions{}, log.NewNopLogger())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_, err = client.StatusRaw(ctx)
+		var connErr *apcmetrics.ConnectionError
+		if !errors.As(err, &connErr) {
+			t.Fatalf("expected ConnectionError, got %T: %v", err, err)
+		}
+	})
+
+	t.Run("closed without response", func(t *testing.T) {
+		addr := rawServer(t, func(conn net.Conn, cmd string) bool {
+			return false
+		})
+
+		client := apcmetrics.NewApcClient(addr, apcmetrics.ClientOptions{}, log.NewNopLogger())
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		_, err := client.StatusRaw(ctx)
+		var protoErr *apcmetrics.ProtocolError
+		if !errors.As(err, &protoErr) || !errors.Is(err, apcmetrics.ErrTruncatedResponse) {
+			t.Fatalf("expected ProtocolError for a truncated response, got %T: %v", err, err)
+		}
+	})
+}
@@ -0,0 +1,522 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Sources of UPS status and events that can be used by a target.
+const (
+	SourceNis    = "nis"
+	SourceFile   = "file"
+	SourceNut    = "nut"
+	SourceSnmp   = "snmp"
+	SourceReplay = "replay"
+
+	DefaultNisAddress      = "localhost:3551"
+	DefaultListenAddress   = ":9780"
+	DefaultTelemetryPath   = "/metrics"
+	DefaultProbePath       = "/probe"
+	DefaultOutagesPath     = "/outages"
+	DefaultBatteryInterval = time.Second
+	DefaultTimeout         = 5 * time.Second
+
+	// TargetLabel is the label added to all metrics about a target with its name
+	TargetLabel = "ups"
+
+	// envPrefix is the prefix of environment variables that override settings
+	envPrefix = "APCMETRICS"
+)
+
+// envReference matches references to environment variables in a config
+// file of the form ${NAME}
+var envReference = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// Config is the configuration of the exporter and CLI, typically loaded from a
+// YAML file by LoadConfig on top of settings from CLI flags.
+type Config struct {
+	Web     WebConfig     `yaml:"web"`
+	Metrics MetricsConfig `yaml:"metrics"`
+	Poll    PollConfig    `yaml:"poll"`
+	Events  EventsConfig  `yaml:"events"`
+	// Timeout is the max time requests for the status or events of a UPS may
+	// take, used for any targets that don't set their own timeout.
+	Timeout time.Duration  `yaml:"timeout"`
+	Targets []TargetConfig `yaml:"targets"`
+}
+
+type WebConfig struct {
+	ListenAddress string `yaml:"listen_address"`
+	TelemetryPath string `yaml:"telemetry_path"`
+	ProbePath     string `yaml:"probe_path"`
+	OutagesPath   string `yaml:"outages_path"`
+}
+
+type MetricsConfig struct {
+	Lenient       bool `yaml:"lenient"`
+	GenericFields bool `yaml:"generic_fields"`
+	LegacyStatus  bool `yaml:"legacy_status"`
+}
+
+type PollConfig struct {
+	Interval        time.Duration `yaml:"interval"`
+	BatteryInterval time.Duration `yaml:"battery_interval"`
+	MaxAge          time.Duration `yaml:"max_age"`
+}
+
+type EventsConfig struct {
+	Interval  time.Duration `yaml:"interval"`
+	StateFile string        `yaml:"state_file"`
+}
+
+// TargetConfig is a UPS to get status and events for and where to get them from.
+// Only the settings for the source used by the target are required.
+type TargetConfig struct {
+	Name   string `yaml:"name"`
+	Source string `yaml:"source"`
+	// Address is the address of apcupsd (nis), NUT upsd (nut), or the SNMP
+	// agent (snmp), using the default port for each source if empty.
+	Address string        `yaml:"address"`
+	Timeout time.Duration `yaml:"timeout"`
+	// Labels are added to all metrics about the UPS.
+	Labels map[string]string `yaml:"labels"`
+
+	// EventsStateFile is the file to persist counts of events for the target to,
+	// using events.state_file if empty.
+	EventsStateFile string `yaml:"events_state_file"`
+
+	Persistent bool        `yaml:"persistent"`
+	StatusFile string      `yaml:"status_file"`
+	EventsFile string      `yaml:"events_file"`
+	NutName    string      `yaml:"nut_name"`
+	Snmp       SnmpOptions `yaml:"snmp"`
+	ReplayFile string      `yaml:"replay_file"`
+}
+
+// LoadConfig reads a YAML config file on top of base, which is typically built
+// from CLI flags, so that any settings not in the file keep their value from
+// base. If the file includes any targets, they replace all targets in base.
+// References to environment variables of the form ${NAME} in the file are
+// replaced with their values. Settings that aren't part of a target can be
+// overridden using environment variables named after the setting, e.g.
+// APCMETRICS_WEB_LISTEN_ADDRESS for web.listen_address. If path is empty, only
+// environment variables are applied to base. The config is validated before
+// being returned.
+func LoadConfig(path string, base Config) (*Config, error) {
+	cfg := base
+	cfg.Targets = append([]TargetConfig(nil), base.Targets...)
+
+	if path != "" {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+
+		expanded, err := expandEnv(string(raw))
+		if err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+
+		if err := yaml.UnmarshalStrict([]byte(expanded), &cfg); err != nil {
+			return nil, fmt.Errorf("invalid config file %s: %w", path, err)
+		}
+	}
+
+	if err := applyEnv(reflect.ValueOf(&cfg.Web).Elem(), envPrefix+"_WEB"); err != nil {
+		return nil, err
+	}
+
+	if err := applyEnv(reflect.ValueOf(&cfg.Metrics).Elem(), envPrefix+"_METRICS"); err != nil {
+		return nil, err
+	}
+
+	if err := applyEnv(reflect.ValueOf(&cfg.Poll).Elem(), envPrefix+"_POLL"); err != nil {
+		return nil, err
+	}
+
+	if err := applyEnv(reflect.ValueOf(&cfg.Events).Elem(), envPrefix+"_EVENTS"); err != nil {
+		return nil, err
+	}
+
+	if v, ok := os.LookupEnv(envPrefix + "_TIMEOUT"); ok {
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s_TIMEOUT %q: %w", envPrefix, v, err)
+		}
+
+		cfg.Timeout = d
+	}
+
+	cfg.setDefaults()
+	if err := cfg.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &cfg, nil
+}
+
+// expandEnv replaces references to environment variables of the form ${NAME},
+// returning an error for any that are not set.
+func expandEnv(raw string) (string, error) {
+	var missing []string
+	out := envReference.ReplaceAllStringFunc(raw, func(ref string) string {
+		name := envReference.FindStringSubmatch(ref)[1]
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+
+		return v
+	})
+
+	if len(missing) > 0 {
+		return "", fmt.Errorf("environment variables not set: %s", strings.Join(missing, ", "))
+	}
+
+	return out, nil
+}
+
+// applyEnv sets each field of a struct from an environment variable named after
+// the prefix and the YAML name of the field, if the variable is set.
+func applyEnv(v reflect.Value, prefix string) error {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		tag := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		name := prefix + "_" + strings.ToUpper(tag)
+
+		raw, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		field := v.Field(i)
+		switch {
+		case field.Type() == reflect.TypeOf(time.Duration(0)):
+			d, err := time.ParseDuration(raw)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", name, raw, err)
+			}
+			field.SetInt(int64(d))
+		case field.Kind() == reflect.Bool:
+			b, err := strconv.ParseBool(raw)
+			if err != nil {
+				return fmt.Errorf("invalid %s %q: %w", name, raw, err)
+			}
+			field.SetBool(b)
+		case field.Kind() == reflect.String:
+			field.SetString(raw)
+		}
+	}
+
+	return nil
+}
+
+// setDefaults sets any settings that are required but weren't set by the
+// config file or the base config.
+func (c *Config) setDefaults() {
+	if c.Web.ListenAddress == "" {
+		c.Web.ListenAddress = DefaultListenAddress
+	}
+
+	if c.Web.TelemetryPath == "" {
+		c.Web.TelemetryPath = DefaultTelemetryPath
+	}
+
+	if c.Web.ProbePath == "" {
+		c.Web.ProbePath = DefaultProbePath
+	}
+
+	if c.Web.OutagesPath == "" {
+		c.Web.OutagesPath = DefaultOutagesPath
+	}
+
+	if c.Poll.BatteryInterval == 0 {
+		c.Poll.BatteryInterval = DefaultBatteryInterval
+	}
+
+	if c.Timeout == 0 {
+		c.Timeout = DefaultTimeout
+	}
+
+	for i := range c.Targets {
+		t := &c.Targets[i]
+		if t.Source == "" {
+			t.Source = SourceNis
+		}
+
+		if t.Address == "" {
+			switch t.Source {
+			case SourceNis:
+				t.Address = DefaultNisAddress
+			case SourceNut:
+				t.Address = DefaultNutAddress
+			case SourceSnmp:
+				t.Address = DefaultSnmpAddress
+			}
+		}
+
+		if t.NutName == "" {
+			t.NutName = DefaultNutUps
+		}
+
+		if t.Snmp.Version == "" {
+			t.Snmp.Version = "2c"
+		}
+
+		if t.Snmp.Version == "2c" && t.Snmp.Community == "" {
+			t.Snmp.Community = DefaultSnmpCommunity
+		}
+
+		if t.StatusFile == "" {
+			t.StatusFile = DefaultStatusFile
+		}
+
+		if t.EventsFile == "" {
+			t.EventsFile = DefaultEventsFile
+		}
+	}
+}
+
+// Validate returns an error describing every problem with the config, if any.
+func (c *Config) Validate() error {
+	var errs []error
+
+	paths := make(map[string]string)
+	for _, p := range []struct{ name, path string }{
+		{"web.telemetry_path", c.Web.TelemetryPath},
+		{"web.probe_path", c.Web.ProbePath},
+		{"web.outages_path", c.Web.OutagesPath},
+	} {
+		if !strings.HasPrefix(p.path, "/") {
+			errs = append(errs, fmt.Errorf("%s must start with /, got %q", p.name, p.path))
+		} else if other, ok := paths[p.path]; ok {
+			errs = append(errs, fmt.Errorf("%s must be different from %s, both are %q", p.name, other, p.path))
+		}
+
+		paths[p.path] = p.name
+	}
+
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"poll.interval", c.Poll.Interval},
+		{"poll.battery_interval", c.Poll.BatteryInterval},
+		{"poll.max_age", c.Poll.MaxAge},
+		{"events.interval", c.Events.Interval},
+	} {
+		if d.value < 0 {
+			errs = append(errs, fmt.Errorf("%s must not be negative, got %s", d.name, d.value))
+		}
+	}
+
+	if c.Timeout <= 0 {
+		errs = append(errs, fmt.Errorf("timeout must be positive, got %s", c.Timeout))
+	}
+
+	if len(c.Targets) == 0 {
+		errs = append(errs, errors.New("at least one target must be configured"))
+	}
+
+	names := make(map[string]bool)
+	stateFiles := make(map[string]string)
+	for i, t := range c.Targets {
+		desc := fmt.Sprintf("targets[%d]", i)
+		if t.Name != "" {
+			desc = fmt.Sprintf("targets[%d] (%s)", i, t.Name)
+		}
+
+		for _, err := range t.validate() {
+			errs = append(errs, fmt.Errorf("%s: %w", desc, err))
+		}
+
+		if t.Name != "" && names[t.Name] {
+			errs = append(errs, fmt.Errorf("%s: duplicate target name", desc))
+		}
+
+		names[t.Name] = true
+
+		if f := c.StateFileFor(t); f != "" {
+			if other, ok := stateFiles[f]; ok {
+				errs = append(errs, fmt.Errorf("%s: events state file %s is already used by target %s, set events_state_file for each target", desc, f, other))
+			}
+
+			stateFiles[f] = t.Name
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (t TargetConfig) validate() []error {
+	var errs []error
+
+	if t.Name == "" {
+		errs = append(errs, errors.New("name must be set"))
+	}
+
+	if t.Timeout < 0 {
+		errs = append(errs, fmt.Errorf("timeout must not be negative, got %s", t.Timeout))
+	}
+
+	for k := range t.Labels {
+		if !model.LabelName(k).IsValid() || strings.HasPrefix(k, "__") {
+			errs = append(errs, fmt.Errorf("invalid label name %q", k))
+		} else if k == TargetLabel {
+			errs = append(errs, fmt.Errorf("label name %q is reserved for the name of the target", k))
+		} else if isCollectorLabel(k) {
+			errs = append(errs, fmt.Errorf("label name %q is reserved for a label of exported metrics", k))
+		}
+	}
+
+	switch t.Source {
+	case SourceNis, SourceNut:
+	case SourceFile:
+		if t.StatusFile == "" {
+			errs = append(errs, errors.New("status_file must be set for the file source"))
+		}
+	case SourceSnmp:
+		if _, _, err := snmpTarget(t.Address); err != nil {
+			errs = append(errs, err)
+		}
+
+		if err := t.Snmp.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	case SourceReplay:
+		if t.ReplayFile == "" {
+			errs = append(errs, errors.New("replay_file must be set for the replay source"))
+		}
+	default:
+		errs = append(errs, fmt.Errorf("unknown source %q, expected one of %s, %s, %s, %s, or %s",
+			t.Source, SourceNis, SourceFile, SourceNut, SourceSnmp, SourceReplay))
+	}
+
+	return errs
+}
+
+// Target returns the target with the given name or the first target if name is empty.
+func (c *Config) Target(name string) (TargetConfig, error) {
+	if name == "" && len(c.Targets) > 0 {
+		return c.Targets[0], nil
+	}
+
+	for _, t := range c.Targets {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+
+	return TargetConfig{}, fmt.Errorf("unknown target %q", name)
+}
+
+// HasEvents returns true if the source of the target provides events. NUT and
+// SNMP don't keep a log of events so there are never any events to count.
+func (t TargetConfig) HasEvents() bool {
+	return t.Source != SourceNut && t.Source != SourceSnmp
+}
+
+// TimeoutFor returns the timeout of the target or the default if it doesn't set one.
+func (c *Config) TimeoutFor(t TargetConfig) time.Duration {
+	if t.Timeout > 0 {
+		return t.Timeout
+	}
+
+	return c.Timeout
+}
+
+// StateFileFor returns the events state file of the target or the default if it
+// doesn't set one.
+func (c *Config) StateFileFor(t TargetConfig) string {
+	if t.EventsStateFile != "" {
+		return t.EventsStateFile
+	}
+
+	return c.Events.StateFile
+}
+
+// LabelsFor returns the labels to add to all metrics about the target: its name
+// as the "ups" label and its own labels. Labels that only other targets set are
+// included with an empty value, which Prometheus treats the same as a missing
+// label, so that metrics for all targets have the same label names.
+func (c *Config) LabelsFor(t TargetConfig) map[string]string {
+	labels := map[string]string{TargetLabel: t.Name}
+	for _, other := range c.Targets {
+		for k := range other.Labels {
+			labels[k] = ""
+		}
+	}
+
+	for k, v := range t.Labels {
+		labels[k] = v
+	}
+
+	return labels
+}
+
+// isCollectorLabel returns true if the name is used by a label that collectors add to metrics.
+func isCollectorLabel(name string) bool {
+	for _, l := range collectorLabels {
+		if l == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// NewSource creates the Source of status and events for a target.
+func NewSource(t TargetConfig, logger log.Logger) (Source, error) {
+	switch t.Source {
+	case SourceNis:
+		return NewApcClient(t.Address, ClientOptions{Persistent: t.Persistent}, logger), nil
+	case SourceFile:
+		return NewApcFileSource(t.StatusFile, t.EventsFile, logger), nil
+	case SourceNut:
+		return NewNutClient(t.Address, t.NutName, logger), nil
+	case SourceSnmp:
+		client, err := NewSnmpClient(t.Address, t.Snmp, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		return client, nil
+	case SourceReplay:
+		replay, err := NewReplaySource(t.ReplayFile)
+		if err != nil {
+			return nil, err
+		}
+
+		return replay, nil
+	}
+
+	return nil, fmt.Errorf("unknown source %q", t.Source)
+}
@@ -0,0 +1,95 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestConfig_Validate_Labels(t *testing.T) {
+	tests := []struct {
+		name    string
+		labels  map[string]string
+		wantErr string
+	}{
+		{
+			name:   "valid",
+			labels: map[string]string{"site": "office", "rack": "2"},
+		},
+		{
+			name:    "invalid name",
+			labels:  map[string]string{"site-name": "office"},
+			wantErr: `invalid label name "site-name"`,
+		},
+		{
+			name:    "target name",
+			labels:  map[string]string{"ups": "office"},
+			wantErr: `label name "ups" is reserved`,
+		},
+		{
+			name:    "state label",
+			labels:  map[string]string{"state": "online"},
+			wantErr: `label name "state" is reserved`,
+		},
+		{
+			name:    "event type label",
+			labels:  map[string]string{"type": "rack"},
+			wantErr: `label name "type" is reserved`,
+		},
+		{
+			name:    "info label",
+			labels:  map[string]string{"model": "Smart-UPS"},
+			wantErr: `label name "model" is reserved`,
+		},
+		{
+			name:    "histogram bucket label",
+			labels:  map[string]string{"le": "10"},
+			wantErr: `label name "le" is reserved`,
+		},
+		{
+			name:    "summary quantile label",
+			labels:  map[string]string{"quantile": "0.5"},
+			wantErr: `label name "quantile" is reserved`,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cfg := Config{
+				Timeout: DefaultTimeout,
+				Targets: []TargetConfig{{Name: "office", Labels: tc.labels}},
+			}
+			cfg.setDefaults()
+
+			err := cfg.Validate()
+			if tc.wantErr == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %s", err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Fatalf("expected error containing %q, got %v", tc.wantErr, err)
+			}
+		})
+	}
+}
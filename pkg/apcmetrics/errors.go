@@ -0,0 +1,96 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+)
+
+// ConnectionError is returned when a connection to apcupsd could not be made.
+type ConnectionError struct {
+	Address string
+	Err     error
+}
+
+func (e *ConnectionError) Error() string {
+	return fmt.Sprintf("unable to connect to %s: %v", e.Address, e.Err)
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// TimeoutError is returned when connecting to apcupsd or a request to apcupsd
+// took longer than allowed by the deadline of the context used.
+type TimeoutError struct {
+	Address string
+	Op      string
+	Err     error
+}
+
+func (e *TimeoutError) Error() string {
+	return fmt.Sprintf("timeout during %s to %s: %v", e.Op, e.Address, e.Err)
+}
+
+func (e *TimeoutError) Unwrap() error {
+	return e.Err
+}
+
+// ProtocolError is returned when a request to apcupsd fails after connecting,
+// e.g. the response is truncated (ErrTruncatedResponse) or malformed (ErrMalformedResponse).
+type ProtocolError struct {
+	Address string
+	Command string
+	Err     error
+	// Lines are the lines of the response that were read before it was
+	// rejected, if any.
+	Lines []string
+}
+
+func (e *ProtocolError) Error() string {
+	return fmt.Sprintf("%s request to %s failed: %v", e.Command, e.Address, e.Err)
+}
+
+func (e *ProtocolError) Unwrap() error {
+	return e.Err
+}
+
+// ParseError is returned when a field of a response from apcupsd could not be parsed.
+type ParseError struct {
+	Field string
+	Value string
+	Err   error
+}
+
+func (e *ParseError) Error() string {
+	return fmt.Sprintf("unable to parse %s %s: %v", e.Field, e.Value, e.Err)
+}
+
+func (e *ParseError) Unwrap() error {
+	return e.Err
+}
+
+// isTimeout returns true if the error is the result of a deadline being exceeded.
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &netErr) && netErr.Timeout())
+}
@@ -0,0 +1,91 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+// netTimeout is a net.Error that reports a timeout, like those returned
+// by reads on a connection after its deadline.
+type netTimeout struct{}
+
+func (netTimeout) Error() string   { return "i/o timeout" }
+func (netTimeout) Timeout() bool   { return true }
+func (netTimeout) Temporary() bool { return true }
+
+func TestErrorClass(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "connection", err: &ConnectionError{Address: "ups:3551", Err: errors.New("connection refused")}, want: failureDial},
+		{name: "connect timeout", err: &TimeoutError{Address: "ups:3551", Op: "connect", Err: netTimeout{}}, want: failureTimeout},
+		{name: "deadline", err: fmt.Errorf("request failed: %w", context.DeadlineExceeded), want: failureTimeout},
+		{name: "net timeout", err: netTimeout{}, want: failureTimeout},
+		{name: "truncated", err: &ProtocolError{Address: "ups:3551", Command: "status", Err: ErrTruncatedResponse}, want: failureProtocol},
+		{name: "malformed", err: &ProtocolError{Address: "ups:3551", Command: "status", Err: ErrMalformedResponse}, want: failureProtocol},
+		{name: "parse", err: &ParseError{Field: "BCHARGE", Value: "lots", Err: errors.New("invalid syntax")}, want: failureParse},
+		{name: "stale", err: ErrNoStatus, want: failureStale},
+		{name: "other", err: errors.New("something else"), want: failureProtocol},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := errorClass(tc.err); got != tc.want {
+				t.Errorf("expected class %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestParseStatusFromLines_ParseError(t *testing.T) {
+	tests := []struct {
+		line  string
+		field string
+	}{
+		{line: "BCHARGE  : lots Percent", field: "BCHARGE"},
+		{line: "TIMELEFT : soon Minutes", field: "TIMELEFT"},
+		{line: "LINEV    : high Volts", field: "LINEV"},
+		{line: "STATFLAG : 0xZZ", field: "STATFLAG"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.field, func(t *testing.T) {
+			_, err := ParseStatusFromLines([]string{"STATUS   : ONLINE", tc.line})
+
+			var parseErr *ParseError
+			if !errors.As(err, &parseErr) {
+				t.Fatalf("expected ParseError, got %T: %v", err, err)
+			}
+
+			if parseErr.Field != tc.field {
+				t.Errorf("expected field %s, got %s", tc.field, parseErr.Field)
+			}
+
+			if parseErr.Unwrap() == nil {
+				t.Errorf("expected ParseError to wrap the underlying error")
+			}
+		})
+	}
+}
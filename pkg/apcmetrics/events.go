@@ -0,0 +1,296 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// countedEventsWindow is how long before the most recent event counted that events
+// are remembered so that they aren't counted again. Events older than this are
+// assumed to have been counted already.
+const countedEventsWindow = 24 * time.Hour
+
+// countedEvent identifies an event that has been counted.
+type countedEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Message   string    `json:"message"`
+}
+
+// eventCounterState is the state of an EventCounter persisted between restarts.
+type eventCounterState struct {
+	Counts map[string]uint64 `json:"counts"`
+	// LastTimestamp is the timestamp of the most recent event counted
+	LastTimestamp time.Time `json:"last_timestamp"`
+	// Counted are the events counted within countedEventsWindow of LastTimestamp
+	Counted []countedEvent `json:"counted"`
+}
+
+// EventCounter watches for new events from apcupsd and counts them by type. Counts
+// can optionally be persisted to a file so that they survive restarts without
+// counting the same event more than once.
+type EventCounter struct {
+	watcher *EventWatcher
+	logger  log.Logger
+
+	*eventCounts
+}
+
+// eventCounts are the counts of events and the events that have been counted,
+// shared by an EventCounter and any counters it has been handed over to.
+type eventCounts struct {
+	stateFile string
+
+	mtx   sync.Mutex
+	state eventCounterState
+	// seeded is true once the counter knows which events have already been
+	// counted, either from the state file or from the first poll of events
+	seeded bool
+}
+
+// NewEventCounter creates a new counter that uses the watcher to find new events. If
+// stateFile is not empty, counts are loaded from and saved to it. Otherwise, or if the
+// file doesn't exist yet, events known to apcupsd when the counter first fetches events
+// successfully are considered to have already happened and only later events are counted.
+func NewEventCounter(watcher *EventWatcher, stateFile string, logger log.Logger) (*EventCounter, error) {
+	c := &EventCounter{
+		watcher: watcher,
+		logger:  logger,
+		eventCounts: &eventCounts{
+			stateFile: stateFile,
+			state: eventCounterState{
+				Counts: make(map[string]uint64),
+			},
+		},
+	}
+
+	if stateFile != "" {
+		if err := c.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	return c, nil
+}
+
+// Handover returns a counter that uses watcher to find new events and shares the
+// counts, counted events, and state file of c. This allows counting to continue
+// using a new source without saving and loading counts. Both counters may run at
+// the same time while the new counter replaces c without counting any event twice.
+func (c *EventCounter) Handover(watcher *EventWatcher, logger log.Logger) *EventCounter {
+	return &EventCounter{
+		watcher:     watcher,
+		logger:      logger,
+		eventCounts: c.eventCounts,
+	}
+}
+
+// StateFile returns the file counts are persisted to, empty if they aren't.
+func (c *EventCounter) StateFile() string {
+	return c.stateFile
+}
+
+func (c *eventCounts) load() error {
+	bytes, err := os.ReadFile(c.stateFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var state eventCounterState
+	if err := json.Unmarshal(bytes, &state); err != nil {
+		return err
+	}
+
+	if state.Counts == nil {
+		state.Counts = make(map[string]uint64)
+	}
+
+	c.state = state
+	c.seeded = true
+	return nil
+}
+
+// save writes the current state to the state file, replacing it atomically.
+// Must be called with the lock held.
+func (c *eventCounts) save() error {
+	bytes, err := json.Marshal(c.state)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(c.stateFile), filepath.Base(c.stateFile)+".*.tmp")
+	if err != nil {
+		return err
+	}
+
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	if _, err := tmp.Write(bytes); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), c.stateFile)
+}
+
+// Run counts new events until the context is canceled.
+func (c *EventCounter) Run(ctx context.Context) {
+	if !c.seed(ctx) {
+		return
+	}
+
+	for e := range c.watcher.Watch(ctx) {
+		c.count(e)
+	}
+}
+
+// seed marks all events currently known to apcupsd as counted, unless counts were
+// loaded from the state file, so that only events after them are counted. Timestamps
+// of events come from the clock of apcupsd, so they're used instead of the current
+// time to decide which events are new. Fetching events is retried every interval
+// until it succeeds, returning false if the context is canceled first.
+func (c *EventCounter) seed(ctx context.Context) bool {
+	c.mtx.Lock()
+	seeded := c.seeded
+	c.mtx.Unlock()
+
+	if seeded {
+		return true
+	}
+
+	ticker := time.NewTicker(c.watcher.interval)
+	defer ticker.Stop()
+
+	for {
+		events, err := c.watcher.poll(ctx)
+		if err == nil {
+			c.mtx.Lock()
+			defer c.mtx.Unlock()
+
+			for _, e := range events {
+				c.markCounted(e)
+			}
+
+			c.seeded = true
+			c.saveState()
+			level.Debug(c.logger).Log("msg", "counting UPS events after", "timestamp", c.state.LastTimestamp, "known", len(events))
+			return true
+		}
+
+		level.Warn(c.logger).Log("msg", "unable to get UPS events to start counting from", "err", err)
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+func (c *EventCounter) count(e ApcEvent) {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	// skip events that were already counted before a restart or that were known
+	// to apcupsd when the counter started. the watcher will emit all events that
+	// apcupsd knows about when it starts.
+	if !c.markCounted(e) {
+		return
+	}
+
+	t := e.Kind.String()
+	c.state.Counts[t]++
+	level.Debug(c.logger).Log("msg", "counted UPS event", "type", t, "message", e.Message)
+	c.saveState()
+}
+
+// markCounted records the event as counted, returning false if it was already counted.
+// Events are identified by their timestamp and message rather than only counting events
+// newer than the most recent one so that events aren't lost if the clock of apcupsd
+// steps backwards, as long as it steps back less than countedEventsWindow. Must be
+// called with the lock held.
+func (c *EventCounter) markCounted(e ApcEvent) bool {
+	if e.TimeStamp.Before(c.state.LastTimestamp.Add(-countedEventsWindow)) {
+		return false
+	}
+
+	for _, counted := range c.state.Counted {
+		if counted.Timestamp.Equal(e.TimeStamp) && counted.Message == e.Message {
+			return false
+		}
+	}
+
+	c.state.Counted = append(c.state.Counted, countedEvent{Timestamp: e.TimeStamp, Message: e.Message})
+	if e.TimeStamp.After(c.state.LastTimestamp) {
+		c.state.LastTimestamp = e.TimeStamp
+
+		// forget events that are now too old to be counted again
+		cutoff := e.TimeStamp.Add(-countedEventsWindow)
+		kept := c.state.Counted[:0]
+		for _, counted := range c.state.Counted {
+			if !counted.Timestamp.Before(cutoff) {
+				kept = append(kept, counted)
+			}
+		}
+
+		c.state.Counted = kept
+	}
+
+	return true
+}
+
+// saveState writes the current state to the state file, if there is one, logging
+// any errors. Must be called with the lock held.
+func (c *EventCounter) saveState() {
+	if c.stateFile == "" {
+		return
+	}
+
+	if err := c.save(); err != nil {
+		level.Warn(c.logger).Log("msg", "unable to save event counts", "file", c.stateFile, "err", err)
+	}
+}
+
+// Counts returns the number of events counted by type.
+func (c *EventCounter) Counts() map[string]uint64 {
+	c.mtx.Lock()
+	defer c.mtx.Unlock()
+
+	out := make(map[string]uint64, len(c.state.Counts))
+	for k, v := range c.state.Counts {
+		out[k] = v
+	}
+
+	return out
+}
@@ -0,0 +1,262 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// waitForCounts waits for the counter to have the expected count of a type of event.
+func waitForCounts(t *testing.T, counter *EventCounter, kind EventKind, want uint64) {
+	t.Helper()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for time.Now().Before(deadline) {
+		if counter.Counts()[kind.String()] == want {
+			return
+		}
+
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	t.Fatalf("expected %d %s events, got %v", want, kind, counter.Counts())
+}
+
+func TestEventCounter_SeedsFromFirstPoll(t *testing.T) {
+	// timestamps are long before the current time, as if the clock of the
+	// host running apcupsd was behind the clock of the exporter
+	history := []string{
+		"2021-11-06 15:39:29 -0400  Power failure.",
+		"2021-11-06 15:39:35 -0400  Running on UPS batteries.",
+		"2021-11-06 15:40:23 -0400  Mains returned. No longer on UPS batteries.",
+		"2021-11-06 15:40:23 -0400  Power is back. UPS running on mains.",
+	}
+
+	source := &staticSource{events: history}
+	watcher := NewEventWatcher(source, 10*time.Millisecond, time.Second, log.NewNopLogger())
+	counter, err := NewEventCounter(watcher, "", log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error creating counter: %s", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go counter.Run(ctx)
+
+	// wait for the counter to seed itself from the existing events
+	time.Sleep(50 * time.Millisecond)
+	if counts := counter.Counts(); len(counts) != 0 {
+		t.Fatalf("expected events known at startup not to be counted, got %v", counts)
+	}
+
+	// a new event in the same second as the most recent existing event
+	source.setEvents(append(history,
+		"2021-11-06 15:40:23 -0400  UPS Self Test switch to battery.",
+	))
+	waitForCounts(t, counter, EventSelfTestStart, 1)
+
+	source.setEvents(append(history,
+		"2021-11-06 15:40:23 -0400  UPS Self Test switch to battery.",
+		"2021-11-06 16:00:00 -0400  Power failure.",
+	))
+	waitForCounts(t, counter, EventPowerFailure, 1)
+}
+
+func TestEventCounter_MarkCounted(t *testing.T) {
+	type mark struct {
+		line string
+		want bool
+	}
+
+	tests := []struct {
+		name  string
+		marks []mark
+	}{
+		{
+			name: "new events",
+			marks: []mark{
+				{line: "2021-11-06 15:39:29 -0400  Power failure.", want: true},
+				{line: "2021-11-06 15:39:35 -0400  Running on UPS batteries.", want: true},
+			},
+		},
+		{
+			name: "already counted",
+			marks: []mark{
+				{line: "2021-11-06 15:39:29 -0400  Power failure.", want: true},
+				{line: "2021-11-06 15:39:35 -0400  Running on UPS batteries.", want: true},
+				{line: "2021-11-06 15:39:29 -0400  Power failure.", want: false},
+				{line: "2021-11-06 15:39:35 -0400  Running on UPS batteries.", want: false},
+			},
+		},
+		{
+			name: "same timestamp",
+			marks: []mark{
+				{line: "2021-11-06 15:40:23 -0400  Mains returned. No longer on UPS batteries.", want: true},
+				{line: "2021-11-06 15:40:23 -0400  Power is back. UPS running on mains.", want: true},
+				{line: "2021-11-06 15:40:23 -0400  Power is back. UPS running on mains.", want: false},
+			},
+		},
+		{
+			name: "clock stepped backwards",
+			marks: []mark{
+				{line: "2021-11-06 16:00:00 -0400  Power failure.", want: true},
+				{line: "2021-11-06 15:00:00 -0400  Power failure.", want: true},
+				{line: "2021-11-06 15:00:06 -0400  Running on UPS batteries.", want: true},
+				{line: "2021-11-06 15:00:00 -0400  Power failure.", want: false},
+			},
+		},
+		{
+			name: "older than window",
+			marks: []mark{
+				{line: "2021-11-06 16:00:00 -0400  Power failure.", want: true},
+				{line: "2021-11-04 16:00:00 -0400  Power failure.", want: false},
+			},
+		},
+		{
+			name: "forgotten after window",
+			marks: []mark{
+				{line: "2021-11-04 16:00:00 -0400  Power failure.", want: true},
+				{line: "2021-11-06 16:00:00 -0400  Power failure.", want: true},
+				{line: "2021-11-04 16:00:00 -0400  Power failure.", want: false},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			counter, err := NewEventCounter(nil, "", log.NewNopLogger())
+			if err != nil {
+				t.Fatalf("unexpected error creating counter: %s", err)
+			}
+
+			for _, m := range tc.marks {
+				events, err := ParseEventsFromLines([]string{m.line})
+				if err != nil {
+					t.Fatalf("unexpected error parsing event %q: %s", m.line, err)
+				}
+
+				if got := counter.markCounted(events[0]); got != m.want {
+					t.Errorf("expected %q to be counted=%t, got %t", m.line, m.want, got)
+				}
+			}
+
+			if len(counter.state.Counted) > len(tc.marks) {
+				t.Errorf("expected at most %d counted events to be kept, got %d", len(tc.marks), len(counter.state.Counted))
+			}
+		})
+	}
+}
+
+func TestEventCounter_StateFile(t *testing.T) {
+	stateFile := filepath.Join(t.TempDir(), "events.json")
+	events, err := ParseEventsFromLines([]string{
+		"2021-11-06 16:00:00 -0400  Power failure.",
+		"2021-11-06 15:00:00 -0400  Power failure.",
+	})
+	if err != nil {
+		t.Fatalf("unexpected error parsing events: %s", err)
+	}
+
+	first, err := NewEventCounter(nil, stateFile, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error creating counter: %s", err)
+	}
+
+	for _, e := range events {
+		first.count(e)
+	}
+
+	// a counter created after a restart doesn't count the same events again
+	second, err := NewEventCounter(nil, stateFile, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error loading counter: %s", err)
+	}
+
+	for _, e := range events {
+		second.count(e)
+	}
+
+	if got := second.Counts()[EventPowerFailure.String()]; got != 2 {
+		t.Errorf("expected 2 power failures after restart, got %d", got)
+	}
+}
+
+func TestEventCounter_Handover(t *testing.T) {
+	history := []string{
+		"2021-11-06 15:39:29 -0400  Power failure.",
+		"2021-11-06 15:40:23 -0400  Power is back. UPS running on mains.",
+	}
+
+	stateFile := filepath.Join(t.TempDir(), "events.json")
+	oldSource := &staticSource{events: history}
+	oldCounter, err := NewEventCounter(NewEventWatcher(oldSource, 5*time.Millisecond, time.Second, log.NewNopLogger()), stateFile, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error creating counter: %s", err)
+	}
+
+	oldCtx, oldCancel := context.WithCancel(context.Background())
+	defer oldCancel()
+	go oldCounter.Run(oldCtx)
+
+	// wait for the counter to seed itself from the existing events
+	time.Sleep(50 * time.Millisecond)
+	oldSource.setEvents(append(history, "2021-11-06 16:00:00 -0400  Power failure."))
+	waitForCounts(t, oldCounter, EventPowerFailure, 1)
+
+	// both counters run at the same time while the new one replaces the old one
+	newSource := &staticSource{events: append(history, "2021-11-06 16:00:00 -0400  Power failure.")}
+	newCounter := oldCounter.Handover(NewEventWatcher(newSource, 5*time.Millisecond, time.Second, log.NewNopLogger()), log.NewNopLogger())
+
+	newCtx, newCancel := context.WithCancel(context.Background())
+	defer newCancel()
+	go newCounter.Run(newCtx)
+
+	events := append(history,
+		"2021-11-06 16:00:00 -0400  Power failure.",
+		"2021-11-06 16:10:00 -0400  Power failure.",
+	)
+	oldSource.setEvents(events)
+	newSource.setEvents(events)
+	waitForCounts(t, newCounter, EventPowerFailure, 2)
+
+	oldCancel()
+	newSource.setEvents(append(events, "2021-11-06 16:20:00 -0400  Power failure."))
+	waitForCounts(t, newCounter, EventPowerFailure, 3)
+
+	if newCounter.StateFile() != stateFile {
+		t.Errorf("expected state file %s, got %s", stateFile, newCounter.StateFile())
+	}
+
+	// the same counts are seen by both counters and saved to the state file
+	loaded, err := NewEventCounter(nil, stateFile, log.NewNopLogger())
+	if err != nil {
+		t.Fatalf("unexpected error loading counter: %s", err)
+	}
+
+	for _, c := range []*EventCounter{oldCounter, loaded} {
+		if got := c.Counts()[EventPowerFailure.String()]; got != 3 {
+			t.Errorf("expected 3 power failures, got %d", got)
+		}
+	}
+}
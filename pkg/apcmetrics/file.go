@@ -0,0 +1,224 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	DefaultStatusFile = "/var/log/apcupsd.status"
+	DefaultEventsFile = "/var/log/apcupsd.events"
+)
+
+// rotatedSuffix matches the suffixes added to the events file by log rotation,
+// either numbered (apcupsd.events.1) or dated (apcupsd.events-20211107), and
+// optionally compressed. Other files next to the events file such as editor swap
+// files or temporary files are not rotated copies.
+var rotatedSuffix = regexp.MustCompile(`^(\.[0-9]+|-[0-9]{8})(\.gz)?$`)
+
+// ApcFileSource reads the status and events of a UPS from the files written by
+// apcupsd (STATFILE and EVENTSFILE in apcupsd.conf) instead of using the NIS
+// server of apcupsd. This allows status and events to be read when apcupsd is
+// run with NETSERVER off.
+type ApcFileSource struct {
+	statusFile string
+	eventsFile string
+	logger     log.Logger
+}
+
+func NewApcFileSource(statusFile string, eventsFile string, logger log.Logger) *ApcFileSource {
+	return &ApcFileSource{
+		statusFile: statusFile,
+		eventsFile: eventsFile,
+		logger:     logger,
+	}
+}
+
+func (f *ApcFileSource) Status(ctx context.Context) (*ApcStatus, error) {
+	status, err := f.StatusRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseStatusFromLines(status)
+}
+
+func (f *ApcFileSource) Events(ctx context.Context) ([]ApcEvent, error) {
+	events, err := f.EventsRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseEventsFromLines(events)
+}
+
+// StatusRaw reads the status file written by apcupsd. Since apcupsd rewrites the
+// file in place, a status without an "END APC" line is treated as truncated.
+func (f *ApcFileSource) StatusRaw(_ context.Context) ([]string, error) {
+	lines, err := readLines(f.statusFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lines) == 0 || !strings.HasPrefix(lines[len(lines)-1], endRecord) {
+		return nil, fmt.Errorf("%w: missing %s file=%s", ErrTruncatedResponse, endRecord, f.statusFile)
+	}
+
+	return lines, nil
+}
+
+// EventsRaw reads the events file written by apcupsd along with any rotated
+// copies of it (e.g. apcupsd.events.1 or apcupsd.events.2.gz), oldest first.
+// Rotated files that can't be read are logged and skipped so that old history
+// can't prevent reading events. Lines of any file that aren't valid events, such
+// as those partially written during a crash, are logged and skipped.
+func (f *ApcFileSource) EventsRaw(_ context.Context) ([]string, error) {
+	files, err := f.rotatedEventsFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	var out []string
+	for _, file := range files {
+		lines, err := readLines(file)
+		if err != nil {
+			level.Warn(f.logger).Log("msg", "skipping unreadable rotated events file", "file", file, "err", err)
+			continue
+		}
+
+		out = append(out, f.validEvents(file, lines)...)
+	}
+
+	lines, err := readLines(f.eventsFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(out, f.validEvents(f.eventsFile, lines)...), nil
+}
+
+// validEvents returns the lines of an events file that are valid events, logging
+// and skipping any others.
+func (f *ApcFileSource) validEvents(file string, lines []string) []string {
+	out := make([]string, 0, len(lines))
+	for _, line := range lines {
+		if _, err := parseEvent(line); err != nil {
+			level.Warn(f.logger).Log("msg", "skipping invalid line of events file", "file", file, "line", line, "err", err)
+			continue
+		}
+
+		out = append(out, line)
+	}
+
+	return out
+}
+
+// rotatedEventsFiles returns rotated copies of the events file, oldest first. Files
+// are ordered by modification time so that both numbered (apcupsd.events.1) and dated
+// (apcupsd.events-20211107) rotation schemes are handled.
+func (f *ApcFileSource) rotatedEventsFiles() ([]string, error) {
+	candidates, err := filepath.Glob(f.eventsFile + "?*")
+	if err != nil {
+		return nil, err
+	}
+
+	var matches []string
+	for _, m := range candidates {
+		if rotatedSuffix.MatchString(strings.TrimPrefix(m, f.eventsFile)) {
+			matches = append(matches, m)
+		}
+	}
+
+	type rotated struct {
+		path  string
+		mtime int64
+	}
+
+	files := make([]rotated, 0, len(matches))
+	for _, m := range matches {
+		info, err := os.Stat(m)
+		if err != nil {
+			// the file may have been removed by log rotation since we listed it
+			level.Debug(f.logger).Log("msg", "skipping rotated events file", "file", m, "err", err)
+			continue
+		}
+
+		if info.Mode().IsRegular() {
+			files = append(files, rotated{path: m, mtime: info.ModTime().UnixNano()})
+		}
+	}
+
+	sort.SliceStable(files, func(i, j int) bool { return files[i].mtime < files[j].mtime })
+
+	out := make([]string, 0, len(files))
+	for _, r := range files {
+		out = append(out, r.path)
+	}
+
+	return out, nil
+}
+
+// readLines reads all non-empty lines of a file, decompressing it if it is gzipped.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = f.Close() }()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return nil, fmt.Errorf("unable to decompress %s: %w", path, err)
+		}
+
+		defer func() { _ = gz.Close() }()
+		r = gz
+	}
+
+	var out []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" {
+			out = append(out, line)
+		}
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
@@ -0,0 +1,212 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// writeEventsFile writes lines to a file, compressing them if the name ends
+// in .gz, and sets the modification time of the file to mtime.
+func writeEventsFile(t *testing.T, path string, lines []string, mtime time.Time) {
+	t.Helper()
+
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatalf("unable to create %s: %s", path, err)
+	}
+
+	content := strings.Join(lines, "\n") + "\n"
+	if strings.HasSuffix(path, ".gz") {
+		gz := gzip.NewWriter(f)
+		_, err = gz.Write([]byte(content))
+		if err == nil {
+			err = gz.Close()
+		}
+	} else {
+		_, err = f.Write([]byte(content))
+	}
+
+	if err != nil {
+		t.Fatalf("unable to write %s: %s", path, err)
+	}
+
+	if err := f.Close(); err != nil {
+		t.Fatalf("unable to close %s: %s", path, err)
+	}
+
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatalf("unable to set modification time of %s: %s", path, err)
+	}
+}
+
+func TestApcFileSource_Status(t *testing.T) {
+	tests := []struct {
+		name       string
+		lines      []string
+		missing    bool
+		wantErr    error
+		wantStatus string
+		wantCharge Percent
+	}{
+		{
+			name: "complete",
+			lines: []string{
+				"APC      : 001,036,0857",
+				"STATUS   : ONBATT",
+				"BCHARGE  : 87.0 Percent",
+				"END APC  : 2021-11-06 15:40:00 -0400",
+			},
+			wantStatus: "ONBATT",
+			wantCharge: 87,
+		},
+		{
+			name: "surrounding whitespace and blank lines",
+			lines: []string{
+				"",
+				"  STATUS   : ONLINE  ",
+				"BCHARGE  : 100.0 Percent",
+				"",
+				"END APC  : 2021-11-06 15:40:00 -0400",
+				"",
+			},
+			wantStatus: "ONLINE",
+			wantCharge: 100,
+		},
+		{
+			name: "rewritten while reading",
+			lines: []string{
+				"APC      : 001,036,0857",
+				"STATUS   : ONLINE",
+			},
+			wantErr: ErrTruncatedResponse,
+		},
+		{
+			name:    "empty",
+			lines:   []string{""},
+			wantErr: ErrTruncatedResponse,
+		},
+		{
+			name:    "missing",
+			missing: true,
+			wantErr: os.ErrNotExist,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			statusFile := filepath.Join(t.TempDir(), "apcupsd.status")
+			if !tc.missing {
+				writeEventsFile(t, statusFile, tc.lines, time.Now())
+			}
+
+			source := NewApcFileSource(statusFile, DefaultEventsFile, log.NewNopLogger())
+			status, err := source.Status(context.Background())
+
+			if tc.wantErr != nil {
+				if !errors.Is(err, tc.wantErr) {
+					t.Fatalf("expected error %v, got %v", tc.wantErr, err)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error reading status: %s", err)
+			}
+
+			if status.Status != tc.wantStatus {
+				t.Errorf("expected status %s, got %s", tc.wantStatus, status.Status)
+			}
+
+			if status.ChargePercent != tc.wantCharge {
+				t.Errorf("expected charge %v, got %v", tc.wantCharge, status.ChargePercent)
+			}
+		})
+	}
+}
+
+func TestApcFileSource_EventsRotated(t *testing.T) {
+	dir := t.TempDir()
+	eventsFile := filepath.Join(dir, "apcupsd.events")
+	now := time.Now()
+
+	writeEventsFile(t, eventsFile+".2.gz", []string{
+		"2021-10-01 10:00:00 -0400  Power failure.",
+		"2021-10-01 10:01:00 -0400  Power is back. UPS running on mains.",
+	}, now.Add(-48*time.Hour))
+	writeEventsFile(t, eventsFile+".1", []string{
+		"2021-10-15 10:00:00 -0400  Power failure.",
+		"garbage written during a crash",
+		"2021-10-15 10:01:00 -0400  Power is back. UPS running on mains.",
+	}, now.Add(-24*time.Hour))
+	writeEventsFile(t, eventsFile+"-20211020", []string{
+		"2021-10-20 10:00:00 -0400  Power failure.",
+	}, now.Add(-12*time.Hour))
+	if err := os.WriteFile(eventsFile+".3.gz", []byte("not gzip"), 0644); err != nil {
+		t.Fatalf("unable to write corrupt rotated file: %s", err)
+	}
+	// files next to the events file that aren't rotated copies of it are ignored
+	writeEventsFile(t, eventsFile+".swp", []string{
+		"2021-09-01 10:00:00 -0400  Power failure.",
+	}, now.Add(-72*time.Hour))
+	writeEventsFile(t, eventsFile+".tmp", []string{
+		"2021-09-02 10:00:00 -0400  Power failure.",
+	}, now.Add(-72*time.Hour))
+	writeEventsFile(t, eventsFile+".1.bak", []string{
+		"2021-09-03 10:00:00 -0400  Power failure.",
+	}, now.Add(-72*time.Hour))
+	writeEventsFile(t, eventsFile, []string{
+		"2021-11-06 15:39:29 -0400  Power failure.",
+		"2021-11-06 15:39",
+	}, now)
+
+	source := NewApcFileSource(filepath.Join(dir, "apcupsd.status"), eventsFile, log.NewNopLogger())
+
+	lines, err := source.EventsRaw(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error reading events: %s", err)
+	}
+
+	want := []string{
+		"2021-10-01 10:00:00 -0400  Power failure.",
+		"2021-10-01 10:01:00 -0400  Power is back. UPS running on mains.",
+		"2021-10-15 10:00:00 -0400  Power failure.",
+		"2021-10-15 10:01:00 -0400  Power is back. UPS running on mains.",
+		"2021-10-20 10:00:00 -0400  Power failure.",
+		"2021-11-06 15:39:29 -0400  Power failure.",
+	}
+
+	if !reflect.DeepEqual(lines, want) {
+		t.Fatalf("expected lines\n%q\ngot\n%q", want, lines)
+	}
+
+	if _, err := source.Events(context.Background()); err != nil {
+		t.Fatalf("unexpected error parsing events: %s", err)
+	}
+}
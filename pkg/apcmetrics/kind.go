@@ -0,0 +1,170 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"fmt"
+	"strings"
+)
+
+// EventKind is the type of event logged by apcupsd.
+type EventKind int
+
+const (
+	EventOther EventKind = iota
+	EventPowerFailure
+	EventOnBattery
+	EventOffBattery
+	EventPowerBack
+	EventSelfTestStart
+	EventSelfTestComplete
+	EventCommLost
+	EventCommRestored
+	EventBatteryExhausted
+	EventChargeLimit
+	EventRuntimeLimit
+	EventShutdown
+	EventRemoteShutdown
+	EventReplaceBattery
+	EventBatteryDisconnected
+	EventBatteryReattached
+	EventEmergency
+	EventLogoff
+	EventDaemonStart
+	EventDaemonStop
+)
+
+// eventKindNames are the names of each kind of event, used for JSON
+// output and the "type" label of the apc_events_total metric.
+var eventKindNames = map[EventKind]string{
+	EventOther:               "other",
+	EventPowerFailure:        "power_failure",
+	EventOnBattery:           "on_battery",
+	EventOffBattery:          "off_battery",
+	EventPowerBack:           "power_back",
+	EventSelfTestStart:       "self_test_start",
+	EventSelfTestComplete:    "self_test_complete",
+	EventCommLost:            "comm_lost",
+	EventCommRestored:        "comm_restored",
+	EventBatteryExhausted:    "battery_exhausted",
+	EventChargeLimit:         "charge_limit",
+	EventRuntimeLimit:        "runtime_limit",
+	EventShutdown:            "shutdown",
+	EventRemoteShutdown:      "remote_shutdown",
+	EventReplaceBattery:      "replace_battery",
+	EventBatteryDisconnected: "battery_disconnected",
+	EventBatteryReattached:   "battery_reattached",
+	EventEmergency:           "emergency",
+	EventLogoff:              "logoff",
+	EventDaemonStart:         "daemon_start",
+	EventDaemonStop:          "daemon_stop",
+}
+
+// EventKinds returns all kinds of events in order.
+func EventKinds() []EventKind {
+	out := make([]EventKind, 0, len(eventKindNames))
+	for k := EventOther; k <= EventDaemonStop; k++ {
+		out = append(out, k)
+	}
+
+	return out
+}
+
+func (k EventKind) String() string {
+	if name, ok := eventKindNames[k]; ok {
+		return name
+	}
+
+	return fmt.Sprintf("EventKind(%d)", int(k))
+}
+
+func (k EventKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+func (k *EventKind) UnmarshalText(text []byte) error {
+	for kind, name := range eventKindNames {
+		if name == string(text) {
+			*k = kind
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown event kind %q", string(text))
+}
+
+// eventMessages are the prefixes of messages logged by apcupsd for each kind
+// of event, taken from the apcupsd source, src/action.c.
+var eventMessages = []struct {
+	prefix string
+	kind   EventKind
+}{
+	{"Power failure.", EventPowerFailure},
+	{"Running on UPS batteries.", EventOnBattery},
+	{"Mains returned. No longer on UPS batteries.", EventOffBattery},
+	{"Power is back. UPS running on mains.", EventPowerBack},
+	{"UPS Self Test switch to battery.", EventSelfTestStart},
+	{"UPS Self Test completed", EventSelfTestComplete},
+	{"Communications with UPS lost.", EventCommLost},
+	{"Communications with UPS restored.", EventCommRestored},
+	{"Battery power exhausted.", EventBatteryExhausted},
+	{"Battery charge below low limit.", EventChargeLimit},
+	{"Reached run time limit on batteries.", EventRuntimeLimit},
+	{"Reached remaining time percentage limit on batteries.", EventRuntimeLimit},
+	{"Initiating system shutdown!", EventShutdown},
+	{"Remote shutdown requested.", EventRemoteShutdown},
+	{"UPS battery must be replaced.", EventReplaceBattery},
+	{"Battery disconnected.", EventBatteryDisconnected},
+	{"Battery reattached.", EventBatteryReattached},
+	{"Battery failure. Emergency.", EventEmergency},
+	{"Emergency Shutdown. Possible UPS battery failure.", EventEmergency},
+	{"Users requested to logoff.", EventLogoff},
+}
+
+// ClassifyEvent determines the kind of event based on the message logged by
+// apcupsd along with any details included in the message: the result of self
+// tests, the version of apcupsd when it starts, and the reason it exits.
+func ClassifyEvent(message string) (EventKind, string) {
+	for _, m := range eventMessages {
+		if strings.HasPrefix(message, m.prefix) {
+			var detail string
+			if m.kind == EventSelfTestComplete {
+				// e.g. "UPS Self Test completed: Battery OK"
+				detail = strings.TrimSpace(strings.TrimPrefix(strings.TrimPrefix(message, m.prefix), ":"))
+			}
+
+			return m.kind, detail
+		}
+	}
+
+	// messages logged by apcupsd itself include the version, e.g.
+	// "apcupsd 3.14.14 (31 May 2016) debian startup succeeded"
+	if strings.HasPrefix(message, "apcupsd ") {
+		if strings.HasSuffix(message, " startup succeeded") {
+			return EventDaemonStart, strings.TrimSuffix(strings.TrimPrefix(message, "apcupsd "), " startup succeeded")
+		} else if strings.HasSuffix(message, " shutdown succeeded") {
+			return EventDaemonStop, ""
+		} else if i := strings.Index(message, "exiting, "); i >= 0 {
+			// e.g. "apcupsd exiting, signal 15"
+			return EventDaemonStop, message[i+len("exiting, "):]
+		}
+	}
+
+	return EventOther, ""
+}
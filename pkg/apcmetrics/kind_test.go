@@ -0,0 +1,64 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"testing"
+)
+
+func TestClassifyEvent(t *testing.T) {
+	tests := []struct {
+		message    string
+		wantKind   EventKind
+		wantDetail string
+	}{
+		{message: "Power failure.", wantKind: EventPowerFailure},
+		{message: "Running on UPS batteries.", wantKind: EventOnBattery},
+		{message: "Mains returned. No longer on UPS batteries.", wantKind: EventOffBattery},
+		{message: "Power is back. UPS running on mains.", wantKind: EventPowerBack},
+		{message: "UPS Self Test switch to battery.", wantKind: EventSelfTestStart},
+		{message: "UPS Self Test completed: Battery OK", wantKind: EventSelfTestComplete, wantDetail: "Battery OK"},
+		{message: "UPS Self Test completed: Battery Failed", wantKind: EventSelfTestComplete, wantDetail: "Battery Failed"},
+		{message: "UPS Self Test completed", wantKind: EventSelfTestComplete},
+		{message: "Communications with UPS lost.", wantKind: EventCommLost},
+		{message: "Communications with UPS restored.", wantKind: EventCommRestored},
+		{message: "Reached run time limit on batteries.", wantKind: EventRuntimeLimit},
+		{message: "Reached remaining time percentage limit on batteries.", wantKind: EventRuntimeLimit},
+		{message: "Emergency Shutdown. Possible UPS battery failure.", wantKind: EventEmergency},
+		{message: "apcupsd 3.14.14 (31 May 2016) debian startup succeeded", wantKind: EventDaemonStart, wantDetail: "3.14.14 (31 May 2016) debian"},
+		{message: "apcupsd 3.14.14 (31 May 2016) debian shutdown succeeded", wantKind: EventDaemonStop},
+		{message: "apcupsd exiting, signal 15", wantKind: EventDaemonStop, wantDetail: "signal 15"},
+		{message: "apcupsd is doing something new", wantKind: EventOther},
+		{message: "Something unexpected happened.", wantKind: EventOther},
+		{message: "", wantKind: EventOther},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.message, func(t *testing.T) {
+			kind, detail := ClassifyEvent(tc.message)
+			if kind != tc.wantKind {
+				t.Errorf("expected kind %s, got %s", tc.wantKind, kind)
+			}
+
+			if detail != tc.wantDetail {
+				t.Errorf("expected detail %q, got %q", tc.wantDetail, detail)
+			}
+		})
+	}
+}
@@ -20,6 +20,7 @@ package apcmetrics
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/go-kit/log"
@@ -27,18 +28,97 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
-func NewApcCollector(client *ApcClient, timeout time.Duration, logger log.Logger) prometheus.Collector {
+// Classes of errors that can cause collection of UPS status to fail, used
+// as the value of the "class" label of the apc_scrape_failures_total metric.
+const (
+	failureDial     = "dial"
+	failureTimeout  = "timeout"
+	failureProtocol = "protocol"
+	failureParse    = "parse"
+	failureStale    = "stale"
+)
+
+// collectorLabels are the names of the labels that collectors for a UPS add to
+// metrics, which targets can't use for their own labels.
+var collectorLabels = []string{
+	"class", "status", "state", "name", "flag", "type",
+	"hostname", "version", "ups_name", "model", "driver", "ups_mode", "cable", "serial_number", "firmware",
+	// reserved by Prometheus for the buckets of histograms and quantiles of summaries
+	"le", "quantile",
+}
+
+// CollectorOptions control which metrics are exported by the collector.
+type CollectorOptions struct {
+	// LegacyStatus enables the apc_status metric which has the STATUS reported
+	// by apcupsd as a label. Prefer apc_state which has a fixed set of labels.
+	LegacyStatus bool
+	// Lenient exports all fields of the UPS status that can be parsed along with
+	// the number of fields that could not be parsed as apc_parse_errors instead of
+	// failing the entire collection when any field cannot be parsed.
+	Lenient bool
+	// GenericFields exports every numeric field of the UPS status that is not
+	// otherwise exported by a specific metric as apc_field with a "name" label.
+	GenericFields bool
+	// Poller, if set, is used to get the status of the UPS instead of contacting
+	// apcupsd on every collection. The age of the status is exported as
+	// apc_status_age_seconds. The poller must be started separately.
+	Poller *ApcPoller
+	// Probe indicates the collector is created for a single collection, such as
+	// for each request to the /probe endpoint. apc_scrape_failures_total is not
+	// exported since it would be reset by every collection and never increase.
+	Probe bool
+}
+
+func NewApcCollector(source Source, timeout time.Duration, opts CollectorOptions, logger log.Logger) prometheus.Collector {
+	scrapeFailures := prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "apc_scrape_failures_total",
+		Help: "Number of failed attempts to collect UPS status by class of error",
+	}, []string{"class"})
+
+	// Initialize all classes of errors so that they're exported as zero
+	// instead of being absent until the first failure of each class.
+	for _, class := range []string{failureDial, failureTimeout, failureProtocol, failureParse, failureStale} {
+		scrapeFailures.WithLabelValues(class)
+	}
+
 	return &apcCollector{
-		client:  client,
+		source:  source,
 		timeout: timeout,
+		opts:    opts,
 		logger:  logger,
 
+		up: prometheus.NewDesc(
+			"apc_up",
+			"Whether the last attempt to collect UPS status was successful",
+			nil,
+			nil,
+		),
+		scrapeDuration: prometheus.NewDesc(
+			"apc_scrape_duration_seconds",
+			"Time taken to collect UPS status in seconds",
+			nil,
+			nil,
+		),
+		scrapeFailures: scrapeFailures,
+		statusAge: prometheus.NewDesc(
+			"apc_status_age_seconds",
+			"Time since the UPS status was fetched from apcupsd in seconds",
+			nil,
+			nil,
+		),
+		parseErrors: prometheus.NewDesc(
+			"apc_parse_errors",
+			"Number of fields of the UPS status that could not be parsed",
+			nil,
+			nil,
+		),
+
 		// These descriptions mostly come from the apcupsd manual.
 		// http://www.apcupsd.org/manual/manual.html#status-report-fields
 		info: prometheus.NewDesc(
 			"apc_info",
 			"Info about the UPS",
-			[]string{"hostname", "version", "ups_name", "model", "driver", "ups_mode"},
+			[]string{"hostname", "version", "ups_name", "model", "driver", "ups_mode", "cable", "serial_number", "firmware"},
 			nil,
 		),
 		status: prometheus.NewDesc(
@@ -47,6 +127,24 @@ func NewApcCollector(client *ApcClient, timeout time.Duration, logger log.Logger
 			[]string{"status"},
 			nil,
 		),
+		state: prometheus.NewDesc(
+			"apc_state",
+			"Whether each state is part of the current status of the UPS",
+			[]string{"state"},
+			nil,
+		),
+		field: prometheus.NewDesc(
+			"apc_field",
+			"Value of a numeric field of the UPS status not exported by any other metric",
+			[]string{"name"},
+			nil,
+		),
+		statusFlag: prometheus.NewDesc(
+			"apc_status_flag",
+			"Whether each flag of the UPS status bitmask is set",
+			[]string{"flag"},
+			nil,
+		),
 		timeLeft: prometheus.NewDesc(
 			"apc_time_left",
 			"Remaining runtime left on the batteries in seconds",
@@ -131,16 +229,176 @@ func NewApcCollector(client *ApcClient, timeout time.Duration, logger log.Logger
 			nil,
 			nil,
 		),
+		date: prometheus.NewDesc(
+			"apc_last_update",
+			"Last time apcupsd retrieved status from the UPS as a UNIX timestamp",
+			nil,
+			nil,
+		),
+		startTime: prometheus.NewDesc(
+			"apc_start_time",
+			"Time apcupsd was started as a UNIX timestamp",
+			nil,
+			nil,
+		),
+		manufactureDate: prometheus.NewDesc(
+			"apc_manufacture_date",
+			"Date the UPS was manufactured as a UNIX timestamp",
+			nil,
+			nil,
+		),
+		outputVoltage: prometheus.NewDesc(
+			"apc_output_voltage",
+			"Voltage the UPS is supplying to the load",
+			nil,
+			nil,
+		),
+		maxLineVoltage: prometheus.NewDesc(
+			"apc_max_line_voltage",
+			"Maximum line voltage since the last report",
+			nil,
+			nil,
+		),
+		minLineVoltage: prometheus.NewDesc(
+			"apc_min_line_voltage",
+			"Minimum line voltage since the last report",
+			nil,
+			nil,
+		),
+		nominalOutputVoltage: prometheus.NewDesc(
+			"apc_nominal_output_voltage",
+			"Nominal output voltage to supply when on batteries",
+			nil,
+			nil,
+		),
+		outputCurrent: prometheus.NewDesc(
+			"apc_output_current",
+			"Current the UPS is supplying to the load in amps",
+			nil,
+			nil,
+		),
+		nominalApparentPower: prometheus.NewDesc(
+			"apc_nominal_apparent_power",
+			"Max apparent power the UPS is designed to supply in volt-amps",
+			nil,
+			nil,
+		),
+		lineFrequency: prometheus.NewDesc(
+			"apc_line_frequency",
+			"Current line frequency in hertz",
+			nil,
+			nil,
+		),
+		internalTemperature: prometheus.NewDesc(
+			"apc_internal_temperature",
+			"Internal UPS temperature in degrees Celsius",
+			nil,
+			nil,
+		),
+		ambientTemperature: prometheus.NewDesc(
+			"apc_ambient_temperature",
+			"Ambient temperature in degrees Celsius",
+			nil,
+			nil,
+		),
+		humidityPercent: prometheus.NewDesc(
+			"apc_humidity_percent",
+			"Ambient humidity percentage",
+			nil,
+			nil,
+		),
+		minChargePercent: prometheus.NewDesc(
+			"apc_min_charge_percent",
+			"Percentage of charge of the batteries at which apcupsd will shut down the system",
+			nil,
+			nil,
+		),
+		returnChargePercent: prometheus.NewDesc(
+			"apc_return_charge_percent",
+			"Percentage of charge of the batteries required to power on after a shutdown",
+			nil,
+			nil,
+		),
+		minTimeLeft: prometheus.NewDesc(
+			"apc_min_time_left",
+			"Remaining runtime in seconds at which apcupsd will shut down the system",
+			nil,
+			nil,
+		),
+		maxTimeOnBattery: prometheus.NewDesc(
+			"apc_max_time_on_battery",
+			"Max time in seconds to run on batteries before apcupsd will shut down the system",
+			nil,
+			nil,
+		),
+		timeOnBattery: prometheus.NewDesc(
+			"apc_time_on_battery",
+			"Time in seconds on batteries for the current transfer",
+			nil,
+			nil,
+		),
+		cumulativeTimeOnBattery: prometheus.NewDesc(
+			"apc_cumulative_time_on_battery",
+			"Total time in seconds on batteries since apcupsd startup",
+			nil,
+			nil,
+		),
+		lowBatterySignal: prometheus.NewDesc(
+			"apc_low_battery_signal",
+			"Remaining runtime in seconds at which the UPS will signal a low battery",
+			nil,
+			nil,
+		),
+		shutdownDelay: prometheus.NewDesc(
+			"apc_shutdown_delay",
+			"Delay in seconds the UPS will wait before shutting down when commanded",
+			nil,
+			nil,
+		),
+		wakeDelay: prometheus.NewDesc(
+			"apc_wake_delay",
+			"Delay in seconds the UPS will wait before powering on after power returns",
+			nil,
+			nil,
+		),
+		numTransfers: prometheus.NewDesc(
+			"apc_transfers_total",
+			"Number of transfers to batteries since apcupsd startup",
+			nil,
+			nil,
+		),
+		externalBatteries: prometheus.NewDesc(
+			"apc_external_batteries",
+			"Number of external batteries",
+			nil,
+			nil,
+		),
+		badBatteries: prometheus.NewDesc(
+			"apc_bad_batteries",
+			"Number of bad external batteries",
+			nil,
+			nil,
+		),
 	}
 }
 
 type apcCollector struct {
-	client  *ApcClient
+	source  Source
 	timeout time.Duration
+	opts    CollectorOptions
 	logger  log.Logger
 
+	up             *prometheus.Desc
+	scrapeDuration *prometheus.Desc
+	scrapeFailures *prometheus.CounterVec
+	statusAge      *prometheus.Desc
+	parseErrors    *prometheus.Desc
+
 	info                  *prometheus.Desc
 	status                *prometheus.Desc
+	state                 *prometheus.Desc
+	statusFlag            *prometheus.Desc
+	field                 *prometheus.Desc
 	timeLeft              *prometheus.Desc
 	loadPercent           *prometheus.Desc
 	chargePercent         *prometheus.Desc
@@ -155,11 +413,55 @@ type apcCollector struct {
 	lastTimeOnBattery     *prometheus.Desc
 	lastTimeOffBattery    *prometheus.Desc
 	lastSelfTest          *prometheus.Desc
+
+	date                    *prometheus.Desc
+	startTime               *prometheus.Desc
+	manufactureDate         *prometheus.Desc
+	outputVoltage           *prometheus.Desc
+	maxLineVoltage          *prometheus.Desc
+	minLineVoltage          *prometheus.Desc
+	nominalOutputVoltage    *prometheus.Desc
+	outputCurrent           *prometheus.Desc
+	nominalApparentPower    *prometheus.Desc
+	lineFrequency           *prometheus.Desc
+	internalTemperature     *prometheus.Desc
+	ambientTemperature      *prometheus.Desc
+	humidityPercent         *prometheus.Desc
+	minChargePercent        *prometheus.Desc
+	returnChargePercent     *prometheus.Desc
+	minTimeLeft             *prometheus.Desc
+	maxTimeOnBattery        *prometheus.Desc
+	timeOnBattery           *prometheus.Desc
+	cumulativeTimeOnBattery *prometheus.Desc
+	lowBatterySignal        *prometheus.Desc
+	shutdownDelay           *prometheus.Desc
+	wakeDelay               *prometheus.Desc
+	numTransfers            *prometheus.Desc
+	externalBatteries       *prometheus.Desc
+	badBatteries            *prometheus.Desc
 }
 
 func (a *apcCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.up
+	ch <- a.scrapeDuration
+	if !a.opts.Probe {
+		a.scrapeFailures.Describe(ch)
+	}
+	if a.opts.Poller != nil {
+		ch <- a.statusAge
+	}
+	if a.opts.Lenient {
+		ch <- a.parseErrors
+	}
 	ch <- a.info
-	ch <- a.status
+	if a.opts.LegacyStatus {
+		ch <- a.status
+	}
+	ch <- a.state
+	ch <- a.statusFlag
+	if a.opts.GenericFields {
+		ch <- a.field
+	}
 	ch <- a.timeLeft
 	ch <- a.loadPercent
 	ch <- a.chargePercent
@@ -174,18 +476,137 @@ func (a *apcCollector) Describe(ch chan<- *prometheus.Desc) {
 	ch <- a.lastTimeOnBattery
 	ch <- a.lastTimeOffBattery
 	ch <- a.lastSelfTest
+	ch <- a.date
+	ch <- a.startTime
+	ch <- a.manufactureDate
+	ch <- a.outputVoltage
+	ch <- a.maxLineVoltage
+	ch <- a.minLineVoltage
+	ch <- a.nominalOutputVoltage
+	ch <- a.outputCurrent
+	ch <- a.nominalApparentPower
+	ch <- a.lineFrequency
+	ch <- a.internalTemperature
+	ch <- a.ambientTemperature
+	ch <- a.humidityPercent
+	ch <- a.minChargePercent
+	ch <- a.returnChargePercent
+	ch <- a.minTimeLeft
+	ch <- a.maxTimeOnBattery
+	ch <- a.timeOnBattery
+	ch <- a.cumulativeTimeOnBattery
+	ch <- a.lowBatterySignal
+	ch <- a.shutdownDelay
+	ch <- a.wakeDelay
+	ch <- a.numTransfers
+	ch <- a.externalBatteries
+	ch <- a.badBatteries
 }
 
 func (a *apcCollector) Collect(ch chan<- prometheus.Metric) {
-	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
-	defer cancel()
+	start := time.Now()
+	status, parseErrs, err := a.fetchStatus(ch)
+	ch <- prometheus.MustNewConstMetric(a.scrapeDuration, prometheus.GaugeValue, time.Since(start).Seconds())
 
-	status, err := a.client.Status(ctx)
 	if err != nil {
-		level.Error(a.logger).Log("msg", "unable to determine UPS status", "err", err)
+		class := errorClass(err)
+		level.Error(a.logger).Log("msg", "unable to determine UPS status", "class", class, "err", err)
+		a.scrapeFailures.WithLabelValues(class).Inc()
+		a.collectScrapeFailures(ch)
+		ch <- prometheus.MustNewConstMetric(a.up, prometheus.GaugeValue, 0)
 		return
 	}
 
+	a.collectScrapeFailures(ch)
+	ch <- prometheus.MustNewConstMetric(a.up, prometheus.GaugeValue, 1)
+
+	// fields that could not be parsed in lenient mode are left unset, make
+	// sure we don't export their zero values as if they were reported
+	failed := make(map[string]bool, len(parseErrs))
+	for _, e := range parseErrs {
+		level.Warn(a.logger).Log("msg", "unable to parse UPS status field", "field", e.Field, "value", e.Value, "err", e.Err)
+		failed[e.Field] = true
+	}
+
+	if a.opts.Lenient {
+		ch <- prometheus.MustNewConstMetric(a.parseErrors, prometheus.GaugeValue, float64(len(parseErrs)))
+	}
+
+	a.collectStatus(ch, status, failed)
+}
+
+func (a *apcCollector) collectScrapeFailures(ch chan<- prometheus.Metric) {
+	if !a.opts.Probe {
+		a.scrapeFailures.Collect(ch)
+	}
+}
+
+// fetchStatus gets the current status of the UPS from apcupsd, or the poller if
+// there is one, and parses it. When the collector is in lenient mode, errors parsing
+// individual fields are returned separately and do not prevent the rest of the status
+// from being returned.
+func (a *apcCollector) fetchStatus(ch chan<- prometheus.Metric) (*ApcStatus, []*ParseError, error) {
+	lines, err := a.fetchLines(ch)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if a.opts.Lenient {
+		status, parseErrs := ParseStatusFromLinesLenient(lines)
+		return status, parseErrs, nil
+	}
+
+	status, err := ParseStatusFromLines(lines)
+	return status, nil, err
+}
+
+// fetchLines gets the raw status of the UPS from the poller, exporting its age,
+// if the collector has one or directly from apcupsd otherwise.
+func (a *apcCollector) fetchLines(ch chan<- prometheus.Metric) ([]string, error) {
+	if a.opts.Poller != nil {
+		snapshot, err := a.opts.Poller.Latest()
+		if err != nil {
+			return nil, err
+		}
+
+		ch <- prometheus.MustNewConstMetric(a.statusAge, prometheus.GaugeValue, snapshot.Age().Seconds())
+		return snapshot.Lines, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.timeout)
+	defer cancel()
+
+	return a.source.StatusRaw(ctx)
+}
+
+// errorClass determines the class of an error returned when fetching the status
+// of the UPS to be used as a label for the apc_scrape_failures_total metric.
+func errorClass(err error) string {
+	var connErr *ConnectionError
+	var timeoutErr *TimeoutError
+	var parseErr *ParseError
+
+	if errors.As(err, &timeoutErr) || isTimeout(err) {
+		return failureTimeout
+	} else if errors.As(err, &connErr) {
+		return failureDial
+	} else if errors.As(err, &parseErr) {
+		return failureParse
+	} else if errors.Is(err, ErrNoStatus) {
+		return failureStale
+	}
+
+	return failureProtocol
+}
+
+func (a *apcCollector) collectStatus(ch chan<- prometheus.Metric, status *ApcStatus, failed map[string]bool) {
+	// gauge exports a field if it was reported by the UPS and could be parsed
+	gauge := func(desc *prometheus.Desc, field string, val float64) {
+		if _, ok := status.Fields[field]; ok && !failed[field] {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, val)
+		}
+	}
+
 	ch <- prometheus.MustNewConstMetric(
 		a.info,
 		prometheus.GaugeValue,
@@ -196,19 +617,45 @@ func (a *apcCollector) Collect(ch chan<- prometheus.Metric) {
 		status.Model,
 		status.Driver,
 		status.UpsMode,
+		status.Cable,
+		status.SerialNumber,
+		status.Firmware,
 	)
 
-	ch <- prometheus.MustNewConstMetric(a.status, prometheus.GaugeValue, 1, status.Status)
-	ch <- prometheus.MustNewConstMetric(a.timeLeft, prometheus.GaugeValue, status.TimeLeft.Seconds())
-	ch <- prometheus.MustNewConstMetric(a.loadPercent, prometheus.GaugeValue, float64(status.LoadPercent))
-	ch <- prometheus.MustNewConstMetric(a.chargePercent, prometheus.GaugeValue, float64(status.ChargePercent))
-	ch <- prometheus.MustNewConstMetric(a.lineVoltage, prometheus.GaugeValue, float64(status.LineVoltage))
-	ch <- prometheus.MustNewConstMetric(a.lowTransferVoltage, prometheus.GaugeValue, float64(status.LowTransferVoltage))
-	ch <- prometheus.MustNewConstMetric(a.highTransferVoltage, prometheus.GaugeValue, float64(status.HighTransferVoltage))
-	ch <- prometheus.MustNewConstMetric(a.batteryVoltage, prometheus.GaugeValue, float64(status.BatteryVoltage))
-	ch <- prometheus.MustNewConstMetric(a.nominalBatteryVoltage, prometheus.GaugeValue, float64(status.NominalBatteryVoltage))
-	ch <- prometheus.MustNewConstMetric(a.nominalInputVoltage, prometheus.GaugeValue, float64(status.NominalInputVoltage))
-	ch <- prometheus.MustNewConstMetric(a.nominalWattage, prometheus.GaugeValue, float64(status.NominalWattage))
+	if a.opts.LegacyStatus {
+		ch <- prometheus.MustNewConstMetric(a.status, prometheus.GaugeValue, 1, status.Status)
+	}
+
+	for _, n := range upsStateNames {
+		var val float64
+		if status.States.Has(n.state) {
+			val = 1
+		}
+
+		ch <- prometheus.MustNewConstMetric(a.state, prometheus.GaugeValue, val, n.name)
+	}
+
+	if status.Flags != nil {
+		for _, n := range statusFlagNames {
+			var val float64
+			if status.Flags.Has(n.flag) {
+				val = 1
+			}
+
+			ch <- prometheus.MustNewConstMetric(a.statusFlag, prometheus.GaugeValue, val, n.name)
+		}
+	}
+
+	gauge(a.timeLeft, "TIMELEFT", status.TimeLeft.Seconds())
+	gauge(a.loadPercent, "LOADPCT", float64(status.LoadPercent))
+	gauge(a.chargePercent, "BCHARGE", float64(status.ChargePercent))
+	gauge(a.lineVoltage, "LINEV", float64(status.LineVoltage))
+	gauge(a.lowTransferVoltage, "LOTRANS", float64(status.LowTransferVoltage))
+	gauge(a.highTransferVoltage, "HITRANS", float64(status.HighTransferVoltage))
+	gauge(a.batteryVoltage, "BATTV", float64(status.BatteryVoltage))
+	gauge(a.nominalBatteryVoltage, "NOMBATTV", float64(status.NominalBatteryVoltage))
+	gauge(a.nominalInputVoltage, "NOMINV", float64(status.NominalInputVoltage))
+	gauge(a.nominalWattage, "NOMPOWER", float64(status.NominalWattage))
 
 	if !status.BatteryDate.IsZero() {
 		ch <- prometheus.MustNewConstMetric(a.batteryDate, prometheus.GaugeValue, float64(status.BatteryDate.Unix()))
@@ -222,4 +669,199 @@ func (a *apcCollector) Collect(ch chan<- prometheus.Metric) {
 	if !status.LastSelfTest.IsZero() {
 		ch <- prometheus.MustNewConstMetric(a.lastSelfTest, prometheus.GaugeValue, float64(status.LastSelfTest.Unix()))
 	}
+	if !status.Date.IsZero() {
+		ch <- prometheus.MustNewConstMetric(a.date, prometheus.GaugeValue, float64(status.Date.Unix()))
+	}
+	if !status.StartTime.IsZero() {
+		ch <- prometheus.MustNewConstMetric(a.startTime, prometheus.GaugeValue, float64(status.StartTime.Unix()))
+	}
+	if !status.ManufactureDate.IsZero() {
+		ch <- prometheus.MustNewConstMetric(a.manufactureDate, prometheus.GaugeValue, float64(status.ManufactureDate.Unix()))
+	}
+
+	if status.OutputVoltage != nil {
+		ch <- prometheus.MustNewConstMetric(a.outputVoltage, prometheus.GaugeValue, float64(*status.OutputVoltage))
+	}
+	if status.MaxLineVoltage != nil {
+		ch <- prometheus.MustNewConstMetric(a.maxLineVoltage, prometheus.GaugeValue, float64(*status.MaxLineVoltage))
+	}
+	if status.MinLineVoltage != nil {
+		ch <- prometheus.MustNewConstMetric(a.minLineVoltage, prometheus.GaugeValue, float64(*status.MinLineVoltage))
+	}
+	if status.NominalOutputVoltage != nil {
+		ch <- prometheus.MustNewConstMetric(a.nominalOutputVoltage, prometheus.GaugeValue, float64(*status.NominalOutputVoltage))
+	}
+	if status.OutputCurrent != nil {
+		ch <- prometheus.MustNewConstMetric(a.outputCurrent, prometheus.GaugeValue, float64(*status.OutputCurrent))
+	}
+	if status.NominalApparentPower != nil {
+		ch <- prometheus.MustNewConstMetric(a.nominalApparentPower, prometheus.GaugeValue, float64(*status.NominalApparentPower))
+	}
+	if status.LineFrequency != nil {
+		ch <- prometheus.MustNewConstMetric(a.lineFrequency, prometheus.GaugeValue, float64(*status.LineFrequency))
+	}
+	if status.InternalTemperature != nil {
+		ch <- prometheus.MustNewConstMetric(a.internalTemperature, prometheus.GaugeValue, float64(*status.InternalTemperature))
+	}
+	if status.AmbientTemperature != nil {
+		ch <- prometheus.MustNewConstMetric(a.ambientTemperature, prometheus.GaugeValue, float64(*status.AmbientTemperature))
+	}
+	if status.HumidityPercent != nil {
+		ch <- prometheus.MustNewConstMetric(a.humidityPercent, prometheus.GaugeValue, float64(*status.HumidityPercent))
+	}
+	if status.MinChargePercent != nil {
+		ch <- prometheus.MustNewConstMetric(a.minChargePercent, prometheus.GaugeValue, float64(*status.MinChargePercent))
+	}
+	if status.ReturnChargePercent != nil {
+		ch <- prometheus.MustNewConstMetric(a.returnChargePercent, prometheus.GaugeValue, float64(*status.ReturnChargePercent))
+	}
+	if status.MinTimeLeft != nil {
+		ch <- prometheus.MustNewConstMetric(a.minTimeLeft, prometheus.GaugeValue, status.MinTimeLeft.Seconds())
+	}
+	if status.MaxTimeOnBattery != nil {
+		ch <- prometheus.MustNewConstMetric(a.maxTimeOnBattery, prometheus.GaugeValue, status.MaxTimeOnBattery.Seconds())
+	}
+	if status.TimeOnBattery != nil {
+		ch <- prometheus.MustNewConstMetric(a.timeOnBattery, prometheus.GaugeValue, status.TimeOnBattery.Seconds())
+	}
+	if status.CumulativeTimeOnBattery != nil {
+		ch <- prometheus.MustNewConstMetric(a.cumulativeTimeOnBattery, prometheus.GaugeValue, status.CumulativeTimeOnBattery.Seconds())
+	}
+	if status.LowBatterySignal != nil {
+		ch <- prometheus.MustNewConstMetric(a.lowBatterySignal, prometheus.GaugeValue, status.LowBatterySignal.Seconds())
+	}
+	if status.ShutdownDelay != nil {
+		ch <- prometheus.MustNewConstMetric(a.shutdownDelay, prometheus.GaugeValue, status.ShutdownDelay.Seconds())
+	}
+	if status.WakeDelay != nil {
+		ch <- prometheus.MustNewConstMetric(a.wakeDelay, prometheus.GaugeValue, status.WakeDelay.Seconds())
+	}
+	if status.NumTransfers != nil {
+		ch <- prometheus.MustNewConstMetric(a.numTransfers, prometheus.CounterValue, float64(*status.NumTransfers))
+	}
+	if status.ExternalBatteries != nil {
+		ch <- prometheus.MustNewConstMetric(a.externalBatteries, prometheus.GaugeValue, float64(*status.ExternalBatteries))
+	}
+	if status.BadBatteries != nil {
+		ch <- prometheus.MustNewConstMetric(a.badBatteries, prometheus.GaugeValue, float64(*status.BadBatteries))
+	}
+
+	if a.opts.GenericFields {
+		for name, v := range status.UnknownFields() {
+			// most unknown fields will be numeric but skip any that aren't
+			// (strings, dates, hex registers) since they can't be exported
+			if val, err := parseNumber(v); err == nil {
+				ch <- prometheus.MustNewConstMetric(a.field, prometheus.GaugeValue, val, name)
+			}
+		}
+	}
+}
+
+// NewApcClientCollector returns a collector for metrics about requests
+// made by the client to apcupsd such as how often requests were coalesced.
+func NewApcClientCollector(client *ApcClient) prometheus.Collector {
+	return &apcClientCollector{
+		client: client,
+
+		requests: prometheus.NewDesc(
+			"apc_client_requests_total",
+			"Number of requests made to the apcupsd client",
+			nil,
+			nil,
+		),
+		coalesced: prometheus.NewDesc(
+			"apc_client_coalesced_requests_total",
+			"Number of requests served by an identical request already in flight instead of contacting apcupsd",
+			nil,
+			nil,
+		),
+		connections: prometheus.NewDesc(
+			"apc_client_connections_total",
+			"Number of connections made to apcupsd",
+			nil,
+			nil,
+		),
+	}
+}
+
+type apcClientCollector struct {
+	client *ApcClient
+
+	requests    *prometheus.Desc
+	coalesced   *prometheus.Desc
+	connections *prometheus.Desc
+}
+
+func (a *apcClientCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.requests
+	ch <- a.coalesced
+	ch <- a.connections
+}
+
+func (a *apcClientCollector) Collect(ch chan<- prometheus.Metric) {
+	stats := a.client.Stats()
+
+	ch <- prometheus.MustNewConstMetric(a.requests, prometheus.CounterValue, float64(stats.Requests))
+	ch <- prometheus.MustNewConstMetric(a.coalesced, prometheus.CounterValue, float64(stats.Coalesced))
+	ch <- prometheus.MustNewConstMetric(a.connections, prometheus.CounterValue, float64(stats.Connections))
+}
+
+// NewApcPollerCollector returns a collector for metrics about samples of
+// UPS status taken by the poller while the UPS is on batteries.
+func NewApcPollerCollector(poller *ApcPoller) prometheus.Collector {
+	return &apcPollerCollector{poller: poller}
+}
+
+type apcPollerCollector struct {
+	poller *ApcPoller
+}
+
+func (a *apcPollerCollector) Describe(ch chan<- *prometheus.Desc) {
+	a.poller.samples.Describe(ch)
+	a.poller.chargePercent.Describe(ch)
+	a.poller.timeLeft.Describe(ch)
+	a.poller.loadPercent.Describe(ch)
+}
+
+func (a *apcPollerCollector) Collect(ch chan<- prometheus.Metric) {
+	a.poller.samples.Collect(ch)
+	a.poller.chargePercent.Collect(ch)
+	a.poller.timeLeft.Collect(ch)
+	a.poller.loadPercent.Collect(ch)
+}
+
+// NewApcEventCollector returns a collector for the number of each
+// type of event seen by the event counter.
+func NewApcEventCollector(counter *EventCounter) prometheus.Collector {
+	return &apcEventCollector{
+		counter: counter,
+
+		events: prometheus.NewDesc(
+			"apc_events_total",
+			"Number of events logged by apcupsd by type",
+			[]string{"type"},
+			nil,
+		),
+	}
+}
+
+type apcEventCollector struct {
+	counter *EventCounter
+
+	events *prometheus.Desc
+}
+
+func (a *apcEventCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- a.events
+}
+
+func (a *apcEventCollector) Collect(ch chan<- prometheus.Metric) {
+	counts := a.counter.Counts()
+
+	// export all known types of events even if they haven't been seen
+	// yet so that they're exported as zero instead of being absent
+	for _, k := range EventKinds() {
+		t := k.String()
+		ch <- prometheus.MustNewConstMetric(a.events, prometheus.CounterValue, float64(counts[t]), t)
+	}
 }
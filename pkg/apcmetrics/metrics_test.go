@@ -0,0 +1,183 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// staticSource is a Source that returns the same status and events until
+// they are changed by the test
+type staticSource struct {
+	mtx    sync.Mutex
+	status []string
+	events []string
+}
+
+func (s *staticSource) setStatus(status []string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.status = status
+}
+
+func (s *staticSource) setEvents(events []string) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.events = events
+}
+
+func (s *staticSource) Status(ctx context.Context) (*ApcStatus, error) {
+	lines, _ := s.StatusRaw(ctx)
+	return ParseStatusFromLines(lines)
+}
+
+func (s *staticSource) StatusRaw(ctx context.Context) ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.status, nil
+}
+
+func (s *staticSource) Events(ctx context.Context) ([]ApcEvent, error) {
+	lines, _ := s.EventsRaw(ctx)
+	return ParseEventsFromLines(lines)
+}
+
+func (s *staticSource) EventsRaw(ctx context.Context) ([]string, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.events, nil
+}
+
+func TestApcCollector_MissingFields(t *testing.T) {
+	source := &staticSource{status: []string{
+		"STATUS   : ONLINE",
+		"LOADPCT  : 6.0 Percent",
+		"BCHARGE  : 82.0 Percent",
+		"TIMELEFT : 72.0 Minutes",
+	}}
+
+	collector := NewApcCollector(source, time.Second, CollectorOptions{}, log.NewNopLogger())
+
+	for _, name := range []string{"apc_time_left", "apc_load_percent", "apc_charge_percent"} {
+		if n := testutil.CollectAndCount(collector, name); n != 1 {
+			t.Errorf("expected %s to be exported once, got %d", name, n)
+		}
+	}
+
+	for _, name := range []string{
+		"apc_line_voltage",
+		"apc_low_transfer_voltage",
+		"apc_high_transfer_voltage",
+		"apc_battery_voltage",
+		"apc_nominal_battery_voltage",
+		"apc_nominal_input_voltage",
+		"apc_nominal_wattage",
+	} {
+		if n := testutil.CollectAndCount(collector, name); n != 0 {
+			t.Errorf("expected %s not to be exported for a missing field, got %d", name, n)
+		}
+	}
+}
+
+func TestApcCollector_ScrapeFailures(t *testing.T) {
+	tests := []struct {
+		name  string
+		probe bool
+		want  int
+	}{
+		{name: "metrics", probe: false, want: 5},
+		{name: "probe", probe: true, want: 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			source := &staticSource{status: []string{"STATUS   : ONLINE"}}
+			collector := NewApcCollector(source, time.Second, CollectorOptions{Probe: tc.probe}, log.NewNopLogger())
+
+			if n := testutil.CollectAndCount(collector, "apc_scrape_failures_total"); n != tc.want {
+				t.Errorf("expected %d apc_scrape_failures_total series, got %d", tc.want, n)
+			}
+
+			if n := testutil.CollectAndCount(collector, "apc_up"); n != 1 {
+				t.Errorf("expected apc_up to be exported once, got %d", n)
+			}
+		})
+	}
+}
+
+func TestApcCollector_StateSet(t *testing.T) {
+	tests := []struct {
+		status string
+		want   map[string]float64
+	}{
+		{
+			status: "ONLINE",
+			want:   map[string]float64{"online": 1, "on_battery": 0, "low_battery": 0, "shutting_down": 0},
+		},
+		{
+			status: "ONBATT LOWBATT",
+			want:   map[string]float64{"online": 0, "on_battery": 1, "low_battery": 1, "shutting_down": 0},
+		},
+		{
+			status: "ONBATT SHUTTING DOWN",
+			want:   map[string]float64{"online": 0, "on_battery": 1, "low_battery": 0, "shutting_down": 1},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.status, func(t *testing.T) {
+			source := &staticSource{status: []string{"STATUS   : " + tc.status}}
+			reg := prometheus.NewPedanticRegistry()
+			reg.MustRegister(NewApcCollector(source, time.Second, CollectorOptions{}, log.NewNopLogger()))
+
+			families, err := reg.Gather()
+			if err != nil {
+				t.Fatalf("unexpected error gathering metrics: %s", err)
+			}
+
+			got := make(map[string]float64)
+			for _, f := range families {
+				if f.GetName() != "apc_state" {
+					continue
+				}
+
+				for _, m := range f.GetMetric() {
+					got[m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+				}
+			}
+
+			if len(got) != len(upsStateNames) {
+				t.Errorf("expected every state to be exported, got %v", got)
+			}
+
+			for state, want := range tc.want {
+				if got[state] != want {
+					t.Errorf("expected apc_state{state=%q} to be %v, got %v", state, want, got[state])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,423 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+const (
+	DefaultNutAddress = "localhost:3493"
+	DefaultNutUps     = "ups"
+
+	listVarCommand = "LIST VAR"
+	getVarCommand  = "GET VAR"
+)
+
+// nutField maps a variable reported by NUT to a field of the apcupsd status
+// report, converting the value to the format used by apcupsd. Convert returns
+// false if the value cannot be represented in that format.
+type nutField struct {
+	nut     []string
+	apc     string
+	convert func(string) (string, bool)
+}
+
+// nutFields are the fields of the apcupsd status report that can be derived
+// from NUT variables, in the order apcupsd reports them. Fields with more than
+// one NUT variable use the first one that is reported.
+var nutFields = []nutField{
+	{nut: []string{"driver.version"}, apc: "VERSION", convert: nutText},
+	{nut: []string{"driver.name"}, apc: "DRIVER", convert: nutText},
+	{nut: []string{"ups.model", "device.model"}, apc: "MODEL", convert: nutText},
+	{nut: []string{"ups.status"}, apc: "STATUS", convert: nutStatus},
+	{nut: []string{"ups.status"}, apc: "STATFLAG", convert: nutStatusFlags},
+	{nut: []string{"input.voltage"}, apc: "LINEV", convert: nutUnit("Volts")},
+	{nut: []string{"ups.load"}, apc: "LOADPCT", convert: nutUnit("Percent")},
+	{nut: []string{"battery.charge"}, apc: "BCHARGE", convert: nutUnit("Percent")},
+	{nut: []string{"battery.runtime"}, apc: "TIMELEFT", convert: nutMinutes},
+	{nut: []string{"battery.charge.low"}, apc: "MBATTCHG", convert: nutUnit("Percent")},
+	{nut: []string{"battery.runtime.low"}, apc: "MINTIMEL", convert: nutMinutes},
+	{nut: []string{"ups.delay.shutdown"}, apc: "DSHUTD", convert: nutUnit("Seconds")},
+	{nut: []string{"ups.delay.start"}, apc: "DWAKE", convert: nutUnit("Seconds")},
+	{nut: []string{"input.transfer.low"}, apc: "LOTRANS", convert: nutUnit("Volts")},
+	{nut: []string{"input.transfer.high"}, apc: "HITRANS", convert: nutUnit("Volts")},
+	{nut: []string{"input.frequency"}, apc: "LINEFREQ", convert: nutUnit("Hz")},
+	{nut: []string{"output.voltage"}, apc: "OUTPUTV", convert: nutUnit("Volts")},
+	{nut: []string{"output.current"}, apc: "OUTCURNT", convert: nutUnit("Amps")},
+	{nut: []string{"ups.temperature"}, apc: "ITEMP", convert: nutUnit("C")},
+	{nut: []string{"ambient.temperature"}, apc: "AMBTEMP", convert: nutUnit("C")},
+	{nut: []string{"ambient.humidity"}, apc: "HUMIDITY", convert: nutUnit("Percent")},
+	{nut: []string{"battery.voltage"}, apc: "BATTV", convert: nutUnit("Volts")},
+	{nut: []string{"input.transfer.reason"}, apc: "LASTXFER", convert: nutText},
+	{nut: []string{"ups.test.result"}, apc: "SELFTEST", convert: nutText},
+	{nut: []string{"ups.serial", "device.serial"}, apc: "SERIALNO", convert: nutText},
+	{nut: []string{"battery.date"}, apc: "BATTDATE", convert: nutDate},
+	{nut: []string{"input.voltage.nominal"}, apc: "NOMINV", convert: nutUnit("Volts")},
+	{nut: []string{"output.voltage.nominal"}, apc: "NOMOUTV", convert: nutUnit("Volts")},
+	{nut: []string{"battery.voltage.nominal"}, apc: "NOMBATTV", convert: nutUnit("Volts")},
+	{nut: []string{"ups.power.nominal"}, apc: "NOMAPNT", convert: nutUnit("VA")},
+	{nut: []string{"ups.realpower.nominal"}, apc: "NOMPOWER", convert: nutUnit("Watts")},
+	{nut: []string{"battery.packs"}, apc: "EXTBATTS", convert: nutNumber},
+	{nut: []string{"battery.packs.bad"}, apc: "BADBATTS", convert: nutNumber},
+	{nut: []string{"ups.mfr.date"}, apc: "MANDATE", convert: nutDate},
+	{nut: []string{"ups.firmware"}, apc: "FIRMWARE", convert: nutText},
+}
+
+// nutStates are the apcupsd states equivalent to each NUT status. NUT statuses
+// without an equivalent, such as CHRG or BYPASS, are not included.
+var nutStates = map[string]struct {
+	state UpsState
+	flag  StatusFlags
+}{
+	"OL":    {StateOnline, FlagOnline},
+	"OB":    {StateOnBattery, FlagOnBattery},
+	"LB":    {StateLowBattery, FlagLowBattery},
+	"RB":    {StateReplaceBattery, FlagReplaceBattery},
+	"OVER":  {StateOverload, FlagOverload},
+	"TRIM":  {StateTrim, FlagTrim},
+	"BOOST": {StateBoost, FlagBoost},
+	"CAL":   {StateCalibration, FlagCalibration},
+	"FSD":   {StateShuttingDown, FlagShutdown},
+}
+
+// NutClient gets the status of a UPS from the upsd daemon of Network UPS Tools
+// (NUT) and converts it to the status report used by apcupsd so that it can be
+// used in place of an ApcClient. NUT does not keep a log of events so there are
+// never any events for a UPS.
+type NutClient struct {
+	address string
+	ups     string
+	logger  log.Logger
+}
+
+func NewNutClient(address string, ups string, logger log.Logger) *NutClient {
+	return &NutClient{
+		address: address,
+		ups:     ups,
+		logger:  logger,
+	}
+}
+
+func (n *NutClient) connect(ctx context.Context) (net.Conn, error) {
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", n.address)
+	if err != nil {
+		if isTimeout(err) {
+			return nil, &TimeoutError{Address: n.address, Op: "connect", Err: err}
+		}
+
+		return nil, &ConnectionError{Address: n.address, Err: err}
+	}
+
+	deadline, _ := ctx.Deadline()
+	if err := conn.SetDeadline(deadline); err != nil {
+		_ = conn.Close()
+		return nil, &ConnectionError{Address: n.address, Err: err}
+	}
+
+	return conn, nil
+}
+
+// request writes a single command to upsd and returns each line of the response
+// for which done returns false, stopping at the first line for which it returns true.
+func (n *NutClient) request(ctx context.Context, cmd string, done func(string) bool) ([]string, error) {
+	conn, err := n.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		// politely end the session, any errors don't matter since we're done
+		_, _ = conn.Write([]byte("LOGOUT\n"))
+		if err := conn.Close(); err != nil {
+			level.Debug(n.logger).Log("msg", "failed to close upsd connection", "err", err)
+		}
+	}()
+
+	lines, err := n.exchange(conn, cmd, done)
+	if err != nil {
+		if isTimeout(err) {
+			return nil, &TimeoutError{Address: n.address, Op: cmd, Err: err}
+		}
+
+		return nil, &ProtocolError{Address: n.address, Command: cmd, Err: err}
+	}
+
+	return lines, nil
+}
+
+func (n *NutClient) exchange(conn net.Conn, cmd string, done func(string) bool) ([]string, error) {
+	if _, err := conn.Write([]byte(cmd + "\n")); err != nil {
+		return nil, err
+	}
+
+	var out []string
+	reader := bufio.NewReader(conn)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return nil, wrapReadError(err, cmd, "line")
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if strings.HasPrefix(line, "ERR ") {
+			return nil, fmt.Errorf("upsd error %s", strings.TrimPrefix(line, "ERR "))
+		}
+
+		if done(line) {
+			return out, nil
+		}
+
+		out = append(out, line)
+	}
+}
+
+// Vars returns all variables reported by NUT for the UPS using the LIST VAR command.
+func (n *NutClient) Vars(ctx context.Context) (map[string]string, error) {
+	cmd := fmt.Sprintf("%s %s", listVarCommand, n.ups)
+	end := fmt.Sprintf("END %s", cmd)
+
+	lines, err := n.request(ctx, cmd, func(line string) bool { return line == end })
+	if err != nil {
+		return nil, err
+	}
+
+	if len(lines) == 0 || lines[0] != fmt.Sprintf("BEGIN %s", cmd) {
+		return nil, &ProtocolError{Address: n.address, Command: cmd, Err: fmt.Errorf("%w: missing BEGIN %s", ErrMalformedResponse, cmd)}
+	}
+
+	out := make(map[string]string, len(lines)-1)
+	for _, line := range lines[1:] {
+		name, val, err := n.parseVar(line)
+		if err != nil {
+			return nil, &ProtocolError{Address: n.address, Command: cmd, Err: err}
+		}
+
+		out[name] = val
+	}
+
+	return out, nil
+}
+
+// Var returns a single variable reported by NUT for the UPS using the GET VAR command.
+func (n *NutClient) Var(ctx context.Context, name string) (string, error) {
+	cmd := fmt.Sprintf("%s %s %s", getVarCommand, n.ups, name)
+
+	// the response is a single line so stop reading at the first one and keep it
+	var line string
+	_, err := n.request(ctx, cmd, func(l string) bool {
+		line = l
+		return true
+	})
+	if err != nil {
+		return "", err
+	}
+
+	got, val, err := n.parseVar(line)
+	if err != nil {
+		return "", &ProtocolError{Address: n.address, Command: cmd, Err: err}
+	}
+
+	if got != name {
+		return "", &ProtocolError{Address: n.address, Command: cmd, Err: fmt.Errorf("%w: unexpected variable %s", ErrMalformedResponse, got)}
+	}
+
+	return val, nil
+}
+
+// parseVar parses a line of the form `VAR <ups> <name> "<value>"` where the
+// value may contain escaped quotes and backslashes.
+func (n *NutClient) parseVar(line string) (string, string, error) {
+	prefix := fmt.Sprintf("VAR %s ", n.ups)
+	if !strings.HasPrefix(line, prefix) {
+		return "", "", fmt.Errorf("%w: unexpected line %q", ErrMalformedResponse, line)
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(line, prefix), " ", 2)
+	if len(parts) != 2 {
+		return "", "", fmt.Errorf("%w: missing value %q", ErrMalformedResponse, line)
+	}
+
+	quoted := parts[1]
+	if len(quoted) < 2 || quoted[0] != '"' || quoted[len(quoted)-1] != '"' {
+		return "", "", fmt.Errorf("%w: unquoted value %q", ErrMalformedResponse, line)
+	}
+
+	var val strings.Builder
+	escaped := false
+	for _, r := range quoted[1 : len(quoted)-1] {
+		if r == '\\' && !escaped {
+			escaped = true
+			continue
+		}
+
+		escaped = false
+		val.WriteRune(r)
+	}
+
+	return parts[0], val.String(), nil
+}
+
+func (n *NutClient) Status(ctx context.Context) (*ApcStatus, error) {
+	status, err := n.StatusRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseStatusFromLines(status)
+}
+
+// Events always returns no events since NUT does not keep a log of them.
+func (n *NutClient) Events(ctx context.Context) ([]ApcEvent, error) {
+	return []ApcEvent{}, nil
+}
+
+// StatusRaw returns the variables reported by NUT for the UPS converted to the
+// status report used by apcupsd. Variables that have no equivalent field in the
+// status report are not included.
+func (n *NutClient) StatusRaw(ctx context.Context) ([]string, error) {
+	vars, err := n.Vars(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return nutStatusLines(n.address, n.ups, vars, time.Now()), nil
+}
+
+// EventsRaw always returns no events since NUT does not keep a log of them.
+func (n *NutClient) EventsRaw(ctx context.Context) ([]string, error) {
+	return []string{}, nil
+}
+
+func nutStatusLines(address string, ups string, vars map[string]string, now time.Time) []string {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+
+	date := now.Format("2006-01-02 15:04:05 -0700")
+	out := []string{
+		statusLine("DATE", date),
+		statusLine("HOSTNAME", host),
+		statusLine("UPSNAME", ups),
+	}
+
+	for _, f := range nutFields {
+		for _, name := range f.nut {
+			v, ok := vars[name]
+			if !ok {
+				continue
+			}
+
+			if converted, ok := f.convert(v); ok {
+				out = append(out, statusLine(f.apc, converted))
+			}
+
+			break
+		}
+	}
+
+	return append(out, statusLine(endRecord, date))
+}
+
+func nutText(v string) (string, bool) {
+	return v, v != ""
+}
+
+func nutNumber(v string) (string, bool) {
+	if _, err := strconv.ParseFloat(v, 64); err != nil {
+		return "", false
+	}
+
+	return v, true
+}
+
+func nutUnit(unit string) func(string) (string, bool) {
+	return func(v string) (string, bool) {
+		if _, err := strconv.ParseFloat(v, 64); err != nil {
+			return "", false
+		}
+
+		return v + " " + unit, true
+	}
+}
+
+// nutMinutes converts a NUT runtime in seconds to minutes as reported by apcupsd.
+func nutMinutes(v string) (string, bool) {
+	secs, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return "", false
+	}
+
+	return strconv.FormatFloat(secs/60, 'f', 1, 64) + " Minutes", true
+}
+
+// nutDate converts dates reported by NUT, which may use slashes (2021/01/31)
+// or dashes (2021-01-31), to the format used by apcupsd.
+func nutDate(v string) (string, bool) {
+	v = strings.ReplaceAll(v, "/", "-")
+	if _, err := time.Parse("2006-01-02", v); err != nil {
+		return "", false
+	}
+
+	return v, true
+}
+
+func nutStatus(v string) (string, bool) {
+	var states []string
+	for _, s := range strings.Fields(v) {
+		if m, ok := nutStates[s]; ok {
+			states = append(states, string(m.state))
+		}
+	}
+
+	if len(states) == 0 {
+		return "", false
+	}
+
+	return strings.Join(states, " "), true
+}
+
+func nutStatusFlags(v string) (string, bool) {
+	var flags StatusFlags
+	matched := false
+	for _, s := range strings.Fields(v) {
+		if m, ok := nutStates[s]; ok {
+			flags |= m.flag
+			matched = true
+		}
+	}
+
+	if !matched {
+		return "", false
+	}
+
+	return fmt.Sprintf("0x%08X", uint32(flags)), true
+}
@@ -0,0 +1,110 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNutStatusLines(t *testing.T) {
+	now := time.Date(2021, 11, 7, 12, 15, 21, 0, time.UTC)
+
+	tests := []struct {
+		name      string
+		vars      map[string]string
+		wantFlags *StatusFlags
+		wantState UpsState
+	}{
+		{
+			name: "online",
+			vars: map[string]string{
+				"ups.status":         "OL CHRG",
+				"battery.charge":     "82",
+				"battery.charge.low": "10",
+				"battery.runtime":    "4320",
+				"ups.load":           "6",
+				"driver.name":        "usbhid-ups",
+				"ups.beeper.status":  "enabled",
+			},
+			wantFlags: flagsPtr(FlagOnline),
+			wantState: StateOnline,
+		},
+		{
+			name: "on battery",
+			vars: map[string]string{
+				"ups.status":     "OB DISCHRG LB",
+				"battery.charge": "9",
+			},
+			wantFlags: flagsPtr(FlagOnBattery | FlagLowBattery),
+			wantState: StateOnBattery,
+		},
+		{
+			name: "unrecognized status",
+			vars: map[string]string{
+				"ups.status":     "CHRG BYPASS",
+				"battery.charge": "82",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			lines := nutStatusLines("nas.example:3493", "ups", tc.vars, now)
+
+			for _, line := range lines {
+				if strings.Contains(line, ".") && strings.Index(line, ".") < strings.Index(line, ":") {
+					t.Errorf("expected NUT variables without an apcupsd equivalent to be dropped, got %q", line)
+				}
+			}
+
+			status, err := ParseStatusFromLines(lines)
+			if err != nil {
+				t.Fatalf("unexpected error parsing status lines %q: %s", lines, err)
+			}
+
+			if tc.wantFlags == nil {
+				if status.Flags != nil {
+					t.Errorf("expected no status flags for unrecognized status, got %v", *status.Flags)
+				}
+
+				if _, ok := status.Fields["STATUS"]; ok {
+					t.Errorf("expected no STATUS for unrecognized status, got %q", status.Status)
+				}
+			} else {
+				if status.Flags == nil || *status.Flags != *tc.wantFlags {
+					t.Errorf("expected status flags %v, got %v", *tc.wantFlags, status.Flags)
+				}
+
+				if !status.States.Has(tc.wantState) {
+					t.Errorf("expected state %s, got %v", tc.wantState, status.States)
+				}
+			}
+
+			if status.ChargePercent == 0 {
+				t.Errorf("expected battery charge to be converted, got %v", status.Fields)
+			}
+		})
+	}
+}
+
+func flagsPtr(f StatusFlags) *StatusFlags {
+	return &f
+}
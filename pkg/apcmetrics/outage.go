@@ -0,0 +1,194 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+// Reasons the UPS switched to batteries for an outage.
+const (
+	OutageReasonPowerFailure = "power_failure"
+	OutageReasonSelfTest     = "self_test"
+	OutageReasonUnknown      = "unknown"
+)
+
+// transferWindow is how far apart the start of an outage from events and the
+// last transfer to batteries from status can be and still be the same outage.
+const transferWindow = time.Minute
+
+// Outage is a period of time that the UPS was running on batteries. End
+// is zero if the UPS is still running on batteries.
+type Outage struct {
+	Start    time.Time     `json:"start"`
+	End      time.Time     `json:"end"`
+	Duration time.Duration `json:"duration"`
+	Reason   string        `json:"reason"`
+	// Cause is the reason for the transfer to batteries reported by the UPS,
+	// only known for the most recent outage, e.g. "Low line voltage".
+	Cause string `json:"cause,omitempty"`
+}
+
+// Ongoing returns true if the UPS is still running on batteries.
+func (o Outage) Ongoing() bool {
+	return o.End.IsZero()
+}
+
+// FindOutages pairs events for the UPS switching to and from batteries into outages,
+// oldest first. If status is not nil, the last transfer to and from batteries it
+// reports is used to complete the most recent outage or to add it if it's no longer
+// part of the events known to apcupsd. Outages that are ongoing have a duration up
+// until now.
+func FindOutages(events []ApcEvent, status *ApcStatus, now time.Time) []Outage {
+	sorted := append([]ApcEvent(nil), events...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].TimeStamp.Before(sorted[j].TimeStamp) })
+
+	var out []Outage
+	var cur *Outage
+
+	for _, e := range sorted {
+		switch e.Kind {
+		case EventPowerFailure, EventOnBattery:
+			if cur == nil {
+				cur = &Outage{Start: e.TimeStamp, Reason: OutageReasonPowerFailure}
+			}
+		case EventSelfTestStart:
+			if cur == nil {
+				cur = &Outage{Start: e.TimeStamp, Reason: OutageReasonSelfTest}
+			}
+		case EventOffBattery, EventPowerBack, EventSelfTestComplete:
+			if cur != nil {
+				cur.End = e.TimeStamp
+				out = append(out, *cur)
+				cur = nil
+			}
+		}
+	}
+
+	if cur != nil {
+		out = append(out, *cur)
+	}
+
+	if status != nil {
+		out = mergeLastTransfer(out, status)
+	}
+
+	for i := range out {
+		if out[i].Ongoing() {
+			out[i].Duration = now.Sub(out[i].Start)
+		} else {
+			out[i].Duration = out[i].End.Sub(out[i].Start)
+		}
+	}
+
+	return out
+}
+
+// mergeLastTransfer uses the last transfer to and from batteries reported by the status
+// of the UPS to complete the most recent outage or add it if it's missing from events.
+func mergeLastTransfer(outages []Outage, status *ApcStatus) []Outage {
+	on := status.LastTimeOnBattery
+	off := status.LastTimeOffBattery
+	if on.IsZero() {
+		return outages
+	}
+
+	reason := OutageReasonPowerFailure
+	if strings.Contains(strings.ToLower(status.LastTransferReason), "self test") {
+		reason = OutageReasonSelfTest
+	}
+
+	// the end of the transfer is only known if it's after the start, otherwise
+	// the UPS is still on batteries from the most recent transfer
+	var end time.Time
+	if !off.IsZero() && !off.Before(on) && !status.OnBattery() {
+		end = off
+	}
+
+	if n := len(outages); n > 0 {
+		last := &outages[n-1]
+		if on.After(last.Start.Add(-transferWindow)) && (last.Ongoing() || on.Before(last.End.Add(transferWindow))) {
+			if last.Ongoing() {
+				last.End = end
+			}
+
+			last.Cause = status.LastTransferReason
+			return outages
+		}
+
+		if on.Before(last.Start) {
+			// the last transfer is older than the most recent outage from events
+			return outages
+		}
+	}
+
+	return append(outages, Outage{
+		Start:  on,
+		End:    end,
+		Reason: reason,
+		Cause:  status.LastTransferReason,
+	})
+}
+
+// OutagesSince returns the outages that started within since of now, or all
+// outages if since is zero.
+func OutagesSince(outages []Outage, since time.Duration, now time.Time) []Outage {
+	out := make([]Outage, 0, len(outages))
+	for _, o := range outages {
+		if since == 0 || !o.Start.Before(now.Add(-since)) {
+			out = append(out, o)
+		}
+	}
+
+	return out
+}
+
+// OutageSummary is statistics about a number of outages.
+type OutageSummary struct {
+	Count    int           `json:"count"`
+	Total    time.Duration `json:"total"`
+	Mean     time.Duration `json:"mean"`
+	Shortest time.Duration `json:"shortest"`
+	Longest  time.Duration `json:"longest"`
+}
+
+// SummarizeOutages computes statistics about the duration of outages.
+func SummarizeOutages(outages []Outage) OutageSummary {
+	var s OutageSummary
+	for i, o := range outages {
+		s.Count++
+		s.Total += o.Duration
+
+		if i == 0 || o.Duration < s.Shortest {
+			s.Shortest = o.Duration
+		}
+
+		if o.Duration > s.Longest {
+			s.Longest = o.Duration
+		}
+	}
+
+	if s.Count > 0 {
+		s.Mean = s.Total / time.Duration(s.Count)
+	}
+
+	return s
+}
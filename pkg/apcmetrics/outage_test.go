@@ -0,0 +1,238 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+var outageTestNow = time.Date(2021, 11, 7, 12, 0, 0, 0, time.UTC)
+
+// outageTime returns a time relative to outageTestNow
+func outageTime(ago time.Duration) time.Time {
+	return outageTestNow.Add(-ago)
+}
+
+func outageEvent(ago time.Duration, message string) ApcEvent {
+	kind, detail := ClassifyEvent(message)
+	return ApcEvent{TimeStamp: outageTime(ago), Message: message, Kind: kind, Detail: detail}
+}
+
+func TestFindOutages(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []ApcEvent
+		status *ApcStatus
+		want   []Outage
+	}{
+		{
+			name: "no events",
+			want: nil,
+		},
+		{
+			name: "power failure",
+			events: []ApcEvent{
+				outageEvent(time.Hour, "Power failure."),
+				outageEvent(time.Hour-6*time.Second, "Running on UPS batteries."),
+				outageEvent(time.Hour-time.Minute, "Mains returned. No longer on UPS batteries."),
+				outageEvent(time.Hour-time.Minute, "Power is back. UPS running on mains."),
+			},
+			want: []Outage{
+				{Start: outageTime(time.Hour), End: outageTime(time.Hour - time.Minute), Duration: time.Minute, Reason: OutageReasonPowerFailure},
+			},
+		},
+		{
+			name: "events out of order",
+			events: []ApcEvent{
+				outageEvent(time.Hour-time.Minute, "Power is back. UPS running on mains."),
+				outageEvent(time.Hour, "Power failure."),
+			},
+			want: []Outage{
+				{Start: outageTime(time.Hour), End: outageTime(time.Hour - time.Minute), Duration: time.Minute, Reason: OutageReasonPowerFailure},
+			},
+		},
+		{
+			name: "missing mains returned",
+			events: []ApcEvent{
+				outageEvent(time.Hour, "Power failure."),
+				outageEvent(time.Hour-6*time.Second, "Running on UPS batteries."),
+				outageEvent(time.Hour-2*time.Minute, "Power is back. UPS running on mains."),
+			},
+			want: []Outage{
+				{Start: outageTime(time.Hour), End: outageTime(time.Hour - 2*time.Minute), Duration: 2 * time.Minute, Reason: OutageReasonPowerFailure},
+			},
+		},
+		{
+			name: "ongoing",
+			events: []ApcEvent{
+				outageEvent(10*time.Minute, "Power failure."),
+				outageEvent(10*time.Minute-6*time.Second, "Running on UPS batteries."),
+			},
+			want: []Outage{
+				{Start: outageTime(10 * time.Minute), Duration: 10 * time.Minute, Reason: OutageReasonPowerFailure},
+			},
+		},
+		{
+			name: "self test",
+			events: []ApcEvent{
+				outageEvent(2*time.Hour, "UPS Self Test switch to battery."),
+				outageEvent(2*time.Hour-8*time.Second, "UPS Self Test completed: Battery OK"),
+			},
+			want: []Outage{
+				{Start: outageTime(2 * time.Hour), End: outageTime(2*time.Hour - 8*time.Second), Duration: 8 * time.Second, Reason: OutageReasonSelfTest},
+			},
+		},
+		{
+			name: "return without start",
+			events: []ApcEvent{
+				outageEvent(time.Hour, "Mains returned. No longer on UPS batteries."),
+				outageEvent(time.Hour, "Power is back. UPS running on mains."),
+			},
+			want: nil,
+		},
+		{
+			name: "multiple outages",
+			events: []ApcEvent{
+				outageEvent(3*time.Hour, "Power failure."),
+				outageEvent(3*time.Hour-time.Minute, "Power is back. UPS running on mains."),
+				outageEvent(2*time.Hour, "UPS Self Test switch to battery."),
+				outageEvent(2*time.Hour-10*time.Second, "UPS Self Test completed: Battery OK"),
+				outageEvent(time.Hour, "Power failure."),
+				outageEvent(time.Hour-5*time.Minute, "Power is back. UPS running on mains."),
+			},
+			want: []Outage{
+				{Start: outageTime(3 * time.Hour), End: outageTime(3*time.Hour - time.Minute), Duration: time.Minute, Reason: OutageReasonPowerFailure},
+				{Start: outageTime(2 * time.Hour), End: outageTime(2*time.Hour - 10*time.Second), Duration: 10 * time.Second, Reason: OutageReasonSelfTest},
+				{Start: outageTime(time.Hour), End: outageTime(time.Hour - 5*time.Minute), Duration: 5 * time.Minute, Reason: OutageReasonPowerFailure},
+			},
+		},
+		{
+			name: "status completes ongoing outage",
+			events: []ApcEvent{
+				outageEvent(time.Hour, "Power failure."),
+			},
+			status: &ApcStatus{
+				LastTimeOnBattery:  outageTime(time.Hour - time.Second),
+				LastTimeOffBattery: outageTime(time.Hour - 3*time.Minute),
+				LastTransferReason: "Low line voltage",
+				States:             UpsStates{StateOnline},
+			},
+			want: []Outage{
+				{Start: outageTime(time.Hour), End: outageTime(time.Hour - 3*time.Minute), Duration: 3 * time.Minute, Reason: OutageReasonPowerFailure, Cause: "Low line voltage"},
+			},
+		},
+		{
+			name: "status adds outage missing from events",
+			status: &ApcStatus{
+				LastTimeOnBattery:  outageTime(time.Hour),
+				LastTimeOffBattery: outageTime(time.Hour - 10*time.Second),
+				LastTransferReason: "Automatic or explicit self test",
+				States:             UpsStates{StateOnline},
+			},
+			want: []Outage{
+				{Start: outageTime(time.Hour), End: outageTime(time.Hour - 10*time.Second), Duration: 10 * time.Second, Reason: OutageReasonSelfTest, Cause: "Automatic or explicit self test"},
+			},
+		},
+		{
+			name: "status on batteries since last transfer",
+			status: &ApcStatus{
+				LastTimeOnBattery:  outageTime(5 * time.Minute),
+				LastTimeOffBattery: outageTime(time.Hour),
+				LastTransferReason: "Low line voltage",
+				States:             UpsStates{StateOnBattery},
+			},
+			want: []Outage{
+				{Start: outageTime(5 * time.Minute), Duration: 5 * time.Minute, Reason: OutageReasonPowerFailure, Cause: "Low line voltage"},
+			},
+		},
+		{
+			name: "status older than events",
+			events: []ApcEvent{
+				outageEvent(time.Hour, "Power failure."),
+				outageEvent(time.Hour-time.Minute, "Power is back. UPS running on mains."),
+			},
+			status: &ApcStatus{
+				LastTimeOnBattery:  outageTime(5 * time.Hour),
+				LastTimeOffBattery: outageTime(5*time.Hour - time.Minute),
+				LastTransferReason: "Low line voltage",
+				States:             UpsStates{StateOnline},
+			},
+			want: []Outage{
+				{Start: outageTime(time.Hour), End: outageTime(time.Hour - time.Minute), Duration: time.Minute, Reason: OutageReasonPowerFailure},
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := FindOutages(tc.events, tc.status, outageTestNow)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected outages\n%+v\ngot\n%+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestOutagesSince(t *testing.T) {
+	outages := []Outage{
+		{Start: outageTime(48 * time.Hour), End: outageTime(48*time.Hour - time.Minute), Duration: time.Minute},
+		{Start: outageTime(2 * time.Hour), End: outageTime(2*time.Hour - time.Minute), Duration: time.Minute},
+		{Start: outageTime(time.Minute), Duration: time.Minute},
+	}
+
+	tests := []struct {
+		name  string
+		since time.Duration
+		want  []Outage
+	}{
+		{name: "all", since: 0, want: outages},
+		{name: "last day", since: 24 * time.Hour, want: outages[1:]},
+		{name: "exactly at start", since: 2 * time.Hour, want: outages[1:]},
+		{name: "last hour", since: time.Hour, want: outages[2:]},
+		{name: "none", since: time.Second, want: []Outage{}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got := OutagesSince(outages, tc.since, outageTestNow)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected outages\n%+v\ngot\n%+v", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestSummarizeOutages(t *testing.T) {
+	summary := SummarizeOutages([]Outage{
+		{Duration: time.Minute},
+		{Duration: 3 * time.Minute},
+		{Duration: 2 * time.Minute},
+	})
+
+	want := OutageSummary{Count: 3, Total: 6 * time.Minute, Mean: 2 * time.Minute, Shortest: time.Minute, Longest: 3 * time.Minute}
+	if summary != want {
+		t.Errorf("expected summary %+v, got %+v", want, summary)
+	}
+
+	if empty := SummarizeOutages(nil); empty != (OutageSummary{}) {
+		t.Errorf("expected empty summary for no outages, got %+v", empty)
+	}
+}
@@ -28,19 +28,48 @@ import (
 
 const missingTime = "N/A"
 
+// knownStatusFields are all fields of the apcupsd status report that are
+// parsed into a specific field of ApcStatus.
+var knownStatusFields = map[string]bool{
+	"HOSTNAME": true, "VERSION": true, "UPSNAME": true, "MODEL": true, "DRIVER": true,
+	"UPSMODE": true, "CABLE": true, "APCMODEL": true, "SERIALNO": true, "FIRMWARE": true,
+	"STATUS": true, "STATFLAG": true, "TIMELEFT": true, "LOADPCT": true, "BCHARGE": true,
+	"LINEV": true, "LOTRANS": true, "HITRANS": true, "BATTV": true, "NOMBATTV": true, "NOMINV": true,
+	"NOMPOWER": true, "BATTDATE": true, "XONBATT": true, "XOFFBATT": true, "LASTSTEST": true,
+	"DATE": true, "STARTTIME": true, "MANDATE": true, "SENSE": true, "ALARMDEL": true,
+	"LASTXFER": true, "SELFTEST": true, "STESTI": true, "OUTPUTV": true, "MAXLINEV": true,
+	"MINLINEV": true, "NOMOUTV": true, "OUTCURNT": true, "NOMAPNT": true, "LINEFREQ": true,
+	"ITEMP": true, "AMBTEMP": true, "HUMIDITY": true, "MBATTCHG": true, "RETPCT": true,
+	"MINTIMEL": true, "MAXTIME": true, "TONBATT": true, "CUMONBATT": true, "DLOWBATT": true,
+	"DSHUTD": true, "DWAKE": true, "NUMXFERS": true, "EXTBATTS": true, "BADBATTS": true,
+}
+
 type Percent float64
 type Voltage float64
 type Wattage float64
-
+type Amperage float64
+type VoltAmps float64
+type Frequency float64
+type Temperature float64
+
+// ApcStatus is the parsed status report of a UPS. Fields that are reported by all UPSes
+// are always set. Fields that are only reported by some models are pointers or strings
+// that are nil or empty if the UPS did not report them.
 type ApcStatus struct {
-	Hostname string `json:"hostname"`
-	Version  string `json:"version"`
-	UpsName  string `json:"ups_name"`
-	Model    string `json:"model"`
-	Driver   string `json:"driver"`
-	UpsMode  string `json:"ups_mode"`
+	Hostname     string `json:"hostname"`
+	Version      string `json:"version"`
+	UpsName      string `json:"ups_name"`
+	Model        string `json:"model"`
+	Driver       string `json:"driver"`
+	UpsMode      string `json:"ups_mode"`
+	Cable        string `json:"cable,omitempty"`
+	ApcModel     string `json:"apc_model,omitempty"`
+	SerialNumber string `json:"serial_number,omitempty"`
+	Firmware     string `json:"firmware,omitempty"`
 
 	Status                string        `json:"status"`
+	States                UpsStates     `json:"states"`
+	Flags                 *StatusFlags  `json:"flags,omitempty"`
 	TimeLeft              time.Duration `json:"time_left"`
 	LoadPercent           Percent       `json:"load_percent"`
 	ChargePercent         Percent       `json:"charge_percent"`
@@ -56,11 +85,80 @@ type ApcStatus struct {
 	LastTimeOnBattery  time.Time `json:"last_time_on_battery"`
 	LastTimeOffBattery time.Time `json:"last_time_off_battery"`
 	LastSelfTest       time.Time `json:"last_self_test"`
+
+	Date            time.Time `json:"date"`
+	StartTime       time.Time `json:"start_time"`
+	ManufactureDate time.Time `json:"manufacture_date"`
+
+	Sense              string `json:"sense,omitempty"`
+	AlarmDelay         string `json:"alarm_delay,omitempty"`
+	LastTransferReason string `json:"last_transfer_reason,omitempty"`
+	SelfTestResult     string `json:"self_test_result,omitempty"`
+	SelfTestInterval   string `json:"self_test_interval,omitempty"`
+
+	OutputVoltage           *Voltage       `json:"output_voltage,omitempty"`
+	MaxLineVoltage          *Voltage       `json:"max_line_voltage,omitempty"`
+	MinLineVoltage          *Voltage       `json:"min_line_voltage,omitempty"`
+	NominalOutputVoltage    *Voltage       `json:"nominal_output_voltage,omitempty"`
+	OutputCurrent           *Amperage      `json:"output_current,omitempty"`
+	NominalApparentPower    *VoltAmps      `json:"nominal_apparent_power,omitempty"`
+	LineFrequency           *Frequency     `json:"line_frequency,omitempty"`
+	InternalTemperature     *Temperature   `json:"internal_temperature,omitempty"`
+	AmbientTemperature      *Temperature   `json:"ambient_temperature,omitempty"`
+	HumidityPercent         *Percent       `json:"humidity_percent,omitempty"`
+	MinChargePercent        *Percent       `json:"min_charge_percent,omitempty"`
+	ReturnChargePercent     *Percent       `json:"return_charge_percent,omitempty"`
+	MinTimeLeft             *time.Duration `json:"min_time_left,omitempty"`
+	MaxTimeOnBattery        *time.Duration `json:"max_time_on_battery,omitempty"`
+	TimeOnBattery           *time.Duration `json:"time_on_battery,omitempty"`
+	CumulativeTimeOnBattery *time.Duration `json:"cumulative_time_on_battery,omitempty"`
+	LowBatterySignal        *time.Duration `json:"low_battery_signal,omitempty"`
+	ShutdownDelay           *time.Duration `json:"shutdown_delay,omitempty"`
+	WakeDelay               *time.Duration `json:"wake_delay,omitempty"`
+	NumTransfers            *int           `json:"num_transfers,omitempty"`
+	ExternalBatteries       *int           `json:"external_batteries,omitempty"`
+	BadBatteries            *int           `json:"bad_batteries,omitempty"`
+
+	// Fields are all key-value pairs of the status report as reported by
+	// apcupsd, including those not parsed into any other field.
+	Fields map[string]string `json:"fields"`
 }
 
+// UnknownFields returns all key-value pairs of the status report that
+// are not parsed into a specific field of the status.
+func (s *ApcStatus) UnknownFields() map[string]string {
+	out := make(map[string]string)
+	for k, v := range s.Fields {
+		if !knownStatusFields[k] {
+			out[k] = v
+		}
+	}
+
+	return out
+}
+
+// ParseStatusFromLines parses the status report from apcupsd, returning an error
+// if any of the fields of the report could not be parsed.
 func ParseStatusFromLines(lines []string) (*ApcStatus, error) {
+	status, errs := parseStatus(lines)
+	if len(errs) != 0 {
+		return nil, errs[0]
+	}
+
+	return status, nil
+}
+
+// ParseStatusFromLinesLenient parses the status report from apcupsd, setting every
+// field of the status that can be parsed and returning a ParseError for each field
+// that could not be parsed. Fields that could not be parsed are left unset.
+func ParseStatusFromLinesLenient(lines []string) (*ApcStatus, []*ParseError) {
+	return parseStatus(lines)
+}
+
+func parseStatus(lines []string) (*ApcStatus, []*ParseError) {
 	kvs := parseLines(lines)
-	status := &ApcStatus{}
+	status := &ApcStatus{Fields: kvs}
+	var errs []*ParseError
 
 	if v, ok := kvs["HOSTNAME"]; ok {
 		status.Hostname = v
@@ -86,137 +184,420 @@ func ParseStatusFromLines(lines []string) (*ApcStatus, error) {
 		status.UpsMode = v
 	}
 
+	if v, ok := kvs["CABLE"]; ok {
+		status.Cable = v
+	}
+
+	if v, ok := kvs["APCMODEL"]; ok {
+		status.ApcModel = v
+	}
+
+	if v, ok := kvs["SERIALNO"]; ok {
+		status.SerialNumber = v
+	}
+
+	if v, ok := kvs["FIRMWARE"]; ok {
+		status.Firmware = v
+	}
+
 	if v, ok := kvs["STATUS"]; ok {
 		status.Status = v
+		status.States = ParseStates(v)
+	}
+
+	if v, ok := kvs["STATFLAG"]; ok {
+		parsed, err := parseStatusFlags(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "STATFLAG", Value: v, Err: err})
+		} else {
+			status.Flags = &parsed
+		}
 	}
 
 	if v, ok := kvs["TIMELEFT"]; ok {
 		parsed, err := parseDuration(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse TIMELEFT %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "TIMELEFT", Value: v, Err: err})
+		} else {
+			status.TimeLeft = parsed
 		}
-
-		status.TimeLeft = parsed
 	}
 
 	if v, ok := kvs["LOADPCT"]; ok {
 		parsed, err := parseFloatAndUnit(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse LOADPCT %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "LOADPCT", Value: v, Err: err})
+		} else {
+			status.LoadPercent = Percent(parsed)
 		}
-
-		status.LoadPercent = Percent(parsed)
 	}
 
 	if v, ok := kvs["BCHARGE"]; ok {
 		parsed, err := parseFloatAndUnit(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse BCHARGE %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "BCHARGE", Value: v, Err: err})
+		} else {
+			status.ChargePercent = Percent(parsed)
 		}
-
-		status.ChargePercent = Percent(parsed)
 	}
 
 	if v, ok := kvs["LINEV"]; ok {
 		parsed, err := parseFloatAndUnit(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse LINEV %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "LINEV", Value: v, Err: err})
+		} else {
+			status.LineVoltage = Voltage(parsed)
 		}
-
-		status.LineVoltage = Voltage(parsed)
 	}
 
 	if v, ok := kvs["LOTRANS"]; ok {
 		parsed, err := parseFloatAndUnit(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse LOTRANS %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "LOTRANS", Value: v, Err: err})
+		} else {
+			status.LowTransferVoltage = Voltage(parsed)
 		}
-
-		status.LowTransferVoltage = Voltage(parsed)
 	}
 
 	if v, ok := kvs["HITRANS"]; ok {
 		parsed, err := parseFloatAndUnit(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse HITRANS %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "HITRANS", Value: v, Err: err})
+		} else {
+			status.HighTransferVoltage = Voltage(parsed)
 		}
-
-		status.HighTransferVoltage = Voltage(parsed)
 	}
 
 	if v, ok := kvs["BATTV"]; ok {
 		parsed, err := parseFloatAndUnit(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse BATTV %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "BATTV", Value: v, Err: err})
+		} else {
+			status.BatteryVoltage = Voltage(parsed)
 		}
-
-		status.BatteryVoltage = Voltage(parsed)
 	}
 
 	if v, ok := kvs["NOMBATTV"]; ok {
 		parsed, err := parseFloatAndUnit(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse NOMBATTV %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "NOMBATTV", Value: v, Err: err})
+		} else {
+			status.NominalBatteryVoltage = Voltage(parsed)
 		}
-
-		status.NominalBatteryVoltage = Voltage(parsed)
 	}
 
 	if v, ok := kvs["NOMINV"]; ok {
 		parsed, err := parseFloatAndUnit(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse NOMINV %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "NOMINV", Value: v, Err: err})
+		} else {
+			status.NominalInputVoltage = Voltage(parsed)
 		}
-
-		status.NominalInputVoltage = Voltage(parsed)
 	}
 
 	if v, ok := kvs["NOMPOWER"]; ok {
 		parsed, err := parseFloatAndUnit(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse NOMPOWER %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "NOMPOWER", Value: v, Err: err})
+		} else {
+			status.NominalWattage = Wattage(parsed)
 		}
-
-		status.NominalWattage = Wattage(parsed)
 	}
 
 	if v, ok := kvs["BATTDATE"]; ok {
 		parsed, err := parseDate(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse BATTDATE %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "BATTDATE", Value: v, Err: err})
+		} else {
+			status.BatteryDate = parsed
 		}
-
-		status.BatteryDate = parsed
 	}
 
 	if v, ok := kvs["XONBATT"]; ok {
 		parsed, err := parseDateTime(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse XONBATT %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "XONBATT", Value: v, Err: err})
+		} else {
+			status.LastTimeOnBattery = parsed
 		}
-
-		status.LastTimeOnBattery = parsed
 	}
 
 	if v, ok := kvs["XOFFBATT"]; ok {
 		parsed, err := parseDateTime(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse XOFFBATT %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "XOFFBATT", Value: v, Err: err})
+		} else {
+			status.LastTimeOffBattery = parsed
 		}
-
-		status.LastTimeOffBattery = parsed
 	}
 
 	if v, ok := kvs["LASTSTEST"]; ok {
 		parsed, err := parseDateTime(v)
 		if err != nil {
-			return nil, fmt.Errorf("unable to parse LASTSTEST %s: %w", v, err)
+			errs = append(errs, &ParseError{Field: "LASTSTEST", Value: v, Err: err})
+		} else {
+			status.LastSelfTest = parsed
 		}
+	}
 
-		status.LastSelfTest = parsed
+	if v, ok := kvs["DATE"]; ok {
+		parsed, err := parseDateTime(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "DATE", Value: v, Err: err})
+		} else {
+			status.Date = parsed
+		}
 	}
 
-	return status, nil
+	if v, ok := kvs["STARTTIME"]; ok {
+		parsed, err := parseDateTime(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "STARTTIME", Value: v, Err: err})
+		} else {
+			status.StartTime = parsed
+		}
+	}
+
+	if v, ok := kvs["MANDATE"]; ok {
+		parsed, err := parseDate(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "MANDATE", Value: v, Err: err})
+		} else {
+			status.ManufactureDate = parsed
+		}
+	}
+
+	if v, ok := kvs["SENSE"]; ok {
+		status.Sense = v
+	}
+
+	if v, ok := kvs["ALARMDEL"]; ok {
+		status.AlarmDelay = v
+	}
+
+	if v, ok := kvs["LASTXFER"]; ok {
+		status.LastTransferReason = v
+	}
+
+	if v, ok := kvs["SELFTEST"]; ok {
+		status.SelfTestResult = v
+	}
+
+	if v, ok := kvs["STESTI"]; ok {
+		status.SelfTestInterval = v
+	}
+
+	if v, ok := kvs["OUTPUTV"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "OUTPUTV", Value: v, Err: err})
+		} else {
+			val := Voltage(parsed)
+			status.OutputVoltage = &val
+		}
+	}
+
+	if v, ok := kvs["MAXLINEV"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "MAXLINEV", Value: v, Err: err})
+		} else {
+			val := Voltage(parsed)
+			status.MaxLineVoltage = &val
+		}
+	}
+
+	if v, ok := kvs["MINLINEV"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "MINLINEV", Value: v, Err: err})
+		} else {
+			val := Voltage(parsed)
+			status.MinLineVoltage = &val
+		}
+	}
+
+	if v, ok := kvs["NOMOUTV"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "NOMOUTV", Value: v, Err: err})
+		} else {
+			val := Voltage(parsed)
+			status.NominalOutputVoltage = &val
+		}
+	}
+
+	if v, ok := kvs["OUTCURNT"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "OUTCURNT", Value: v, Err: err})
+		} else {
+			val := Amperage(parsed)
+			status.OutputCurrent = &val
+		}
+	}
+
+	if v, ok := kvs["NOMAPNT"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "NOMAPNT", Value: v, Err: err})
+		} else {
+			val := VoltAmps(parsed)
+			status.NominalApparentPower = &val
+		}
+	}
+
+	if v, ok := kvs["LINEFREQ"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "LINEFREQ", Value: v, Err: err})
+		} else {
+			val := Frequency(parsed)
+			status.LineFrequency = &val
+		}
+	}
+
+	if v, ok := kvs["ITEMP"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "ITEMP", Value: v, Err: err})
+		} else {
+			val := Temperature(parsed)
+			status.InternalTemperature = &val
+		}
+	}
+
+	if v, ok := kvs["AMBTEMP"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "AMBTEMP", Value: v, Err: err})
+		} else {
+			val := Temperature(parsed)
+			status.AmbientTemperature = &val
+		}
+	}
+
+	if v, ok := kvs["HUMIDITY"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "HUMIDITY", Value: v, Err: err})
+		} else {
+			val := Percent(parsed)
+			status.HumidityPercent = &val
+		}
+	}
+
+	if v, ok := kvs["MBATTCHG"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "MBATTCHG", Value: v, Err: err})
+		} else {
+			val := Percent(parsed)
+			status.MinChargePercent = &val
+		}
+	}
+
+	if v, ok := kvs["RETPCT"]; ok {
+		parsed, err := parseFloatAndUnit(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "RETPCT", Value: v, Err: err})
+		} else {
+			val := Percent(parsed)
+			status.ReturnChargePercent = &val
+		}
+	}
+
+	if v, ok := kvs["MINTIMEL"]; ok {
+		parsed, err := parseDuration(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "MINTIMEL", Value: v, Err: err})
+		} else {
+			status.MinTimeLeft = &parsed
+		}
+	}
+
+	if v, ok := kvs["MAXTIME"]; ok {
+		parsed, err := parseDuration(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "MAXTIME", Value: v, Err: err})
+		} else {
+			status.MaxTimeOnBattery = &parsed
+		}
+	}
+
+	if v, ok := kvs["TONBATT"]; ok {
+		parsed, err := parseDuration(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "TONBATT", Value: v, Err: err})
+		} else {
+			status.TimeOnBattery = &parsed
+		}
+	}
+
+	if v, ok := kvs["CUMONBATT"]; ok {
+		parsed, err := parseDuration(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "CUMONBATT", Value: v, Err: err})
+		} else {
+			status.CumulativeTimeOnBattery = &parsed
+		}
+	}
+
+	if v, ok := kvs["DLOWBATT"]; ok {
+		parsed, err := parseDuration(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "DLOWBATT", Value: v, Err: err})
+		} else {
+			status.LowBatterySignal = &parsed
+		}
+	}
+
+	if v, ok := kvs["DSHUTD"]; ok {
+		parsed, err := parseDuration(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "DSHUTD", Value: v, Err: err})
+		} else {
+			status.ShutdownDelay = &parsed
+		}
+	}
+
+	if v, ok := kvs["DWAKE"]; ok {
+		parsed, err := parseDuration(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "DWAKE", Value: v, Err: err})
+		} else {
+			status.WakeDelay = &parsed
+		}
+	}
+
+	if v, ok := kvs["NUMXFERS"]; ok {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "NUMXFERS", Value: v, Err: err})
+		} else {
+			status.NumTransfers = &parsed
+		}
+	}
+
+	if v, ok := kvs["EXTBATTS"]; ok {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "EXTBATTS", Value: v, Err: err})
+		} else {
+			status.ExternalBatteries = &parsed
+		}
+	}
+
+	if v, ok := kvs["BADBATTS"]; ok {
+		parsed, err := strconv.Atoi(v)
+		if err != nil {
+			errs = append(errs, &ParseError{Field: "BADBATTS", Value: v, Err: err})
+		} else {
+			status.BadBatteries = &parsed
+		}
+	}
+
+	return status, errs
 }
 
 func parseLines(lines []string) map[string]string {
@@ -236,10 +617,18 @@ func parseLines(lines []string) map[string]string {
 	return out
 }
 
+// statusLine formats a key and value the same way as each line of the apcupsd
+// status report, the opposite of parseLines.
+func statusLine(key string, val string) string {
+	return fmt.Sprintf("%-9s: %s", key, val)
+}
+
 func parseFloatAndUnit(raw string) (float64, error) {
-	parts := strings.Split(raw, " ")
-	if len(parts) != 2 {
-		return 0.0, errors.New("expected two parts")
+	// most values are a number and a unit but some have an additional
+	// description after the unit, e.g. ITEMP is "29.2 C Internal"
+	parts := strings.Fields(raw)
+	if len(parts) < 2 {
+		return 0.0, errors.New("expected at least two parts")
 	}
 
 	res, err := strconv.ParseFloat(parts[0], 64)
@@ -250,6 +639,33 @@ func parseFloatAndUnit(raw string) (float64, error) {
 	return res, nil
 }
 
+// parseStatusFlags parses the STATFLAG bitmask, ignoring the description after
+// it that some versions of apcupsd include, e.g. "0x05000008 Status Flag"
+func parseStatusFlags(raw string) (StatusFlags, error) {
+	parts := strings.Fields(raw)
+	if len(parts) == 0 {
+		return 0, errors.New("expected at least one part")
+	}
+
+	res, err := strconv.ParseUint(parts[0], 0, 32)
+	if err != nil {
+		return 0, err
+	}
+
+	return StatusFlags(res), nil
+}
+
+// parseNumber parses the numeric part of a value with an optional unit, e.g.
+// "8.0 Percent" or "2". Values that do not start with a number are rejected.
+func parseNumber(raw string) (float64, error) {
+	parts := strings.Fields(raw)
+	if len(parts) == 0 {
+		return 0.0, errors.New("expected at least one part")
+	}
+
+	return strconv.ParseFloat(parts[0], 64)
+}
+
 func parseDuration(raw string) (time.Duration, error) {
 	raw = strings.ToLower(raw)
 
@@ -297,31 +713,47 @@ func parseDateTime(raw string) (time.Time, error) {
 type ApcEvent struct {
 	TimeStamp time.Time `json:"timestamp"`
 	Message   string    `json:"message"`
+	Kind      EventKind `json:"kind"`
+	// Detail is extra information included in the message for some kinds of
+	// events, e.g. the result of a self test such as "Battery OK".
+	Detail string `json:"detail,omitempty"`
 }
 
 func ParseEventsFromLines(lines []string) ([]ApcEvent, error) {
 	out := make([]ApcEvent, 0, len(lines))
 
 	for _, line := range lines {
-		// timestamp is separated from message with two spaces
-		parts := strings.Split(line, "  ")
-		if len(parts) != 2 {
-			return nil, errors.New("expected two parts")
-		}
-
-		timestamp := strings.TrimSpace(parts[0])
-		message := strings.TrimSpace(parts[1])
-
-		ts, err := parseDateTime(timestamp)
+		e, err := parseEvent(line)
 		if err != nil {
 			return nil, err
 		}
 
-		out = append(out, ApcEvent{
-			TimeStamp: ts,
-			Message:   message,
-		})
+		out = append(out, e)
 	}
 
 	return out, nil
 }
+
+func parseEvent(line string) (ApcEvent, error) {
+	// timestamp is separated from message with two spaces
+	parts := strings.Split(line, "  ")
+	if len(parts) != 2 {
+		return ApcEvent{}, &ParseError{Field: "event", Value: line, Err: errors.New("expected two parts")}
+	}
+
+	timestamp := strings.TrimSpace(parts[0])
+	message := strings.TrimSpace(parts[1])
+
+	ts, err := parseDateTime(timestamp)
+	if err != nil {
+		return ApcEvent{}, &ParseError{Field: "event timestamp", Value: timestamp, Err: err}
+	}
+
+	kind, detail := ClassifyEvent(message)
+	return ApcEvent{
+		TimeStamp: ts,
+		Message:   message,
+		Kind:      kind,
+		Detail:    detail,
+	}, nil
+}
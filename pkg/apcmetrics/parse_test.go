@@ -0,0 +1,199 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStatusFromLines_StatusFlags(t *testing.T) {
+	tests := []struct {
+		name    string
+		value   string
+		want    StatusFlags
+		wantErr bool
+	}{
+		{name: "bitmask only", value: "0x05000008", want: 0x05000008},
+		{name: "bitmask with description", value: "0x07000008 Status Flag", want: 0x07000008},
+		{name: "empty", value: "", wantErr: true},
+		{name: "not a number", value: "Status Flag", wantErr: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status, err := ParseStatusFromLines([]string{
+				"STATUS   : ONLINE",
+				"STATFLAG : " + tc.value,
+			})
+
+			if tc.wantErr {
+				if err == nil {
+					t.Fatalf("expected error parsing STATFLAG %q, got flags %v", tc.value, status.Flags)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("unexpected error parsing STATFLAG %q: %s", tc.value, err)
+			}
+
+			if status.Flags == nil || *status.Flags != tc.want {
+				t.Fatalf("expected flags %v, got %v", tc.want, status.Flags)
+			}
+		})
+	}
+}
+
+func TestParseStatusFromLinesLenient(t *testing.T) {
+	tests := []struct {
+		name       string
+		lines      []string
+		wantFields []string
+		wantCharge Percent
+		wantLoad   Percent
+	}{
+		{
+			name: "all fields valid",
+			lines: []string{
+				"STATUS   : ONLINE",
+				"LOADPCT  : 6.0 Percent",
+				"BCHARGE  : 82.0 Percent",
+			},
+			wantCharge: 82,
+			wantLoad:   6,
+		},
+		{
+			name: "one invalid field",
+			lines: []string{
+				"STATUS   : ONLINE",
+				"LOADPCT  : 6.0 Percent",
+				"BCHARGE  : lots",
+			},
+			wantFields: []string{"BCHARGE"},
+			wantLoad:   6,
+		},
+		{
+			name: "multiple invalid fields",
+			lines: []string{
+				"STATUS   : ONLINE",
+				"STATFLAG : nope",
+				"TIMELEFT : soon",
+				"LOADPCT  : 6.0 Percent",
+				"BCHARGE  : lots",
+				"BATTDATE : yesterday",
+			},
+			wantFields: []string{"STATFLAG", "TIMELEFT", "BCHARGE", "BATTDATE"},
+			wantLoad:   6,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status, errs := ParseStatusFromLinesLenient(tc.lines)
+
+			var fields []string
+			for _, e := range errs {
+				if e.Value == "" || e.Err == nil {
+					t.Errorf("expected value and error for field %s, got %+v", e.Field, e)
+				}
+				fields = append(fields, e.Field)
+			}
+
+			if !reflect.DeepEqual(fields, tc.wantFields) {
+				t.Errorf("expected errors for fields %v, got %v", tc.wantFields, fields)
+			}
+
+			if status.ChargePercent != tc.wantCharge {
+				t.Errorf("expected charge %v, got %v", tc.wantCharge, status.ChargePercent)
+			}
+
+			if status.LoadPercent != tc.wantLoad {
+				t.Errorf("expected load %v, got %v", tc.wantLoad, status.LoadPercent)
+			}
+
+			if !status.States.Has(StateOnline) {
+				t.Errorf("expected online state to be parsed, got %v", status.States)
+			}
+
+			_, strictErr := ParseStatusFromLines(tc.lines)
+			if (strictErr != nil) != (len(tc.wantFields) > 0) {
+				t.Errorf("expected strict parsing error only when lenient parsing has errors, got %v", strictErr)
+			}
+		})
+	}
+}
+
+func TestParseStatusFromLines_Fields(t *testing.T) {
+	tests := []struct {
+		name        string
+		lines       []string
+		wantFields  map[string]string
+		wantUnknown map[string]string
+	}{
+		{
+			name: "known fields only",
+			lines: []string{
+				"STATUS   : ONLINE",
+				"BCHARGE  : 100.0 Percent",
+			},
+			wantFields:  map[string]string{"STATUS": "ONLINE", "BCHARGE": "100.0 Percent"},
+			wantUnknown: map[string]string{},
+		},
+		{
+			name: "unknown fields",
+			lines: []string{
+				"STATUS   : ONLINE",
+				"AMBTEMP  : 24.5 C",
+				"REG1     : 0x00 Register 1",
+				"OUTPUTFREQ : 60.0 Hz",
+			},
+			wantFields:  map[string]string{"STATUS": "ONLINE", "AMBTEMP": "24.5 C", "REG1": "0x00 Register 1", "OUTPUTFREQ": "60.0 Hz"},
+			wantUnknown: map[string]string{"REG1": "0x00 Register 1", "OUTPUTFREQ": "60.0 Hz"},
+		},
+		{
+			name: "header and trailer",
+			lines: []string{
+				"APC      : 001,036,0857",
+				"STATUS   : ONLINE",
+				"SELFTEST : NO",
+				"END APC  : 2021-11-07 21:19:44 -0500",
+			},
+			wantFields:  map[string]string{"APC": "001,036,0857", "STATUS": "ONLINE", "SELFTEST": "NO", "END APC": "2021-11-07 21:19:44 -0500"},
+			wantUnknown: map[string]string{"APC": "001,036,0857", "END APC": "2021-11-07 21:19:44 -0500"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			status, err := ParseStatusFromLines(tc.lines)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+
+			if !reflect.DeepEqual(tc.wantFields, status.Fields) {
+				t.Errorf("expected fields %v, got %v", tc.wantFields, status.Fields)
+			}
+
+			if unknown := status.UnknownFields(); !reflect.DeepEqual(tc.wantUnknown, unknown) {
+				t.Errorf("expected unknown fields %v, got %v", tc.wantUnknown, unknown)
+			}
+		})
+	}
+}
@@ -0,0 +1,289 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	// maxOutageSnapshots is the number of completed outages kept in memory
+	maxOutageSnapshots = 16
+	// maxOutageSamples is the number of samples kept for each outage, about
+	// 2.75 hours worth of samples when polling every second.
+	maxOutageSamples = 10000
+	// defaultMaxAgeIntervals is the number of intervals, in addition to the timeout,
+	// that status may be served for when no max age is set
+	defaultMaxAgeIntervals = 3
+)
+
+// ErrNoStatus is returned by the poller when there is no status available,
+// either because it hasn't been fetched yet or it's older than the max age.
+var ErrNoStatus = errors.New("no status available")
+
+// StatusSnapshot is the status report of the UPS as of a particular time.
+type StatusSnapshot struct {
+	Time  time.Time
+	Lines []string
+}
+
+// Age returns how long ago the snapshot was taken.
+func (s *StatusSnapshot) Age() time.Duration {
+	return time.Since(s.Time)
+}
+
+// BatterySample is the state of the UPS at a particular time while on batteries.
+type BatterySample struct {
+	Time           time.Time     `json:"time"`
+	ChargePercent  Percent       `json:"charge_percent"`
+	TimeLeft       time.Duration `json:"time_left"`
+	LoadPercent    Percent       `json:"load_percent"`
+	BatteryVoltage Voltage       `json:"battery_voltage"`
+	LineVoltage    Voltage       `json:"line_voltage"`
+}
+
+// OutageSnapshot is every sample of the state of the UPS taken while it was on
+// batteries during a single outage. End is zero if the outage is ongoing.
+type OutageSnapshot struct {
+	Start   time.Time       `json:"start"`
+	End     time.Time       `json:"end"`
+	Samples []BatterySample `json:"samples"`
+}
+
+// PollerOptions control how often the poller fetches status from apcupsd.
+type PollerOptions struct {
+	// Interval is how often to fetch status while the UPS is online.
+	Interval time.Duration
+	// BatteryInterval is how often to fetch status while the UPS is on
+	// batteries. If zero, Interval is used.
+	BatteryInterval time.Duration
+	// Timeout is the max time each request to apcupsd may take.
+	Timeout time.Duration
+	// MaxAge is the max age of status returned by Latest. If zero, three times
+	// Interval plus Timeout is used so that status stops being returned after a
+	// few failed attempts to fetch it.
+	MaxAge time.Duration
+}
+
+// ApcPoller fetches the status of the UPS from apcupsd in the background at a
+// fixed interval and keeps the most recent status that was successfully fetched
+// in memory so that it can be used without contacting apcupsd. While the UPS is
+// on batteries, status is fetched more frequently and each sample is recorded.
+type ApcPoller struct {
+	source Source
+	opts   PollerOptions
+	logger log.Logger
+
+	mtx       sync.RWMutex
+	snapshot  *StatusSnapshot
+	lastErr   error
+	onBattery bool
+	current   *OutageSnapshot
+	outages   []OutageSnapshot
+
+	samples       prometheus.Counter
+	chargePercent prometheus.Histogram
+	timeLeft      prometheus.Histogram
+	loadPercent   prometheus.Histogram
+}
+
+func NewApcPoller(source Source, opts PollerOptions, logger log.Logger) *ApcPoller {
+	if opts.MaxAge == 0 {
+		opts.MaxAge = defaultMaxAgeIntervals*opts.Interval + opts.Timeout
+	}
+
+	return &ApcPoller{
+		source: source,
+		opts:   opts,
+		logger: logger,
+
+		samples: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "apc_battery_samples_total",
+			Help: "Number of samples of UPS status taken while on batteries",
+		}),
+		chargePercent: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "apc_battery_sample_charge_percent",
+			Help:    "Percentage of charge of the batteries sampled while on batteries",
+			Buckets: prometheus.LinearBuckets(10, 10, 10),
+		}),
+		timeLeft: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "apc_battery_sample_time_left_seconds",
+			Help:    "Remaining runtime left on the batteries in seconds sampled while on batteries",
+			Buckets: prometheus.ExponentialBuckets(60, 2, 8),
+		}),
+		loadPercent: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "apc_battery_sample_load_percent",
+			Help:    "Percentage of load capacity sampled while on batteries",
+			Buckets: prometheus.LinearBuckets(10, 10, 10),
+		}),
+	}
+}
+
+// Run fetches status immediately and then every interval until the context is
+// canceled. Status is fetched every battery interval while the UPS is on batteries.
+func (p *ApcPoller) Run(ctx context.Context) {
+	for {
+		p.Poll(ctx)
+
+		timer := time.NewTimer(p.nextInterval())
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		}
+	}
+}
+
+func (p *ApcPoller) nextInterval() time.Duration {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if p.onBattery && p.opts.BatteryInterval > 0 {
+		return p.opts.BatteryInterval
+	}
+
+	return p.opts.Interval
+}
+
+// Poll fetches status from apcupsd a single time, replacing the latest
+// snapshot if it was successful.
+func (p *ApcPoller) Poll(ctx context.Context) {
+	ctx, cancel := context.WithTimeout(ctx, p.opts.Timeout)
+	defer cancel()
+
+	lines, err := p.source.StatusRaw(ctx)
+	now := time.Now()
+
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+
+	p.lastErr = err
+	if err != nil {
+		level.Warn(p.logger).Log("msg", "unable to poll UPS status", "err", err)
+		return
+	}
+
+	p.snapshot = &StatusSnapshot{Time: now, Lines: lines}
+
+	// use lenient parsing since we only care about a few fields for
+	// determining if the UPS is on batteries and recording samples
+	status, parseErrs := ParseStatusFromLinesLenient(lines)
+	failed := make(map[string]bool, len(parseErrs))
+	for _, e := range parseErrs {
+		failed[e.Field] = true
+	}
+
+	p.record(now, status, failed)
+}
+
+// record tracks the start and end of outages and samples the state of the
+// UPS while it's on batteries. Fields that weren't reported by the UPS or that
+// couldn't be parsed aren't observed by the histograms. Must be called with the
+// lock held.
+func (p *ApcPoller) record(now time.Time, status *ApcStatus, failed map[string]bool) {
+	onBattery := status.OnBattery()
+	if onBattery != p.onBattery {
+		level.Info(p.logger).Log("msg", "UPS battery state changed", "on_battery", onBattery)
+	}
+
+	p.onBattery = onBattery
+	if !onBattery {
+		if p.current != nil {
+			p.current.End = now
+			p.outages = append(p.outages, *p.current)
+			if len(p.outages) > maxOutageSnapshots {
+				p.outages = p.outages[len(p.outages)-maxOutageSnapshots:]
+			}
+
+			p.current = nil
+		}
+
+		return
+	}
+
+	if p.current == nil {
+		p.current = &OutageSnapshot{Start: now}
+	}
+
+	if len(p.current.Samples) < maxOutageSamples {
+		p.current.Samples = append(p.current.Samples, BatterySample{
+			Time:           now,
+			ChargePercent:  status.ChargePercent,
+			TimeLeft:       status.TimeLeft,
+			LoadPercent:    status.LoadPercent,
+			BatteryVoltage: status.BatteryVoltage,
+			LineVoltage:    status.LineVoltage,
+		})
+	}
+
+	// observe a field if it was reported by the UPS and could be parsed
+	observe := func(h prometheus.Histogram, field string, val float64) {
+		if _, ok := status.Fields[field]; ok && !failed[field] {
+			h.Observe(val)
+		}
+	}
+
+	p.samples.Inc()
+	observe(p.chargePercent, "BCHARGE", float64(status.ChargePercent))
+	observe(p.timeLeft, "TIMELEFT", status.TimeLeft.Seconds())
+	observe(p.loadPercent, "LOADPCT", float64(status.LoadPercent))
+}
+
+// Latest returns the most recent snapshot of UPS status. If there is no snapshot or the
+// snapshot is older than the max age of the poller, the error from the most recent attempt
+// to fetch status is returned, or ErrNoStatus if the most recent attempt was successful.
+func (p *ApcPoller) Latest() (*StatusSnapshot, error) {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	if p.snapshot == nil || (p.opts.MaxAge > 0 && p.snapshot.Age() > p.opts.MaxAge) {
+		if p.lastErr != nil {
+			return nil, p.lastErr
+		}
+
+		return nil, ErrNoStatus
+	}
+
+	return p.snapshot, nil
+}
+
+// Outages returns samples taken during recent outages, oldest first, including
+// the current outage if the UPS is on batteries.
+func (p *ApcPoller) Outages() []OutageSnapshot {
+	p.mtx.RLock()
+	defer p.mtx.RUnlock()
+
+	out := make([]OutageSnapshot, 0, len(p.outages)+1)
+	out = append(out, p.outages...)
+	if p.current != nil {
+		current := *p.current
+		current.Samples = append([]BatterySample(nil), p.current.Samples...)
+		out = append(out, current)
+	}
+
+	return out
+}
@@ -0,0 +1,272 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestApcPoller_Latest_DefaultMaxAge(t *testing.T) {
+	source := &staticSource{status: []string{
+		"STATUS   : ONLINE",
+		"BCHARGE  : 82.0 Percent",
+	}}
+
+	poller := NewApcPoller(source, PollerOptions{
+		Interval: 10 * time.Millisecond,
+		Timeout:  10 * time.Millisecond,
+	}, log.NewNopLogger())
+
+	if _, err := poller.Latest(); !errors.Is(err, ErrNoStatus) {
+		t.Fatalf("expected ErrNoStatus before polling, got %v", err)
+	}
+
+	poller.Poll(context.Background())
+	if _, err := poller.Latest(); err != nil {
+		t.Fatalf("expected status after polling, got %s", err)
+	}
+
+	// no polls are made after the first, so the status is older than three
+	// intervals plus the timeout and should no longer be served
+	time.Sleep(60 * time.Millisecond)
+
+	_, err := poller.Latest()
+	if !errors.Is(err, ErrNoStatus) {
+		t.Fatalf("expected ErrNoStatus for stale status, got %v", err)
+	}
+
+	if class := errorClass(err); class != failureStale {
+		t.Fatalf("expected failure class %s, got %s", failureStale, class)
+	}
+}
+
+// sampleCount returns the number of observations made by a histogram.
+func sampleCount(t *testing.T, h prometheus.Histogram) uint64 {
+	t.Helper()
+
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(h)
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("unable to gather histogram: %s", err)
+	}
+
+	if len(families) != 1 || len(families[0].GetMetric()) != 1 {
+		t.Fatalf("expected a single histogram, got %v", families)
+	}
+
+	return families[0].GetMetric()[0].GetHistogram().GetSampleCount()
+}
+
+func TestApcPoller_NextInterval(t *testing.T) {
+	online := []string{"STATUS   : ONLINE", "BCHARGE  : 100.0 Percent"}
+	onBattery := []string{"STATUS   : ONBATT", "BCHARGE  : 90.0 Percent"}
+
+	tests := []struct {
+		name            string
+		batteryInterval time.Duration
+		statuses        [][]string
+		want            time.Duration
+	}{
+		{name: "not polled", batteryInterval: time.Second, want: time.Minute},
+		{name: "online", batteryInterval: time.Second, statuses: [][]string{online}, want: time.Minute},
+		{name: "on batteries", batteryInterval: time.Second, statuses: [][]string{online, onBattery}, want: time.Second},
+		{name: "power back", batteryInterval: time.Second, statuses: [][]string{onBattery, online}, want: time.Minute},
+		{name: "no battery interval", statuses: [][]string{onBattery}, want: time.Minute},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			source := &staticSource{}
+			poller := NewApcPoller(source, PollerOptions{
+				Interval:        time.Minute,
+				BatteryInterval: tc.batteryInterval,
+				Timeout:         time.Second,
+			}, log.NewNopLogger())
+
+			for _, status := range tc.statuses {
+				source.setStatus(status)
+				poller.Poll(context.Background())
+			}
+
+			if got := poller.nextInterval(); got != tc.want {
+				t.Errorf("expected interval %s, got %s", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestApcPoller_Outages(t *testing.T) {
+	online := []string{"STATUS   : ONLINE", "BCHARGE  : 100.0 Percent"}
+	onBattery := func(charge string) []string {
+		return []string{
+			"STATUS   : ONBATT",
+			"BCHARGE  : " + charge + " Percent",
+			"TIMELEFT : 30.0 Minutes",
+			"LOADPCT  : 20.0 Percent",
+		}
+	}
+
+	source := &staticSource{}
+	poller := NewApcPoller(source, PollerOptions{
+		Interval:        time.Minute,
+		BatteryInterval: time.Second,
+		Timeout:         time.Second,
+	}, log.NewNopLogger())
+
+	for _, status := range [][]string{
+		online,
+		onBattery("90.0"),
+		onBattery("80.0"),
+		online,
+		online,
+		onBattery("70.0"),
+	} {
+		source.setStatus(status)
+		poller.Poll(context.Background())
+	}
+
+	outages := poller.Outages()
+	if len(outages) != 2 {
+		t.Fatalf("expected 2 outages, got %d: %+v", len(outages), outages)
+	}
+
+	tests := []struct {
+		name        string
+		outage      OutageSnapshot
+		wantEnded   bool
+		wantCharges []Percent
+	}{
+		{name: "completed", outage: outages[0], wantEnded: true, wantCharges: []Percent{90, 80}},
+		{name: "ongoing", outage: outages[1], wantEnded: false, wantCharges: []Percent{70}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if ended := !tc.outage.End.IsZero(); ended != tc.wantEnded {
+				t.Errorf("expected ended %t, got %t", tc.wantEnded, ended)
+			}
+
+			if tc.wantEnded && tc.outage.End.Before(tc.outage.Start) {
+				t.Errorf("expected end %s to be after start %s", tc.outage.End, tc.outage.Start)
+			}
+
+			if len(tc.outage.Samples) != len(tc.wantCharges) {
+				t.Fatalf("expected %d samples, got %d", len(tc.wantCharges), len(tc.outage.Samples))
+			}
+
+			for i, sample := range tc.outage.Samples {
+				if sample.ChargePercent != tc.wantCharges[i] {
+					t.Errorf("expected sample %d charge %v, got %v", i, tc.wantCharges[i], sample.ChargePercent)
+				}
+
+				if sample.TimeLeft != 30*time.Minute {
+					t.Errorf("expected sample %d time left 30m, got %s", i, sample.TimeLeft)
+				}
+			}
+		})
+	}
+
+	// snapshots are copies and can't be modified by later polls
+	outages[1].Samples[0].ChargePercent = 0
+	if got := poller.Outages()[1].Samples[0].ChargePercent; got != 70 {
+		t.Errorf("expected ongoing outage to be unchanged, got charge %v", got)
+	}
+}
+
+func TestApcPoller_SampleHistograms(t *testing.T) {
+	tests := []struct {
+		name       string
+		status     []string
+		wantCharge uint64
+		wantTime   uint64
+		wantLoad   uint64
+	}{
+		{
+			name: "all fields",
+			status: []string{
+				"STATUS   : ONBATT",
+				"BCHARGE  : 90.0 Percent",
+				"TIMELEFT : 30.0 Minutes",
+				"LOADPCT  : 20.0 Percent",
+			},
+			wantCharge: 1,
+			wantTime:   1,
+			wantLoad:   1,
+		},
+		{
+			name: "no runtime reported",
+			status: []string{
+				"STATUS   : ONBATT",
+				"BCHARGE  : 90.0 Percent",
+				"LOADPCT  : 20.0 Percent",
+			},
+			wantCharge: 1,
+			wantLoad:   1,
+		},
+		{
+			name: "unparsable charge",
+			status: []string{
+				"STATUS   : ONBATT",
+				"BCHARGE  : lots Percent",
+				"TIMELEFT : 30.0 Minutes",
+			},
+			wantTime: 1,
+		},
+		{
+			name: "online",
+			status: []string{
+				"STATUS   : ONLINE",
+				"BCHARGE  : 100.0 Percent",
+				"TIMELEFT : 60.0 Minutes",
+				"LOADPCT  : 20.0 Percent",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			poller := NewApcPoller(&staticSource{status: tc.status}, PollerOptions{
+				Interval: time.Minute,
+				Timeout:  time.Second,
+			}, log.NewNopLogger())
+
+			poller.Poll(context.Background())
+
+			if got := sampleCount(t, poller.chargePercent); got != tc.wantCharge {
+				t.Errorf("expected %d charge observations, got %d", tc.wantCharge, got)
+			}
+
+			if got := sampleCount(t, poller.timeLeft); got != tc.wantTime {
+				t.Errorf("expected %d time left observations, got %d", tc.wantTime, got)
+			}
+
+			if got := sampleCount(t, poller.loadPercent); got != tc.wantLoad {
+				t.Errorf("expected %d load observations, got %d", tc.wantLoad, got)
+			}
+		})
+	}
+}
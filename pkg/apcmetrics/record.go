@@ -0,0 +1,230 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// RecordedResponse is a single raw response to the status or events command
+// saved by a Recorder, one per line of a recording as JSON.
+type RecordedResponse struct {
+	Time    time.Time `json:"time"`
+	Command string    `json:"command"`
+	Lines   []string  `json:"lines"`
+	// Error is why the response was rejected by the source, e.g. because it was
+	// truncated, in which case Lines are the lines read before it was rejected.
+	Error string `json:"error,omitempty"`
+}
+
+// Recorder is a Source that saves every raw status and events response of
+// another Source so that it can be reproduced later by a ReplaySource, e.g.
+// to capture a response from a UPS that cannot be parsed. Responses are saved
+// before being parsed so that responses that fail to parse are included.
+// Responses rejected by the source as truncated or malformed (a ProtocolError)
+// are saved along with the error and any lines read before it. Requests that
+// fail without a response, e.g. connection errors or timeouts, are not saved.
+type Recorder struct {
+	source Source
+
+	mtx sync.Mutex
+	enc *json.Encoder
+}
+
+func NewRecorder(source Source, w io.Writer) *Recorder {
+	return &Recorder{
+		source: source,
+		enc:    json.NewEncoder(w),
+	}
+}
+
+func (r *Recorder) record(cmd string, lines []string, reqErr error) error {
+	res := RecordedResponse{Time: time.Now(), Command: cmd, Lines: lines}
+	if reqErr != nil {
+		res.Error = reqErr.Error()
+	}
+
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	return r.enc.Encode(res)
+}
+
+// recordRaw records the result of a raw request to the source, including the
+// partial response of requests rejected with a ProtocolError.
+func (r *Recorder) recordRaw(cmd string, lines []string, err error) ([]string, error) {
+	if err != nil {
+		var protoErr *ProtocolError
+		if !errors.As(err, &protoErr) {
+			return nil, err
+		}
+
+		if recErr := r.record(cmd, protoErr.Lines, err); recErr != nil {
+			return nil, fmt.Errorf("unable to record %s response: %v: %w", cmd, recErr, err)
+		}
+
+		return nil, err
+	}
+
+	if err := r.record(cmd, lines, nil); err != nil {
+		return nil, fmt.Errorf("unable to record %s response: %w", cmd, err)
+	}
+
+	return lines, nil
+}
+
+func (r *Recorder) Status(ctx context.Context) (*ApcStatus, error) {
+	status, err := r.StatusRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseStatusFromLines(status)
+}
+
+func (r *Recorder) Events(ctx context.Context) ([]ApcEvent, error) {
+	events, err := r.EventsRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseEventsFromLines(events)
+}
+
+func (r *Recorder) StatusRaw(ctx context.Context) ([]string, error) {
+	lines, err := r.source.StatusRaw(ctx)
+	return r.recordRaw(statusCommand, lines, err)
+}
+
+func (r *Recorder) EventsRaw(ctx context.Context) ([]string, error) {
+	lines, err := r.source.EventsRaw(ctx)
+	return r.recordRaw(eventsCommand, lines, err)
+}
+
+// replayAddress is the address of errors from responses replayed by a ReplaySource.
+const replayAddress = "recording"
+
+// ReplaySource is a Source that serves the responses saved by a Recorder. Each
+// request returns the next recorded response for the command in the order they
+// were recorded. Once all responses for a command have been returned, the last
+// one is returned for every following request. Responses that were recorded
+// with an error are replayed as a ProtocolError including the recorded lines.
+type ReplaySource struct {
+	mtx       sync.Mutex
+	responses map[string][]RecordedResponse
+	next      map[string]int
+}
+
+// NewReplaySource loads a recording made by a Recorder from a file.
+func NewReplaySource(path string) (*ReplaySource, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() { _ = f.Close() }()
+	return ReadReplaySource(f)
+}
+
+// ReadReplaySource loads a recording made by a Recorder from a reader.
+func ReadReplaySource(r io.Reader) (*ReplaySource, error) {
+	responses := make(map[string][]RecordedResponse)
+	scanner := bufio.NewScanner(r)
+	// responses are a single line each and may be larger than the default
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+
+	for n := 1; scanner.Scan(); n++ {
+		var res RecordedResponse
+		if err := json.Unmarshal(scanner.Bytes(), &res); err != nil {
+			return nil, fmt.Errorf("invalid recorded response on line %d: %w", n, err)
+		}
+
+		if res.Command != statusCommand && res.Command != eventsCommand {
+			return nil, fmt.Errorf("invalid recorded response on line %d: unknown command %q", n, res.Command)
+		}
+
+		responses[res.Command] = append(responses[res.Command], res)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return &ReplaySource{
+		responses: responses,
+		next:      make(map[string]int),
+	}, nil
+}
+
+func (r *ReplaySource) replay(cmd string) ([]string, error) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+
+	responses := r.responses[cmd]
+	if len(responses) == 0 {
+		return nil, fmt.Errorf("no recorded responses for %s", cmd)
+	}
+
+	i := r.next[cmd]
+	if i < len(responses)-1 {
+		r.next[cmd] = i + 1
+	}
+
+	// copy the lines so callers can't modify the recording
+	lines := append([]string(nil), responses[i].Lines...)
+	if responses[i].Error != "" {
+		return nil, &ProtocolError{Address: replayAddress, Command: cmd, Err: errors.New(responses[i].Error), Lines: lines}
+	}
+
+	return lines, nil
+}
+
+func (r *ReplaySource) Status(ctx context.Context) (*ApcStatus, error) {
+	status, err := r.StatusRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseStatusFromLines(status)
+}
+
+func (r *ReplaySource) Events(ctx context.Context) ([]ApcEvent, error) {
+	events, err := r.EventsRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseEventsFromLines(events)
+}
+
+func (r *ReplaySource) StatusRaw(ctx context.Context) ([]string, error) {
+	return r.replay(statusCommand)
+}
+
+func (r *ReplaySource) EventsRaw(ctx context.Context) ([]string, error) {
+	return r.replay(eventsCommand)
+}
@@ -0,0 +1,177 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/56quarters/apcmetrics/pkg/apcmetrics"
+)
+
+func TestReplaySource_Recording(t *testing.T) {
+	source, err := apcmetrics.NewReplaySource(filepath.Join("testdata", "recording.jsonl"))
+	if err != nil {
+		t.Fatalf("unable to load recording: %s", err)
+	}
+
+	ctx := context.Background()
+
+	status, err := source.Status(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error replaying first status: %s", err)
+	}
+
+	if !status.States.Has(apcmetrics.StateOnline) || status.ChargePercent != 100 {
+		t.Errorf("expected first status to be online with a full charge, got %v at %v", status.States, status.ChargePercent)
+	}
+
+	_, err = source.Status(ctx)
+	var protoErr *apcmetrics.ProtocolError
+	if !errors.As(err, &protoErr) {
+		t.Fatalf("expected ProtocolError replaying truncated status, got %T: %v", err, err)
+	}
+
+	if len(protoErr.Lines) != 13 {
+		t.Errorf("expected the 13 lines received before the truncated status was rejected, got %d", len(protoErr.Lines))
+	}
+
+	for i := 0; i < 2; i++ {
+		status, err = source.Status(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error replaying last status: %s", err)
+		}
+
+		if !status.States.Has(apcmetrics.StateOnBattery) || status.TimeLeft != 65*time.Minute+24*time.Second {
+			t.Errorf("expected last status to be on battery with 65.4 minutes left, got %v with %s", status.States, status.TimeLeft)
+		}
+	}
+
+	for _, want := range []int{4, 6, 6} {
+		events, err := source.Events(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error replaying events: %s", err)
+		}
+
+		if len(events) != want {
+			t.Errorf("expected %d events, got %d", want, len(events))
+		}
+	}
+}
+
+func TestReplaySource_Collector(t *testing.T) {
+	source, err := apcmetrics.NewReplaySource(filepath.Join("testdata", "recording.jsonl"))
+	if err != nil {
+		t.Fatalf("unable to load recording: %s", err)
+	}
+
+	collector := apcmetrics.NewApcCollector(source, time.Second, apcmetrics.CollectorOptions{}, log.NewNopLogger())
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(collector)
+
+	// each scrape replays the next recorded status: online, truncated, on battery
+	tests := []struct {
+		up     float64
+		charge int
+	}{
+		{up: 1, charge: 1},
+		{up: 0, charge: 0},
+		{up: 1, charge: 1},
+	}
+
+	for i, tc := range tests {
+		families, err := reg.Gather()
+		if err != nil {
+			t.Fatalf("unexpected error gathering scrape %d: %s", i, err)
+		}
+
+		var up float64 = -1
+		var charge int
+		for _, f := range families {
+			switch f.GetName() {
+			case "apc_up":
+				up = f.GetMetric()[0].GetGauge().GetValue()
+			case "apc_charge_percent":
+				charge = len(f.GetMetric())
+			}
+		}
+
+		if up != tc.up {
+			t.Errorf("expected apc_up %v for scrape %d, got %v", tc.up, i, up)
+		}
+
+		if charge != tc.charge {
+			t.Errorf("expected %d apc_charge_percent series for scrape %d, got %d", tc.charge, i, charge)
+		}
+	}
+}
+
+func TestRecorder_TruncatedResponse(t *testing.T) {
+	complete := append(records(testStatus...), endOfResponse...)
+	responses := [][]byte{complete, records(testStatus[:3]...)}
+
+	var n int32
+	addr := rawServer(t, func(conn net.Conn, cmd string) bool {
+		i := atomic.AddInt32(&n, 1) - 1
+		_, _ = conn.Write(responses[int(i)%len(responses)])
+		return false
+	})
+
+	var buf bytes.Buffer
+	client := apcmetrics.NewApcClient(addr, apcmetrics.ClientOptions{}, log.NewNopLogger())
+	recorder := apcmetrics.NewRecorder(client, &buf)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	if _, err := recorder.StatusRaw(ctx); err != nil {
+		t.Fatalf("unexpected error recording complete status: %s", err)
+	}
+
+	if _, err := recorder.StatusRaw(ctx); !errors.Is(err, apcmetrics.ErrTruncatedResponse) {
+		t.Fatalf("expected the truncated response error to be returned, got %v", err)
+	}
+
+	replay, err := apcmetrics.ReadReplaySource(&buf)
+	if err != nil {
+		t.Fatalf("unable to read recording: %s", err)
+	}
+
+	if lines, err := replay.StatusRaw(ctx); err != nil || len(lines) != len(testStatus) {
+		t.Fatalf("expected complete status to be replayed, got %d lines and %v", len(lines), err)
+	}
+
+	_, err = replay.StatusRaw(ctx)
+	var protoErr *apcmetrics.ProtocolError
+	if !errors.As(err, &protoErr) {
+		t.Fatalf("expected truncated status to be replayed as a ProtocolError, got %T: %v", err, err)
+	}
+
+	if len(protoErr.Lines) != 3 {
+		t.Fatalf("expected the 3 lines received before the response was truncated, got %q", protoErr.Lines)
+	}
+}
@@ -0,0 +1,621 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+	"github.com/gosnmp/gosnmp"
+)
+
+const (
+	DefaultSnmpAddress   = "localhost:161"
+	DefaultSnmpCommunity = "public"
+
+	snmpGetCommand = "get"
+
+	// powerNetUps is the prefix of OIDs about a UPS in the APC PowerNet MIB
+	powerNetUps = "1.3.6.1.4.1.318.1.1.1"
+	// upsMib is the prefix of OIDs in the RFC 1628 UPS-MIB
+	upsMib = "1.3.6.1.2.1.33.1"
+)
+
+// OIDs used to determine the state of the UPS, which are converted to the STATUS and
+// STATFLAG fields together instead of being mapped to a single field.
+const (
+	oidPowerNetBatteryStatus   = powerNetUps + ".2.1.1.0"
+	oidPowerNetReplaceBattery  = powerNetUps + ".2.2.4.0"
+	oidPowerNetOutputStatus    = powerNetUps + ".4.1.1.0"
+	oidPowerNetDiagnostics     = powerNetUps + ".7.2.3.0"
+	oidPowerNetCalibration     = powerNetUps + ".7.2.6.0"
+	oidUpsMibBatteryStatus     = upsMib + ".2.1.0"
+	oidUpsMibOutputSource      = upsMib + ".4.1.0"
+	oidUpsMibTestResultSummary = upsMib + ".7.3.0"
+)
+
+// snmpOID is an OID and how to convert its value to the format used by apcupsd.
+// Convert returns false if the value cannot be represented in that format.
+type snmpOID struct {
+	oid     string
+	convert func(gosnmp.SnmpPDU) (string, bool)
+}
+
+// snmpField maps OIDs to a field of the apcupsd status report. Fields with more
+// than one OID use the first one that the agent reports, with PowerNet MIB OIDs
+// first since they are generally more detailed than the UPS-MIB equivalents.
+type snmpField struct {
+	apc  string
+	oids []snmpOID
+}
+
+var snmpFields = []snmpField{
+	{apc: "UPSNAME", oids: []snmpOID{{powerNetUps + ".1.1.2.0", snmpText}, {upsMib + ".1.5.0", snmpText}}},
+	{apc: "MODEL", oids: []snmpOID{{powerNetUps + ".1.1.1.0", snmpText}, {upsMib + ".1.2.0", snmpText}}},
+	{apc: "LINEV", oids: []snmpOID{{powerNetUps + ".3.2.1.0", snmpUnit("Volts", 1)}, {upsMib + ".3.3.1.3.1", snmpUnit("Volts", 1)}}},
+	{apc: "LOADPCT", oids: []snmpOID{{powerNetUps + ".4.2.3.0", snmpUnit("Percent", 1)}, {upsMib + ".4.4.1.5.1", snmpUnit("Percent", 1)}}},
+	{apc: "BCHARGE", oids: []snmpOID{{powerNetUps + ".2.2.1.0", snmpUnit("Percent", 1)}, {upsMib + ".2.4.0", snmpUnit("Percent", 1)}}},
+	{apc: "TIMELEFT", oids: []snmpOID{{powerNetUps + ".2.2.3.0", snmpTicksMinutes}, {upsMib + ".2.3.0", snmpUnit("Minutes", 1)}}},
+	{apc: "MAXLINEV", oids: []snmpOID{{powerNetUps + ".3.2.2.0", snmpUnit("Volts", 1)}}},
+	{apc: "MINLINEV", oids: []snmpOID{{powerNetUps + ".3.2.3.0", snmpUnit("Volts", 1)}}},
+	{apc: "OUTPUTV", oids: []snmpOID{{powerNetUps + ".4.2.1.0", snmpUnit("Volts", 1)}, {upsMib + ".4.4.1.2.1", snmpUnit("Volts", 1)}}},
+	{apc: "DLOWBATT", oids: []snmpOID{{upsMib + ".9.7.0", snmpUnit("Minutes", 1)}}},
+	{apc: "LOTRANS", oids: []snmpOID{{powerNetUps + ".5.2.3.0", snmpUnit("Volts", 1)}, {upsMib + ".9.9.0", snmpUnit("Volts", 1)}}},
+	{apc: "HITRANS", oids: []snmpOID{{powerNetUps + ".5.2.2.0", snmpUnit("Volts", 1)}, {upsMib + ".9.10.0", snmpUnit("Volts", 1)}}},
+	{apc: "ITEMP", oids: []snmpOID{{powerNetUps + ".2.2.2.0", snmpUnit("C", 1)}, {upsMib + ".2.7.0", snmpUnit("C", 1)}}},
+	{apc: "BATTV", oids: []snmpOID{{powerNetUps + ".2.2.8.0", snmpUnit("Volts", 1)}, {upsMib + ".2.5.0", snmpUnit("Volts", 10)}}},
+	{apc: "LINEFREQ", oids: []snmpOID{{powerNetUps + ".3.2.4.0", snmpUnit("Hz", 1)}, {upsMib + ".3.3.1.2.1", snmpUnit("Hz", 10)}}},
+	{apc: "OUTCURNT", oids: []snmpOID{{powerNetUps + ".4.2.4.0", snmpUnit("Amps", 1)}, {upsMib + ".4.4.1.3.1", snmpUnit("Amps", 10)}}},
+	{apc: "LASTXFER", oids: []snmpOID{{powerNetUps + ".3.2.5.0", snmpEnum(powerNetLineFailCauses)}}},
+	{apc: "TONBATT", oids: []snmpOID{{powerNetUps + ".2.1.2.0", snmpTicksSeconds}, {upsMib + ".2.2.0", snmpUnit("Seconds", 1)}}},
+	{apc: "SELFTEST", oids: []snmpOID{{oidPowerNetDiagnostics, snmpEnum(powerNetDiagnostics)}, {oidUpsMibTestResultSummary, snmpEnum(upsMibTestResults)}}},
+	{apc: "SERIALNO", oids: []snmpOID{{powerNetUps + ".1.2.3.0", snmpText}}},
+	{apc: "BATTDATE", oids: []snmpOID{{powerNetUps + ".2.1.3.0", snmpDate}}},
+	{apc: "NOMINV", oids: []snmpOID{{upsMib + ".9.1.0", snmpUnit("Volts", 1)}}},
+	{apc: "NOMOUTV", oids: []snmpOID{{powerNetUps + ".5.2.1.0", snmpUnit("Volts", 1)}, {upsMib + ".9.3.0", snmpUnit("Volts", 1)}}},
+	{apc: "NOMBATTV", oids: []snmpOID{{powerNetUps + ".2.2.7.0", snmpUnit("Volts", 1)}}},
+	{apc: "NOMAPNT", oids: []snmpOID{{upsMib + ".9.5.0", snmpUnit("VA", 1)}}},
+	{apc: "NOMPOWER", oids: []snmpOID{{upsMib + ".9.6.0", snmpUnit("Watts", 1)}}},
+	{apc: "EXTBATTS", oids: []snmpOID{{powerNetUps + ".2.2.5.0", snmpNumber}}},
+	{apc: "BADBATTS", oids: []snmpOID{{powerNetUps + ".2.2.6.0", snmpNumber}}},
+	{apc: "MANDATE", oids: []snmpOID{{powerNetUps + ".1.2.2.0", snmpDate}}},
+	{apc: "FIRMWARE", oids: []snmpOID{{powerNetUps + ".1.2.1.0", snmpText}, {upsMib + ".1.3.0", snmpText}}},
+}
+
+// powerNetLineFailCauses are the values of upsAdvInputLineFailCause using
+// the same descriptions as the LASTXFER field reported by apcupsd: noTransfer(1),
+// highLineVoltage(2), brownout(3), blackout(4), smallMomentarySag(5),
+// deepMomentarySag(6), smallMomentarySpike(7), largeMomentarySpike(8),
+// selfTest(9), and rateOfVoltageChange(10).
+var powerNetLineFailCauses = map[int64]string{
+	1:  "No transfers since turnon",
+	2:  "High line voltage",
+	3:  "Low line voltage",
+	4:  "Line voltage notch or spike",
+	5:  "Line voltage notch or spike",
+	6:  "Line voltage notch or spike",
+	7:  "Line voltage notch or spike",
+	8:  "Line voltage notch or spike",
+	9:  "Automatic or explicit self test",
+	10: "Unacceptable line voltage changes",
+}
+
+// powerNetDiagnostics are the values of upsAdvTestDiagnosticsResults using
+// the same codes as the SELFTEST field reported by apcupsd: ok(1), failed(2),
+// invalidTest(3), and testInProgress(4).
+var powerNetDiagnostics = map[int64]string{
+	1: "OK",
+	2: "NG",
+	3: "NO",
+	4: "IP",
+}
+
+// upsMibTestResults are the values of upsTestResultsSummary using the same
+// codes as the SELFTEST field reported by apcupsd: donePass(1) is OK,
+// doneWarning(2) is WN, doneError(3) is NG, inProgress(5) is IP, and both
+// aborted(4) and noTestsInitiated(6) are NO since there is no result.
+var upsMibTestResults = map[int64]string{
+	1: "OK",
+	2: "WN",
+	3: "NG",
+	4: "NO",
+	5: "IP",
+	6: "NO",
+}
+
+// SnmpOptions control how the SNMP agent of a UPS, such as an APC Network Management
+// Card, is queried. Community is used for SNMP v2c and the remaining options for v3.
+type SnmpOptions struct {
+	// Version is the SNMP version to use, either "2c" or "3".
+	Version   string `yaml:"version"`
+	Community string `yaml:"community"`
+
+	// User is the SNMP v3 user name. If AuthProtocol is empty, no authentication is
+	// used. If PrivProtocol is empty, no privacy (encryption) is used.
+	User         string `yaml:"user"`
+	AuthProtocol string `yaml:"auth_protocol"`
+	AuthPassword string `yaml:"auth_password"`
+	PrivProtocol string `yaml:"priv_protocol"`
+	PrivPassword string `yaml:"priv_password"`
+}
+
+// snmpAuthProtocols are SNMP v3 authentication protocols by name.
+var snmpAuthProtocols = map[string]gosnmp.SnmpV3AuthProtocol{
+	"md5":    gosnmp.MD5,
+	"sha":    gosnmp.SHA,
+	"sha224": gosnmp.SHA224,
+	"sha256": gosnmp.SHA256,
+	"sha384": gosnmp.SHA384,
+	"sha512": gosnmp.SHA512,
+}
+
+// snmpPrivProtocols are SNMP v3 privacy protocols by name.
+var snmpPrivProtocols = map[string]gosnmp.SnmpV3PrivProtocol{
+	"des":    gosnmp.DES,
+	"aes":    gosnmp.AES,
+	"aes192": gosnmp.AES192,
+	"aes256": gosnmp.AES256,
+}
+
+// SnmpClient gets the status of a UPS from its SNMP agent using the APC PowerNet MIB
+// or RFC 1628 UPS-MIB and converts it to the status report used by apcupsd so that
+// it can be used in place of an ApcClient. SNMP agents do not provide a log of events
+// so there are never any events for a UPS.
+type SnmpClient struct {
+	address string
+	opts    SnmpOptions
+	logger  log.Logger
+}
+
+func NewSnmpClient(address string, opts SnmpOptions, logger log.Logger) (*SnmpClient, error) {
+	if _, _, err := snmpTarget(address); err != nil {
+		return nil, err
+	}
+
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &SnmpClient{
+		address: address,
+		opts:    opts,
+		logger:  logger,
+	}, nil
+}
+
+// Validate returns an error if the version or any protocols are not supported.
+func (opts SnmpOptions) Validate() error {
+	if opts.Version != "2c" && opts.Version != "3" {
+		return fmt.Errorf("unsupported SNMP version %q", opts.Version)
+	}
+
+	if opts.Version == "3" && opts.User == "" {
+		return errors.New("SNMP v3 requires a user")
+	}
+
+	if _, ok := snmpAuthProtocols[opts.AuthProtocol]; opts.AuthProtocol != "" && !ok {
+		return fmt.Errorf("unsupported SNMP auth protocol %q", opts.AuthProtocol)
+	}
+
+	if _, ok := snmpPrivProtocols[opts.PrivProtocol]; opts.PrivProtocol != "" && !ok {
+		return fmt.Errorf("unsupported SNMP privacy protocol %q", opts.PrivProtocol)
+	}
+
+	if opts.PrivProtocol != "" && opts.AuthProtocol == "" {
+		return fmt.Errorf("SNMP privacy protocol %q requires an auth protocol", opts.PrivProtocol)
+	}
+
+	return nil
+}
+
+// snmpTarget splits an address into a host and port, using port 161 if the
+// address does not include one.
+func snmpTarget(address string) (string, uint16, error) {
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return address, 161, nil
+	}
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return "", 0, fmt.Errorf("invalid SNMP port %q: %w", portStr, err)
+	}
+
+	return host, uint16(port), nil
+}
+
+func (s *SnmpClient) session(ctx context.Context) *gosnmp.GoSNMP {
+	host, port, _ := snmpTarget(s.address)
+
+	// use the deadline of the context as the timeout for the entire request
+	// instead of retrying since the caller has already decided how long to wait
+	timeout := gosnmp.Default.Timeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	g := &gosnmp.GoSNMP{
+		Target:    host,
+		Port:      port,
+		Transport: "udp",
+		Community: s.opts.Community,
+		Version:   gosnmp.Version2c,
+		Timeout:   timeout,
+		Retries:   0,
+		MaxOids:   gosnmp.MaxOids,
+		Context:   ctx,
+	}
+
+	if s.opts.Version == "3" {
+		params := &gosnmp.UsmSecurityParameters{
+			UserName:               s.opts.User,
+			AuthenticationProtocol: gosnmp.NoAuth,
+			PrivacyProtocol:        gosnmp.NoPriv,
+		}
+
+		flags := gosnmp.NoAuthNoPriv
+		if s.opts.AuthProtocol != "" {
+			flags = gosnmp.AuthNoPriv
+			params.AuthenticationProtocol = snmpAuthProtocols[s.opts.AuthProtocol]
+			params.AuthenticationPassphrase = s.opts.AuthPassword
+		}
+
+		if s.opts.PrivProtocol != "" {
+			flags = gosnmp.AuthPriv
+			params.PrivacyProtocol = snmpPrivProtocols[s.opts.PrivProtocol]
+			params.PrivacyPassphrase = s.opts.PrivPassword
+		}
+
+		g.Version = gosnmp.Version3
+		g.SecurityModel = gosnmp.UserSecurityModel
+		g.MsgFlags = flags
+		g.SecurityParameters = params
+	}
+
+	return g
+}
+
+// Values gets all OIDs used to build the status of the UPS from the SNMP agent,
+// returning a value for each OID that the agent reported, keyed by OID without
+// a leading dot.
+func (s *SnmpClient) Values(ctx context.Context) (map[string]gosnmp.SnmpPDU, error) {
+	g := s.session(ctx)
+	if err := g.Connect(); err != nil {
+		if isTimeout(err) {
+			return nil, &TimeoutError{Address: s.address, Op: "connect", Err: err}
+		}
+
+		return nil, &ConnectionError{Address: s.address, Err: err}
+	}
+
+	defer func() {
+		if err := g.Conn.Close(); err != nil {
+			level.Debug(s.logger).Log("msg", "failed to close SNMP connection", "err", err)
+		}
+	}()
+
+	oids := snmpOIDs()
+	out := make(map[string]gosnmp.SnmpPDU, len(oids))
+
+	for start := 0; start < len(oids); start += g.MaxOids {
+		end := start + g.MaxOids
+		if end > len(oids) {
+			end = len(oids)
+		}
+
+		res, err := g.Get(oids[start:end])
+		if err != nil {
+			// gosnmp doesn't return a distinct error for timeouts so use the
+			// context to determine if we ran out of time waiting for a response
+			if isTimeout(err) || ctx.Err() != nil {
+				return nil, &TimeoutError{Address: s.address, Op: snmpGetCommand, Err: err}
+			}
+
+			return nil, &ProtocolError{Address: s.address, Command: snmpGetCommand, Err: err}
+		}
+
+		if res.Error != gosnmp.NoError {
+			return nil, &ProtocolError{Address: s.address, Command: snmpGetCommand, Err: fmt.Errorf("agent error %s at index %d", res.Error, res.ErrorIndex)}
+		}
+
+		for _, pdu := range res.Variables {
+			switch pdu.Type {
+			case gosnmp.NoSuchObject, gosnmp.NoSuchInstance, gosnmp.EndOfMibView, gosnmp.Null:
+				continue
+			}
+
+			out[strings.TrimPrefix(pdu.Name, ".")] = pdu
+		}
+	}
+
+	return out, nil
+}
+
+// snmpOIDs returns every OID used to build the status of the UPS.
+func snmpOIDs() []string {
+	out := []string{
+		oidPowerNetBatteryStatus,
+		oidPowerNetReplaceBattery,
+		oidPowerNetOutputStatus,
+		oidPowerNetCalibration,
+		oidUpsMibBatteryStatus,
+		oidUpsMibOutputSource,
+	}
+
+	seen := make(map[string]bool)
+	for _, oid := range out {
+		seen[oid] = true
+	}
+
+	for _, f := range snmpFields {
+		for _, o := range f.oids {
+			if !seen[o.oid] {
+				out = append(out, o.oid)
+				seen[o.oid] = true
+			}
+		}
+	}
+
+	return out
+}
+
+func (s *SnmpClient) Status(ctx context.Context) (*ApcStatus, error) {
+	status, err := s.StatusRaw(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return ParseStatusFromLines(status)
+}
+
+// Events always returns no events since SNMP agents do not provide a log of them.
+func (s *SnmpClient) Events(ctx context.Context) ([]ApcEvent, error) {
+	return []ApcEvent{}, nil
+}
+
+// StatusRaw returns the values reported by the SNMP agent of the UPS converted to
+// the status report used by apcupsd.
+func (s *SnmpClient) StatusRaw(ctx context.Context) ([]string, error) {
+	values, err := s.Values(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(values) == 0 {
+		return nil, &ProtocolError{Address: s.address, Command: snmpGetCommand, Err: fmt.Errorf("%w: agent does not support the PowerNet MIB or UPS-MIB", ErrMalformedResponse)}
+	}
+
+	return snmpStatusLines(s.address, values, time.Now()), nil
+}
+
+// EventsRaw always returns no events since SNMP agents do not provide a log of them.
+func (s *SnmpClient) EventsRaw(ctx context.Context) ([]string, error) {
+	return []string{}, nil
+}
+
+func snmpStatusLines(address string, values map[string]gosnmp.SnmpPDU, now time.Time) []string {
+	host, _, _ := snmpTarget(address)
+	date := now.Format("2006-01-02 15:04:05 -0700")
+	states, flags := snmpStates(values)
+
+	out := []string{
+		statusLine("DATE", date),
+		statusLine("HOSTNAME", host),
+		statusLine("DRIVER", "SNMP"),
+	}
+
+	if len(states) > 0 {
+		names := make([]string, 0, len(states))
+		for _, s := range states {
+			names = append(names, string(s))
+		}
+
+		out = append(out, statusLine("STATUS", strings.Join(names, " ")))
+		out = append(out, statusLine("STATFLAG", fmt.Sprintf("0x%08X", uint32(flags))))
+	}
+
+	for _, f := range snmpFields {
+		for _, o := range f.oids {
+			pdu, ok := values[o.oid]
+			if !ok {
+				continue
+			}
+
+			if converted, ok := o.convert(pdu); ok {
+				out = append(out, statusLine(f.apc, converted))
+			}
+
+			break
+		}
+	}
+
+	return append(out, statusLine(endRecord, date))
+}
+
+// snmpStates determines the state of the UPS from the output and battery status
+// reported by the PowerNet MIB or, if not available, the UPS-MIB.
+func snmpStates(values map[string]gosnmp.SnmpPDU) (UpsStates, StatusFlags) {
+	var states UpsStates
+	var flags StatusFlags
+
+	add := func(s UpsState, f StatusFlags) {
+		states = append(states, s)
+		flags |= f
+	}
+
+	if output, ok := snmpInt(values, oidPowerNetOutputStatus); ok {
+		switch output {
+		case 2:
+			add(StateOnline, FlagOnline)
+		case 3:
+			add(StateOnBattery, FlagOnBattery)
+		case 4:
+			add(StateOnline, FlagOnline)
+			add(StateBoost, FlagBoost)
+		case 12:
+			add(StateOnline, FlagOnline)
+			add(StateTrim, FlagTrim)
+		}
+
+		if battery, ok := snmpInt(values, oidPowerNetBatteryStatus); ok && battery == 3 {
+			add(StateLowBattery, FlagLowBattery)
+		}
+
+		if replace, ok := snmpInt(values, oidPowerNetReplaceBattery); ok && replace == 2 {
+			add(StateReplaceBattery, FlagReplaceBattery)
+		}
+
+		// upsAdvTestCalibrationResults is 3 (calibrationInProgress) while a runtime
+		// calibration is running. A self test in progress is reported by SELFTEST.
+		if calibration, ok := snmpInt(values, oidPowerNetCalibration); ok && calibration == 3 {
+			add(StateCalibration, FlagCalibration)
+		}
+	} else if output, ok := snmpInt(values, oidUpsMibOutputSource); ok {
+		switch output {
+		case 3:
+			add(StateOnline, FlagOnline)
+		case 5:
+			add(StateOnBattery, FlagOnBattery)
+		case 6:
+			add(StateOnline, FlagOnline)
+			add(StateBoost, FlagBoost)
+		case 7:
+			add(StateOnline, FlagOnline)
+			add(StateTrim, FlagTrim)
+		}
+
+		if battery, ok := snmpInt(values, oidUpsMibBatteryStatus); ok && (battery == 3 || battery == 4) {
+			add(StateLowBattery, FlagLowBattery)
+		}
+	}
+
+	return states, flags
+}
+
+func snmpInt(values map[string]gosnmp.SnmpPDU, oid string) (int64, bool) {
+	pdu, ok := values[oid]
+	if !ok {
+		return 0, false
+	}
+
+	return snmpPDUInt(pdu)
+}
+
+func snmpPDUInt(pdu gosnmp.SnmpPDU) (int64, bool) {
+	switch pdu.Type {
+	case gosnmp.Integer, gosnmp.Counter32, gosnmp.Gauge32, gosnmp.TimeTicks, gosnmp.Counter64, gosnmp.Uinteger32:
+		return gosnmp.ToBigInt(pdu.Value).Int64(), true
+	}
+
+	return 0, false
+}
+
+func snmpText(pdu gosnmp.SnmpPDU) (string, bool) {
+	if pdu.Type != gosnmp.OctetString {
+		return "", false
+	}
+
+	b, ok := pdu.Value.([]byte)
+	if !ok {
+		return "", false
+	}
+
+	v := strings.TrimSpace(string(b))
+	return v, v != ""
+}
+
+// snmpUnit converts an integer value to a number in the given unit, dividing it
+// by divisor first for values reported in fractions of the unit (e.g. 0.1 Volts).
+func snmpUnit(unit string, divisor float64) func(gosnmp.SnmpPDU) (string, bool) {
+	return func(pdu gosnmp.SnmpPDU) (string, bool) {
+		v, ok := snmpPDUInt(pdu)
+		if !ok {
+			return "", false
+		}
+
+		return strconv.FormatFloat(float64(v)/divisor, 'f', -1, 64) + " " + unit, true
+	}
+}
+
+func snmpNumber(pdu gosnmp.SnmpPDU) (string, bool) {
+	v, ok := snmpPDUInt(pdu)
+	if !ok {
+		return "", false
+	}
+
+	return strconv.FormatInt(v, 10), true
+}
+
+func snmpEnum(names map[int64]string) func(gosnmp.SnmpPDU) (string, bool) {
+	return func(pdu gosnmp.SnmpPDU) (string, bool) {
+		v, ok := snmpPDUInt(pdu)
+		if !ok {
+			return "", false
+		}
+
+		name, ok := names[v]
+		return name, ok
+	}
+}
+
+// snmpTicksMinutes converts TimeTicks (hundredths of a second) to minutes as
+// reported by apcupsd.
+func snmpTicksMinutes(pdu gosnmp.SnmpPDU) (string, bool) {
+	if pdu.Type != gosnmp.TimeTicks {
+		return "", false
+	}
+
+	ticks := gosnmp.ToBigInt(pdu.Value).Int64()
+	return strconv.FormatFloat(float64(ticks)/100/60, 'f', 1, 64) + " Minutes", true
+}
+
+// snmpTicksSeconds converts TimeTicks (hundredths of a second) to seconds as
+// reported by apcupsd.
+func snmpTicksSeconds(pdu gosnmp.SnmpPDU) (string, bool) {
+	if pdu.Type != gosnmp.TimeTicks {
+		return "", false
+	}
+
+	ticks := gosnmp.ToBigInt(pdu.Value).Int64()
+	return strconv.FormatInt(ticks/100, 10) + " Seconds", true
+}
+
+// snmpDate converts dates reported by the PowerNet MIB, which are of the form
+// mm/dd/yy or mm/dd/yyyy, to the format used by apcupsd.
+func snmpDate(pdu gosnmp.SnmpPDU) (string, bool) {
+	v, ok := snmpText(pdu)
+	if !ok {
+		return "", false
+	}
+
+	for _, layout := range []string{"01/02/06", "01/02/2006"} {
+		if t, err := time.Parse(layout, v); err == nil {
+			return t.Format("2006-01-02"), true
+		}
+	}
+
+	return "", false
+}
@@ -0,0 +1,230 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gosnmp/gosnmp"
+)
+
+func TestSnmpStatusLines(t *testing.T) {
+	now := time.Date(2021, 11, 7, 12, 15, 21, 0, time.UTC)
+
+	tests := []struct {
+		fixture    string
+		wantFlags  StatusFlags
+		wantStates UpsStates
+		wantFields map[string]string
+	}{
+		{
+			fixture:    "powernet-selftest.snmprec",
+			wantFlags:  FlagOnline,
+			wantStates: UpsStates{StateOnline},
+			wantFields: map[string]string{
+				"UPSNAME":  "rack-ups",
+				"BCHARGE":  "100 Percent",
+				"TIMELEFT": "54.0 Minutes",
+				"LOADPCT":  "17 Percent",
+				"SELFTEST": "IP",
+				"LASTXFER": "Automatic or explicit self test",
+				"BATTDATE": "2019-03-14",
+			},
+		},
+		{
+			fixture:    "powernet-calibration.snmprec",
+			wantFlags:  FlagOnBattery | FlagCalibration,
+			wantStates: UpsStates{StateOnBattery, StateCalibration},
+			wantFields: map[string]string{
+				"BCHARGE":  "64 Percent",
+				"TIMELEFT": "21.0 Minutes",
+				"SELFTEST": "OK",
+			},
+		},
+		{
+			fixture:    "upsmib-lowbattery.snmprec",
+			wantFlags:  FlagOnBattery | FlagLowBattery,
+			wantStates: UpsStates{StateOnBattery, StateLowBattery},
+			wantFields: map[string]string{
+				"UPSNAME":  "office-ups",
+				"BCHARGE":  "8 Percent",
+				"TIMELEFT": "2 Minutes",
+				"TONBATT":  "540 Seconds",
+				"BATTV":    "11.8 Volts",
+				"NOMPOWER": "600 Watts",
+				"SELFTEST": "WN",
+			},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.fixture, func(t *testing.T) {
+			values := readSnmprec(t, filepath.Join("testdata", tc.fixture))
+
+			states, flags := snmpStates(values)
+			if flags != tc.wantFlags {
+				t.Errorf("expected status flags %v, got %v", tc.wantFlags, flags)
+			}
+
+			if len(states) != len(tc.wantStates) {
+				t.Fatalf("expected states %v, got %v", tc.wantStates, states)
+			}
+
+			for i := range states {
+				if states[i] != tc.wantStates[i] {
+					t.Errorf("expected states %v, got %v", tc.wantStates, states)
+				}
+			}
+
+			lines := snmpStatusLines("rack-ups.example:161", values, now)
+			status, err := ParseStatusFromLines(lines)
+			if err != nil {
+				t.Fatalf("unexpected error parsing status lines %q: %s", lines, err)
+			}
+
+			if status.Flags == nil || *status.Flags != tc.wantFlags {
+				t.Errorf("expected parsed status flags %v, got %v", tc.wantFlags, status.Flags)
+			}
+
+			if status.Driver != "SNMP" {
+				t.Errorf("expected driver SNMP, got %q", status.Driver)
+			}
+
+			for field, want := range tc.wantFields {
+				if got := status.Fields[field]; got != want {
+					t.Errorf("expected %s to be %q, got %q", field, want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestSnmpEnum(t *testing.T) {
+	tests := []struct {
+		name  string
+		names map[int64]string
+		value int
+		want  string
+	}{
+		{name: "line fail noTransfer", names: powerNetLineFailCauses, value: 1, want: "No transfers since turnon"},
+		{name: "line fail highLineVoltage", names: powerNetLineFailCauses, value: 2, want: "High line voltage"},
+		{name: "line fail brownout", names: powerNetLineFailCauses, value: 3, want: "Low line voltage"},
+		{name: "line fail blackout", names: powerNetLineFailCauses, value: 4, want: "Line voltage notch or spike"},
+		{name: "line fail smallMomentarySag", names: powerNetLineFailCauses, value: 5, want: "Line voltage notch or spike"},
+		{name: "line fail deepMomentarySag", names: powerNetLineFailCauses, value: 6, want: "Line voltage notch or spike"},
+		{name: "line fail smallMomentarySpike", names: powerNetLineFailCauses, value: 7, want: "Line voltage notch or spike"},
+		{name: "line fail largeMomentarySpike", names: powerNetLineFailCauses, value: 8, want: "Line voltage notch or spike"},
+		{name: "line fail selfTest", names: powerNetLineFailCauses, value: 9, want: "Automatic or explicit self test"},
+		{name: "line fail rateOfVoltageChange", names: powerNetLineFailCauses, value: 10, want: "Unacceptable line voltage changes"},
+		{name: "line fail unknown", names: powerNetLineFailCauses, value: 11},
+		{name: "diagnostics ok", names: powerNetDiagnostics, value: 1, want: "OK"},
+		{name: "diagnostics failed", names: powerNetDiagnostics, value: 2, want: "NG"},
+		{name: "diagnostics invalidTest", names: powerNetDiagnostics, value: 3, want: "NO"},
+		{name: "diagnostics testInProgress", names: powerNetDiagnostics, value: 4, want: "IP"},
+		{name: "diagnostics unknown", names: powerNetDiagnostics, value: 0},
+		{name: "test results donePass", names: upsMibTestResults, value: 1, want: "OK"},
+		{name: "test results doneWarning", names: upsMibTestResults, value: 2, want: "WN"},
+		{name: "test results doneError", names: upsMibTestResults, value: 3, want: "NG"},
+		{name: "test results aborted", names: upsMibTestResults, value: 4, want: "NO"},
+		{name: "test results inProgress", names: upsMibTestResults, value: 5, want: "IP"},
+		{name: "test results noTestsInitiated", names: upsMibTestResults, value: 6, want: "NO"},
+		{name: "test results unknown", names: upsMibTestResults, value: 7},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, ok := snmpEnum(tc.names)(gosnmp.SnmpPDU{Type: gosnmp.Integer, Value: tc.value})
+			if ok != (tc.want != "") {
+				t.Fatalf("expected value %d to be known=%t, got %t", tc.value, tc.want != "", ok)
+			}
+
+			if got != tc.want {
+				t.Errorf("expected %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+// readSnmprec reads values recorded in the snmprec format used by snmpsim, one
+// OID|type|value per line, keyed by OID the same way as SnmpClient.Values.
+func readSnmprec(t *testing.T, path string) map[string]gosnmp.SnmpPDU {
+	t.Helper()
+
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("unable to open %s: %s", path, err)
+	}
+	defer f.Close()
+
+	out := make(map[string]gosnmp.SnmpPDU)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		parts := strings.SplitN(line, "|", 3)
+		if len(parts) != 3 {
+			t.Fatalf("malformed snmprec line in %s: %q", path, line)
+		}
+
+		oid := strings.TrimPrefix(parts[0], ".")
+		pdu := gosnmp.SnmpPDU{Name: "." + oid}
+
+		switch parts[1] {
+		case "4":
+			pdu.Type = gosnmp.OctetString
+			pdu.Value = []byte(parts[2])
+		case "2", "66", "67":
+			v, err := strconv.ParseInt(parts[2], 10, 64)
+			if err != nil {
+				t.Fatalf("malformed snmprec value in %s: %q", path, line)
+			}
+
+			switch parts[1] {
+			case "2":
+				pdu.Type = gosnmp.Integer
+				pdu.Value = int(v)
+			case "66":
+				pdu.Type = gosnmp.Gauge32
+				pdu.Value = uint(v)
+			case "67":
+				pdu.Type = gosnmp.TimeTicks
+				pdu.Value = uint32(v)
+			}
+		default:
+			t.Fatalf("unsupported snmprec type in %s: %q", path, line)
+		}
+
+		out[oid] = pdu
+	}
+
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("unable to read %s: %s", path, err)
+	}
+
+	return out
+}
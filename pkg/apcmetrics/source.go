@@ -0,0 +1,50 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import "context"
+
+// Ensure each way of getting UPS status and events can be used as a Source
+var (
+	_ Source = (*ApcClient)(nil)
+	_ Source = (*ApcFileSource)(nil)
+	_ Source = (*NutClient)(nil)
+	_ Source = (*SnmpClient)(nil)
+	_ Source = (*Recorder)(nil)
+	_ Source = (*ReplaySource)(nil)
+)
+
+// Source provides the status and events of a UPS. Collectors, pollers, and watchers
+// only depend on a Source so that other backends or wrappers (such as caches) can be
+// used in place of connecting to apcupsd directly with an ApcClient.
+type Source interface {
+	// Status returns the parsed current status of the UPS.
+	Status(ctx context.Context) (*ApcStatus, error)
+
+	// StatusRaw returns the unparsed lines of the current status of the UPS
+	// in the format used by apcupsd.
+	StatusRaw(ctx context.Context) ([]string, error)
+
+	// Events returns the parsed recent events of the UPS, oldest first.
+	Events(ctx context.Context) ([]ApcEvent, error)
+
+	// EventsRaw returns the unparsed lines of recent events of the UPS in the
+	// format used by apcupsd.
+	EventsRaw(ctx context.Context) ([]string, error)
+}
@@ -0,0 +1,229 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// StatusFlags is the STATFLAG bitmask reported by apcupsd. The meaning of each
+// bit comes from the apcupsd source, include/defines.h.
+type StatusFlags uint32
+
+const (
+	FlagCalibration     StatusFlags = 0x00000001
+	FlagTrim            StatusFlags = 0x00000002
+	FlagBoost           StatusFlags = 0x00000004
+	FlagOnline          StatusFlags = 0x00000008
+	FlagOnBattery       StatusFlags = 0x00000010
+	FlagOverload        StatusFlags = 0x00000020
+	FlagLowBattery      StatusFlags = 0x00000040
+	FlagReplaceBattery  StatusFlags = 0x00000080
+	FlagCommLost        StatusFlags = 0x00000100
+	FlagShutdown        StatusFlags = 0x00000200
+	FlagSlave           StatusFlags = 0x00000400
+	FlagSlaveDown       StatusFlags = 0x00000800
+	FlagOnBatteryMsg    StatusFlags = 0x00020000
+	FlagFastPoll        StatusFlags = 0x00040000
+	FlagShutLoad        StatusFlags = 0x00080000
+	FlagShutBatteryTime StatusFlags = 0x00100000
+	FlagShutLowTime     StatusFlags = 0x00200000
+	FlagShutEmergency   StatusFlags = 0x00400000
+	FlagShutRemote      StatusFlags = 0x00800000
+	FlagPlugged         StatusFlags = 0x01000000
+	FlagBatteryPresent  StatusFlags = 0x04000000
+)
+
+type statusFlagName struct {
+	flag StatusFlags
+	name string
+}
+
+// statusFlagNames are the names of each known flag, in bit order, used for
+// JSON output and the "flag" label of the apc_status_flag metric.
+var statusFlagNames = []statusFlagName{
+	{FlagCalibration, "calibration"},
+	{FlagTrim, "trim"},
+	{FlagBoost, "boost"},
+	{FlagOnline, "online"},
+	{FlagOnBattery, "on_battery"},
+	{FlagOverload, "overload"},
+	{FlagLowBattery, "low_battery"},
+	{FlagReplaceBattery, "replace_battery"},
+	{FlagCommLost, "comm_lost"},
+	{FlagShutdown, "shutdown"},
+	{FlagSlave, "slave"},
+	{FlagSlaveDown, "slave_down"},
+	{FlagOnBatteryMsg, "on_battery_msg"},
+	{FlagFastPoll, "fast_poll"},
+	{FlagShutLoad, "shut_load"},
+	{FlagShutBatteryTime, "shut_battery_time"},
+	{FlagShutLowTime, "shut_low_time"},
+	{FlagShutEmergency, "shut_emergency"},
+	{FlagShutRemote, "shut_remote"},
+	{FlagPlugged, "plugged"},
+	{FlagBatteryPresent, "battery_present"},
+}
+
+// Has returns true if all the bits of flag are set.
+func (f StatusFlags) Has(flag StatusFlags) bool {
+	return f&flag == flag
+}
+
+func (f StatusFlags) Online() bool {
+	return f.Has(FlagOnline)
+}
+
+func (f StatusFlags) OnBattery() bool {
+	return f.Has(FlagOnBattery)
+}
+
+func (f StatusFlags) Overload() bool {
+	return f.Has(FlagOverload)
+}
+
+func (f StatusFlags) LowBattery() bool {
+	return f.Has(FlagLowBattery)
+}
+
+func (f StatusFlags) ReplaceBattery() bool {
+	return f.Has(FlagReplaceBattery)
+}
+
+func (f StatusFlags) CommLost() bool {
+	return f.Has(FlagCommLost)
+}
+
+func (f StatusFlags) Shutdown() bool {
+	return f.Has(FlagShutdown)
+}
+
+func (f StatusFlags) Calibration() bool {
+	return f.Has(FlagCalibration)
+}
+
+// Names returns the names of all known flags that are set.
+func (f StatusFlags) Names() []string {
+	out := make([]string, 0)
+	for _, n := range statusFlagNames {
+		if f.Has(n.flag) {
+			out = append(out, n.name)
+		}
+	}
+
+	return out
+}
+
+func (f StatusFlags) String() string {
+	return fmt.Sprintf("0x%08X (%s)", uint32(f), strings.Join(f.Names(), ","))
+}
+
+// MarshalJSON encodes flags as a list of the names of all known flags that are set.
+func (f StatusFlags) MarshalJSON() ([]byte, error) {
+	return json.Marshal(f.Names())
+}
+
+// UpsState is a single component of the STATUS reported by apcupsd, e.g. a STATUS
+// of "ONBATT LOWBATT" is made up of the states ONBATT and LOWBATT.
+type UpsState string
+
+const (
+	StateCalibration    UpsState = "CAL"
+	StateTrim           UpsState = "TRIM"
+	StateBoost          UpsState = "BOOST"
+	StateOnline         UpsState = "ONLINE"
+	StateOnBattery      UpsState = "ONBATT"
+	StateOverload       UpsState = "OVERLOAD"
+	StateLowBattery     UpsState = "LOWBATT"
+	StateReplaceBattery UpsState = "REPLACEBATT"
+	StateNoBattery      UpsState = "NOBATT"
+	StateSlave          UpsState = "SLAVE"
+	StateSlaveDown      UpsState = "SLAVEDOWN"
+	StateCommLost       UpsState = "COMMLOST"
+	StateShuttingDown   UpsState = "SHUTTING DOWN"
+)
+
+type upsStateName struct {
+	state UpsState
+	name  string
+}
+
+// upsStateNames are the fixed set of states, all of which are exported by
+// the apc_state metric whether they are present in the STATUS or not.
+var upsStateNames = []upsStateName{
+	{StateCalibration, "calibration"},
+	{StateTrim, "trim"},
+	{StateBoost, "boost"},
+	{StateOnline, "online"},
+	{StateOnBattery, "on_battery"},
+	{StateOverload, "overload"},
+	{StateLowBattery, "low_battery"},
+	{StateReplaceBattery, "replace_battery"},
+	{StateNoBattery, "no_battery"},
+	{StateSlave, "slave"},
+	{StateSlaveDown, "slave_down"},
+	{StateCommLost, "comm_lost"},
+	{StateShuttingDown, "shutting_down"},
+}
+
+// UpsStates are all states that make up the STATUS reported by apcupsd.
+type UpsStates []UpsState
+
+// Has returns true if state is one of the states.
+func (s UpsStates) Has(state UpsState) bool {
+	for _, v := range s {
+		if v == state {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ParseStates splits the STATUS reported by apcupsd into its component states.
+// Unknown states are included as-is.
+func ParseStates(raw string) UpsStates {
+	fields := strings.Fields(raw)
+	out := make(UpsStates, 0, len(fields))
+
+	for i := 0; i < len(fields); i++ {
+		// "SHUTTING DOWN" is the only state that contains a space
+		if fields[i] == "SHUTTING" && i+1 < len(fields) && fields[i+1] == "DOWN" {
+			out = append(out, StateShuttingDown)
+			i++
+			continue
+		}
+
+		out = append(out, UpsState(fields[i]))
+	}
+
+	return out
+}
+
+// OnBattery returns true if the UPS is running on batteries according to
+// STATFLAG if it was reported or according to STATUS if it was not.
+func (s *ApcStatus) OnBattery() bool {
+	if s.Flags != nil {
+		return s.Flags.OnBattery()
+	}
+
+	return s.States.Has(StateOnBattery)
+}
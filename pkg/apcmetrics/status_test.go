@@ -0,0 +1,49 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseStates(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want UpsStates
+	}{
+		{raw: "ONLINE", want: UpsStates{StateOnline}},
+		{raw: "ONBATT LOWBATT", want: UpsStates{StateOnBattery, StateLowBattery}},
+		{raw: "ONLINE REPLACEBATT ", want: UpsStates{StateOnline, StateReplaceBattery}},
+		{raw: "ONBATT SHUTTING DOWN", want: UpsStates{StateOnBattery, StateShuttingDown}},
+		{raw: "SHUTTING", want: UpsStates{"SHUTTING"}},
+		{raw: "COMMLOST", want: UpsStates{StateCommLost}},
+		{raw: "ONLINE BYPASS", want: UpsStates{StateOnline, "BYPASS"}},
+		{raw: "", want: UpsStates{}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.raw, func(t *testing.T) {
+			got := ParseStates(tc.raw)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("expected %v, got %v", tc.want, got)
+			}
+		})
+	}
+}
@@ -0,0 +1,129 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"context"
+	"time"
+
+	"github.com/go-kit/log"
+	"github.com/go-kit/log/level"
+)
+
+// eventKey uniquely identifies an event by its timestamp and message.
+type eventKey struct {
+	timestamp int64
+	message   string
+}
+
+func newEventKey(e ApcEvent) eventKey {
+	return eventKey{timestamp: e.TimeStamp.UnixNano(), message: e.Message}
+}
+
+// EventWatcher periodically fetches events from apcupsd and emits only those
+// events that have not been seen by previous polls.
+type EventWatcher struct {
+	source   Source
+	interval time.Duration
+	timeout  time.Duration
+	logger   log.Logger
+}
+
+// NewEventWatcher creates a new watcher that fetches events every interval,
+// allowing each request to take up to timeout.
+func NewEventWatcher(source Source, interval time.Duration, timeout time.Duration, logger log.Logger) *EventWatcher {
+	return &EventWatcher{
+		source:   source,
+		interval: interval,
+		timeout:  timeout,
+		logger:   logger,
+	}
+}
+
+// Watch fetches events immediately and then every interval until the context is
+// canceled, emitting each event that has not been seen before on the returned
+// channel. All events currently known to apcupsd are emitted by the first poll.
+// Later polls only emit events after the most recently emitted event, identified
+// by its timestamp and message. The channel is closed when the context is canceled.
+func (w *EventWatcher) Watch(ctx context.Context) <-chan ApcEvent {
+	out := make(chan ApcEvent)
+
+	go func() {
+		defer close(out)
+
+		ticker := time.NewTicker(w.interval)
+		defer ticker.Stop()
+
+		var last *eventKey
+		for {
+			events, err := w.poll(ctx)
+			if err != nil {
+				level.Warn(w.logger).Log("msg", "unable to poll UPS events", "err", err)
+			} else {
+				for _, e := range eventsAfter(events, last) {
+					select {
+					case out <- e:
+					case <-ctx.Done():
+						return
+					}
+				}
+
+				// keep the most recent event emitted if there are no events so
+				// that the same events aren't emitted again if they come back
+				if len(events) != 0 {
+					k := newEventKey(events[len(events)-1])
+					last = &k
+				}
+			}
+
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return out
+}
+
+// eventsAfter returns the events after the most recent occurrence of last. All
+// events are returned if last is nil or isn't one of the events, since apcupsd
+// only keeps the most recent events and the event was discarded (rotated away or
+// the events were cleared) before all events after it could be fetched.
+func eventsAfter(events []ApcEvent, last *eventKey) []ApcEvent {
+	if last == nil {
+		return events
+	}
+
+	for i := len(events) - 1; i >= 0; i-- {
+		if newEventKey(events[i]) == *last {
+			return events[i+1:]
+		}
+	}
+
+	return events
+}
+
+func (w *EventWatcher) poll(ctx context.Context) ([]ApcEvent, error) {
+	ctx, cancel := context.WithTimeout(ctx, w.timeout)
+	defer cancel()
+
+	return w.source.Events(ctx)
+}
@@ -0,0 +1,161 @@
+// apcmetrics - APC UPS metrics exporter for Prometheus
+//
+// Copyright 2021 Nick Pillitteri
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with this program.  If not, see <http://www.gnu.org/licenses/>.
+//
+
+package apcmetrics
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/go-kit/log"
+)
+
+// scriptedSource returns each list of events in turn from successive calls to
+// EventsRaw, repeating the final list once all have been returned. Status is
+// returned by the embedded staticSource.
+type scriptedSource struct {
+	staticSource
+
+	callMtx sync.Mutex
+	script  [][]string
+	calls   int
+}
+
+func (s *scriptedSource) Events(ctx context.Context) ([]ApcEvent, error) {
+	lines, _ := s.EventsRaw(ctx)
+	return ParseEventsFromLines(lines)
+}
+
+func (s *scriptedSource) EventsRaw(context.Context) ([]string, error) {
+	s.callMtx.Lock()
+	defer s.callMtx.Unlock()
+
+	i := s.calls
+	if i >= len(s.script) {
+		i = len(s.script) - 1
+	}
+
+	s.calls++
+	return s.script[i], nil
+}
+
+func (s *scriptedSource) numCalls() int {
+	s.callMtx.Lock()
+	defer s.callMtx.Unlock()
+	return s.calls
+}
+
+func TestEventWatcher_Watch(t *testing.T) {
+	const (
+		failure  = "2021-11-06 15:39:29 -0400  Power failure."
+		onBatt   = "2021-11-06 15:39:35 -0400  Running on UPS batteries."
+		mains    = "2021-11-06 15:40:23 -0400  Mains returned. No longer on UPS batteries."
+		back     = "2021-11-06 15:40:23 -0400  Power is back. UPS running on mains."
+		failure2 = "2021-11-06 16:00:00 -0400  Power failure."
+		onBatt2  = "2021-11-06 16:00:06 -0400  Running on UPS batteries."
+	)
+
+	tests := []struct {
+		name   string
+		script [][]string
+		want   []string
+	}{
+		{
+			name:   "initial events",
+			script: [][]string{{failure, onBatt}},
+			want:   []string{failure, onBatt},
+		},
+		{
+			name:   "appended events",
+			script: [][]string{{failure, onBatt}, {failure, onBatt, mains, back}},
+			want:   []string{failure, onBatt, mains, back},
+		},
+		{
+			name:   "rotated events",
+			script: [][]string{{failure, onBatt, mains}, {mains, back, failure2}},
+			want:   []string{failure, onBatt, mains, back, failure2},
+		},
+		{
+			name:   "rotated past last event",
+			script: [][]string{{failure, onBatt}, {back, failure2}},
+			want:   []string{failure, onBatt, back, failure2},
+		},
+		{
+			name:   "events cleared",
+			script: [][]string{{failure, onBatt}, {}, {failure2}},
+			want:   []string{failure, onBatt, failure2},
+		},
+		{
+			name:   "events cleared and old events return",
+			script: [][]string{{failure, onBatt}, {}, {failure, onBatt, failure2}},
+			want:   []string{failure, onBatt, failure2},
+		},
+		{
+			name:   "same timestamp",
+			script: [][]string{{failure, onBatt, mains}, {failure, onBatt, mains, back}},
+			want:   []string{failure, onBatt, mains, back},
+		},
+		{
+			name:   "clock stepped backwards",
+			script: [][]string{{failure2}, {failure2, onBatt}},
+			want:   []string{failure2, onBatt},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			source := &scriptedSource{script: tc.script}
+			watcher := NewEventWatcher(source, time.Millisecond, time.Second, log.NewNopLogger())
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			var got []ApcEvent
+			done := make(chan struct{})
+			events := watcher.Watch(ctx)
+			go func() {
+				defer close(done)
+				for e := range events {
+					got = append(got, e)
+				}
+			}()
+
+			// every event of a poll is emitted before the next poll starts, so
+			// all events have been emitted once the final list is polled again
+			deadline := time.Now().Add(2 * time.Second)
+			for source.numCalls() <= len(tc.script) && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+
+			cancel()
+			<-done
+
+			want, err := ParseEventsFromLines(tc.want)
+			if err != nil {
+				t.Fatalf("unexpected error parsing events: %s", err)
+			}
+
+			if !reflect.DeepEqual(want, got) {
+				t.Fatalf("expected events\n%v\ngot\n%v", want, got)
+			}
+		})
+	}
+}